@@ -0,0 +1,100 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+  "vm/object"
+  "vm/rom"
+)
+
+/**
+ * ASM
+ * =============================================================================
+ *
+ * Assembles a program into a ROM image that can be run without the source.
+ * With -c a module is assembled into an object file for vm link instead.
+ */
+func asm_command(args []string) int {
+  flags := flag.NewFlagSet("asm", flag.ExitOnError)
+  output := flags.String("o", "", "ROM file to write, defaults to the program name with a .rom extension")
+  strip := flags.Bool("strip", false, "leave out the symbol table")
+  compile := flags.Bool("c", false, "assemble a module into an object file to link later")
+  optimize := flags.Bool("opt", false, "run the peephole optimizer")
+  report := flags.Bool("opt-report", false, "run the peephole optimizer and print what it did")
+  flags.Parse(args)
+
+  if flags.NArg() != 1 {
+    fmt.Println("vm asm [-o prog.rom] [-strip] [--opt] [--opt-report] prog.asm")
+    fmt.Println("vm asm -c [-o module.o] module.asm")
+    return EXIT_USAGE
+  }
+
+  prog_file := flags.Arg(0)
+
+  if *compile {
+    if *output == "" {
+      *output = strings.TrimSuffix(prog_file, ".asm") + ".o"
+    }
+    return write_object(prog_file, *output)
+  }
+
+  img, err := load_image(prog_file, asm_options{*optimize, *report})
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  if *strip {
+    img.Symbols = nil
+  }
+
+  if *output == "" {
+    *output = strings.TrimSuffix(prog_file, ".asm") + ".rom"
+  }
+
+  file, err := os.Create(*output)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  if err := rom.Write(file, img); err != nil {
+    file.Close()
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+  if err := file.Close(); err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  return 0
+}
+
+func write_object(module_file string, output string) int {
+  obj, err := load_object(module_file)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  file, err := os.Create(output)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  if err := object.Write(file, obj); err != nil {
+    file.Close()
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+  if err := file.Close(); err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  return 0
+}
@@ -2,63 +2,493 @@ package assembler
 
 import (
   "fmt"
+  "sort"
   "strings"
-  "strconv"
-  "vm/instructions"
 )
 
-// TODO: The assembler is far from complete
-func Assemble(code string) []uint16 {
-  output := []uint16{}
-  lines := strings.Split(code, "\n")
+/**
+ * ASSEMBLER
+ * =============================================================================
+ *
+ * The assembler works in two passes. The first pass splits the source into
+ * statements, assigns every statement its memory address and records the
+ * address of every label. The second pass encodes the statements, resolving
+ * label references against the addresses collected in the first pass.
+ *
+ * A label is defined by a name followed by a colon, either on its own line or
+ * in front of a statement. Operands are separated by spaces or commas and
+ * everything after a semicolon is a comment.
+ *
+ *   loop:
+ *     ADD 0 0 1
+ *     JUMP loop   ; jumps back to the ADD
+ *
+ * Macros and includes are expanded before the first pass, see macro.go and
+ * include.go. Named constants and the constant pool are handled in
+ * constants.go, the data segment in data.go.
+ */
 
-  var prog_start int = 0
+type token struct {
+  text string
+  column int
+}
+
+type statement struct {
+  file string
+  line int
+  instr string
+  tokens []token
+  address uint16
+
+  // The macro expansion the statement came from, if any
+  expansion *expansion
+}
+
+// Creates an error diagnostic pointing at the token with the given index. An
+// index past the last token points just behind the statement. Statements from
+// a macro get a note pointing at every invocation that led to them.
+func (stmt statement) errorf(index int, format string, args ...interface{}) Diagnostic {
+  column := 1
+  if index < len(stmt.tokens) {
+    column = stmt.tokens[index].column
+  } else if len(stmt.tokens) > 0 {
+    last := stmt.tokens[len(stmt.tokens) - 1]
+    column = last.column + len(last.text)
+  }
+
+  d := Diagnostic{
+    File: stmt.file,
+    Line: stmt.line,
+    Column: column,
+    Message: fmt.Sprintf(format, args...),
+    Severity: SEVERITY_ERROR,
+  }
+
+  // Recursive macros repeat the same invocation, it is noted only once
+  for e := stmt.expansion; e != nil; {
+    times := 1
+    for e.parent != nil && *e.parent == (expansion{e.macro, e.file, e.line, e.column, e.parent.parent}) {
+      e = e.parent
+      times++
+    }
+
+    message := fmt.Sprintf("in expansion of macro %s", e.macro.name)
+    if times > 1 {
+      message += fmt.Sprintf(" (%d times)", times)
+    }
+
+    d.Notes = append(d.Notes, Diagnostic{
+      File: e.file,
+      Line: e.line,
+      Column: e.column,
+      Message: message,
+      Severity: SEVERITY_NOTE,
+    })
+    e = e.parent
+  }
+
+  return d
+}
+
+/**
+ * PROGRAM
+ * =============================================================================
+ *
+ * An assembled program. Its image is laid out the way the machine expects it
+ * in memory: the start address, the constant pool and then the code. The data
+ * segment is loaded right behind the image.
+ */
+type Program struct {
+  Entry uint16
+  Constants []uint16
+  Code []uint16
+  Data []uint16
+
+  // Address of every label
+  Symbols map[string]uint16
+}
+
+// Returns the memory image of the program
+func (p *Program) Image() []uint16 {
+  image := []uint16{p.Entry}
+  image = append(image, p.Constants...)
+  return append(image, p.Code...)
+}
+
+// Assembles source code that did not come from a file
+func Assemble(code string) ([]uint16, error) {
+  return AssembleFile("", code)
+}
+
+// Assembles the source code of the given file into a program image. The file
+// name is used in diagnostics and to find the files it includes.
+//
+// When anything goes wrong the returned error is a Diagnostics list holding
+// every problem found. If the list only holds warnings the program is returned
+// alongside it.
+func AssembleFile(file string, code string) ([]uint16, error) {
+  program, err := AssembleProgram(file, code)
+  if program == nil {
+    return nil, err
+  }
+  return program.Image(), err
+}
+
+// Same as AssembleFile, but keeps the segments and labels of the program apart
+func AssembleProgram(file string, code string) (*Program, error) {
+  program, _, err := assemble(file, code, false)
+  return program, err
+}
+
+// Same as AssembleProgram, but runs the optimizer over the code before encoding
+// it. Also returns the optimizations applied, see optimize.go.
+func AssembleOptimized(file string, code string) (*Program, []Optimization, error) {
+  return assemble(file, code, true)
+}
+
+func assemble(file string, code string, optimized bool) (*Program, []Optimization, error) {
+  var diags Diagnostics
+  var report []Optimization
+  var synthetic map[string]string
+
+  u := first_pass(file, code, &diags)
+
+  if optimized && !diags.HasErrors() {
+    report, synthetic = optimize(u)
+  }
+
+  // Word zero holds the address the program starts at
+  output := []uint16{uint16(u.prog_start)}
+
+  for _, stmt := range u.statements {
+    encode, _ := lookup_encoder(stmt.instr)
+
+    word, err := encode(stmt, u.labels)
+    if err != nil {
+      diags = append(diags, err.(Diagnostic))
+      continue
+    }
+    output = append(output, word)
+  }
+
+  data := []uint16{}
+  for _, stmt := range u.data {
+    words, err := encode_data(stmt)
+    if err != nil {
+      diags = append(diags, err.(Diagnostic))
+      continue
+    }
+    data = append(data, words...)
+  }
+
+  diags.sort(u.files)
+
+  if diags.HasErrors() {
+    return nil, nil, diags
+  }
+
+  for name := range synthetic {
+    delete(u.labels, name)
+  }
+  for name, offset := range u.data_labels {
+    u.labels[name] = uint16(len(output) + offset)
+  }
+
+  program := &Program{
+    Entry: uint16(u.prog_start),
+    Constants: output[1:u.prog_start],
+    Code: output[u.prog_start:],
+    Data: data,
+    Symbols: u.labels,
+  }
+
+  if len(diags) > 0 {
+    return program, report, diags
+  }
+  return program, report, nil
+}
+
+// Orders diagnostics the way the source reads, file by file in the order the
+// files were included
+func (l Diagnostics) sort(files []string) {
+  order := map[string]int{}
+  for i, f := range files {
+    order[f] = i
+  }
+
+  sort.SliceStable(l, func(i, j int) bool {
+    if l[i].File != l[j].File {
+      return order[l[i].File] < order[l[j].File]
+    }
+    if l[i].Line != l[j].Line {
+      return l[i].Line < l[j].Line
+    }
+    return l[i].Column < l[j].Column
+  })
+}
+
+// The result of the first pass
+type unit struct {
+  statements []statement
+  labels map[string]uint16
+  prog_start int
+
+  // Files read, the assembled one first
+  files []string
+
+  // The .export and .import directives, by symbol name
+  exports map[string]statement
+  imports map[string]statement
+
+  // The directives after .data and the offset of every label among them
+  data []statement
+  data_labels map[string]int
+}
+
+// Splits the source into statements and collects the address of every label.
+// Statements that do not occupy memory (START, labels, comments, .export and
+// .import) are dropped. Data directives are kept apart from the code.
+func first_pass(file string, code string, diags *Diagnostics) *unit {
+  statements := []statement{}
+  labels := map[string]uint16{}
+  data := []statement{}
+  data_labels := map[string]int{}
+  exports := map[string]statement{}
+  imports := map[string]statement{}
+  constants := map[string]int{}
+  definitions := map[string]statement{}
+  loads := []int{}
+
+  // Word zero is reserved for the start address
+  var address int = 1
+  var prog_start int = 1
+  var started bool = false
+  var in_data bool = false
+  var data_offset int = 0
+
+  lines, files := expand(file, code, diags)
+
+  for _, line := range lines {
+    stmt := statement{file: line.file, line: line.line, tokens: line.tokens, expansion: line.expansion}
+
+    for len(stmt.tokens) > 0 && strings.HasSuffix(stmt.tokens[0].text, ":") {
+      name := strings.TrimSuffix(stmt.tokens[0].text, ":")
+
+      if !is_identifier(name) {
+        *diags = append(*diags, stmt.errorf(0, "invalid label %q", name))
+      } else if _, exists := labels[name]; exists {
+        *diags = append(*diags, stmt.errorf(0, "label %q is already defined", name))
+      } else if _, exists := data_labels[name]; exists {
+        *diags = append(*diags, stmt.errorf(0, "label %q is already defined", name))
+      } else if in_data && is_register(name) {
+        *diags = append(*diags, stmt.errorf(0, "%s is a register", name))
+      } else if in_data {
+        if data_offset >= DATA_LIMIT {
+          *diags = append(*diags, stmt.errorf(0, "label %q is at offset %d, the devices are mapped from offset %d on", name, data_offset, DATA_LIMIT))
+        }
+        data_labels[name] = data_offset
+      } else {
+        labels[name] = uint16(address)
+      }
+
+      stmt.tokens = stmt.tokens[1:]
+    }
 
-  for i, line := range lines {
-    tokens := strings.Split(line, " ")
-    instr := tokens[0]
+    if len(stmt.tokens) == 0 {
+      continue
+    }
 
-    if (len(line) == 0) {
+    stmt.instr = strings.ToUpper(stmt.tokens[0].text)
+    stmt.address = uint16(address)
+    substitute_constants(&stmt, constants)
+
+    if stmt.instr == "START" {
+      if len(stmt.tokens) > 1 {
+        *diags = append(*diags, stmt.errorf(1, "START takes no operands"))
+      }
+      if in_data {
+        *diags = append(*diags, stmt.errorf(0, "START cannot go in the data segment, use .code first"))
+      }
+      prog_start = address
+      started = true
       continue
     }
 
-    switch instr {
-      case "CONST":
-        i, _ := strconv.Atoi(tokens[1])
-        output = append(output, 0x0000 | uint16(i))
-        break;
-      case "START":
-        prog_start = i + 1
-      case "LOADC":
-        reg, _ := strconv.Atoi(tokens[1])
-        val, _ := strconv.Atoi(tokens[2])
-        op := instructions.OP_LOADC << 12 | reg << 9 | val
-        output = append(output, uint16(op))
-        break;
-      case "ADD":
-        reg0, _ := strconv.Atoi(tokens[1])
-        reg1, _ := strconv.Atoi(tokens[2])
-        reg2, _ := strconv.Atoi(tokens[3])
-        op := instructions.OP_ADD << 12 | reg0 << 9 | 0 << 8 | reg1 << 5 | reg2
-        output = append(output, uint16(op))
-        break;
-      case "DBG":
-        op := instructions.OP_DBG << 12
-        output = append(output, uint16(op))
-        break;
-      case "HALT":
-        op := instructions.OP_HALT << 12
-        output = append(output, uint16(op))
-        break;
-      default:
-        fmt.Println("Unknown instruction: ", instr)
-        break;
+    if stmt.instr == ".EXPORT" || stmt.instr == ".IMPORT" {
+      symbols := exports
+      if stmt.instr == ".IMPORT" {
+        symbols = imports
+      }
+
+      if len(stmt.tokens) < 2 {
+        *diags = append(*diags, stmt.errorf(1, "%s needs at least one label", stmt.tokens[0].text))
+      }
+      for i, t := range stmt.tokens[1:] {
+        if !is_identifier(t.text) {
+          *diags = append(*diags, stmt.errorf(i + 1, "invalid label %q", t.text))
+        } else if _, exists := symbols[t.text]; !exists {
+          symbols[t.text] = statement{file: stmt.file, line: stmt.line, tokens: stmt.tokens[i + 1:i + 2], expansion: stmt.expansion}
+        }
+      }
+      continue
+    }
+
+    if stmt.instr == ".CONST" {
+      define_constant(stmt, constants, definitions, diags)
+      continue
+    }
+
+    if stmt.instr == ".DATA" || stmt.instr == ".CODE" {
+      if len(stmt.tokens) > 1 {
+        *diags = append(*diags, stmt.errorf(1, "%s takes no operands", stmt.tokens[0].text))
+      }
+      in_data = stmt.instr == ".DATA"
+      continue
+    }
+
+    if in_data {
+      size, err := data_size(stmt)
+      if err != nil {
+        *diags = append(*diags, err.(Diagnostic))
+        continue
+      }
+      if data_offset <= DATA_LIMIT && data_offset + size > DATA_LIMIT {
+        *diags = append(*diags, stmt.errorf(0, "the data segment is full, it can hold %d words before the devices", DATA_LIMIT))
+      }
+
+      stmt.address = uint16(data_offset)
+      data = append(data, stmt)
+      data_offset += size
+      continue
+    }
+
+    if _, ok := lookup_encoder(stmt.instr); !ok {
+      *diags = append(*diags, stmt.errorf(0, "unknown instruction %q", stmt.tokens[0].text))
+      continue
+    }
+
+    if stmt.instr == "CONST" && started {
+      warning := stmt.errorf(0, "CONST after START is placed between the instructions, not in the constant pool")
+      warning.Severity = SEVERITY_WARNING
+      *diags = append(*diags, warning)
+    }
+
+    if (stmt.instr == "CONST" || stmt.instr == ".WORD") && len(stmt.tokens) == 2 && strings.HasPrefix(stmt.tokens[1].text, "\"") {
+      for _, s := range expand_string(stmt, diags) {
+        s.address = uint16(address)
+        statements = append(statements, s)
+        address++
+      }
+      continue
+    }
+
+    if stmt.instr == "LOADI" {
+      loads = append(loads, len(statements))
+    }
+
+    statements = append(statements, stmt)
+    address++
+  }
+
+  for name, def := range definitions {
+    _, is_label := labels[name]
+    _, is_data := data_labels[name]
+    if is_label || is_data {
+      *diags = append(*diags, def.errorf(1, "%q is both a constant and a label", name))
+    }
+  }
+
+  // Data labels are offsets, they can be used wherever a number is expected
+  for i := range statements {
+    substitute_constants(&statements[i], data_labels)
+  }
+  for i := range data {
+    substitute_constants(&data[i], data_labels)
+  }
+
+  u := &unit{statements, labels, prog_start, files, exports, imports, data, data_labels}
+  place_loads(u, loads)
+  return u
+}
+
+// Splits a line into tokens, dropping the comment. Tokens are separated by
+// whitespace or commas. Quoted characters and strings are kept whole.
+func tokenize(line string) []token {
+  tokens := []token{}
+  start := -1
+
+  for i := 0; i <= len(line); i++ {
+    if i < len(line) && line[i] == ';' {
+      line = line[:i]
+    }
+
+    if i < len(line) && (line[i] == '\'' || line[i] == '"') {
+      if start < 0 {
+        start = i
       }
+      i = closing_quote(line, i)
+      continue
+    }
+
+    separator := i == len(line) || strings.IndexByte(" \t\r,", line[i]) >= 0
+
+    if separator && start >= 0 {
+      tokens = append(tokens, token{text: line[start:i], column: start + 1})
+      start = -1
+    } else if !separator && start < 0 {
+      start = i
+    }
   }
 
-  output = append(output, 0x0000)
-  copy(output[1:], output)
-  output[0] = uint16(prog_start)
+  return tokens
+}
+
+// Returns the index of the quote closing the one at start, or the end of the
+// line if there is none
+func closing_quote(line string, start int) int {
+  for i := start + 1; i < len(line); i++ {
+    if line[i] == '\\' {
+      i++
+    } else if line[i] == line[start] {
+      return i
+    }
+  }
+  return len(line) - 1
+}
+
+// Resolves the label in the given operand to an offset relative to the
+// instruction following the statement, as the program counter has already
+// been incremented when a jump executes.
+func relative_offset(stmt statement, index int, labels map[string]uint16, min int, max int) (int, error) {
+  target := stmt.tokens[index].text
+
+  address, ok := labels[target]
+  if !ok {
+    return 0, stmt.errorf(index, "undefined label %q", target)
+  }
+
+  offset := int(address) - (int(stmt.address) + 1)
+
+  if offset < min || offset > max {
+    return 0, stmt.errorf(index, "%s target %q is %d words away, the limit is %d to %d", stmt.instr, target, offset, min, max)
+  }
+
+  return offset, nil
+}
+
+func is_identifier(name string) bool {
+  if len(name) == 0 {
+    return false
+  }
+
+  for i, c := range name {
+    letter := c == '_' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+    digit := c >= '0' && c <= '9'
+
+    if !letter && !(digit && i > 0) {
+      return false
+    }
+  }
 
-  return output
+  return true
 }
@@ -0,0 +1,123 @@
+package assembler
+
+import (
+  "strings"
+  "testing"
+)
+
+var label_tests = []struct {
+  name string
+  code string
+  want []uint16
+}{
+  {
+    "forward jump",
+    "JUMP end\nHALT\nend: HALT",
+    []uint16{1, 0x5001, 0x0000, 0x0000},
+  },
+  {
+    "backward jump",
+    "loop:\n  ADD 0 0 1\n  JUMP loop",
+    []uint16{1, 0x6001, 0x5802},
+  },
+  {
+    "jump onto itself",
+    "self: JUMP self",
+    []uint16{1, 0x5801},
+  },
+  {
+    "label on its own line",
+    "JUMP next\nnext:\n\nHALT",
+    []uint16{1, 0x5000, 0x0000},
+  },
+  {
+    "several labels on one statement",
+    "a: b: HALT\nJUMP a\nJUMP b",
+    []uint16{1, 0x0000, 0x5802, 0x5803},
+  },
+  {
+    "labels count from the start of memory",
+    "CONST 5\nSTART\nstart: LOADC 0 0\nJUMP start",
+    []uint16{2, 5, 0x1000, 0x5802},
+  },
+  {
+    "comments are ignored",
+    "; a comment\nJUMP end ; skip the HALT\nHALT\nend: HALT ; done",
+    []uint16{1, 0x5001, 0x0000, 0x0000},
+  },
+}
+
+func TestLabels(t *testing.T) {
+  for _, test := range label_tests {
+    got, err := Assemble(test.code)
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+    if !equal_words(got, test.want) {
+      t.Errorf("%s: got %04X, want %04X", test.name, got, test.want)
+    }
+  }
+}
+
+var label_error_tests = []struct {
+  name string
+  code string
+  want string
+}{
+  {"undefined label", "JUMP nowhere", `<input>:1:6: error: undefined label "nowhere"`},
+  {"duplicate label", "a: HALT\na: HALT", `<input>:2:1: error: label "a" is already defined`},
+  {"invalid label", "1a: HALT", `<input>:1:1: error: invalid label "1a"`},
+  {"missing target", "HALT\nJUMP", "<input>:2:5: error: JUMP takes 1 operands, got 0"},
+  {"target too far", "JUMP end\n" + strings.Repeat("HALT\n", 1024) + "end: HALT", `<input>:1:6: error: JUMP target "end" is 1024 words away`},
+}
+
+func TestLabelErrors(t *testing.T) {
+  for _, test := range label_error_tests {
+    _, err := Assemble(test.code)
+    if err == nil || !strings.Contains(err.Error(), test.want) {
+      t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+    }
+  }
+}
+
+func TestLongestJump(t *testing.T) {
+  code := "JUMP end\n" + strings.Repeat("HALT\n", 1023) + "end: HALT"
+
+  got, err := Assemble(code)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got[1] != 0x53FF {
+    t.Errorf("got %04X, want 53FF", got[1])
+  }
+}
+
+func equal_words(a []uint16, b []uint16) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for i := range a {
+    if a[i] != b[i] {
+      return false
+    }
+  }
+  return true
+}
+
+func TestAssembleProgram(t *testing.T) {
+  program, err := AssembleProgram("prog.asm", "CONST 5\nCONST 6\nSTART\nstart: LOADC r0 0\nend: HALT")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if program.Entry != 3 || !equal_words(program.Constants, []uint16{5, 6}) || len(program.Code) != 2 {
+    t.Errorf("got entry %d, constants %d and code %04X", program.Entry, program.Constants, program.Code)
+  }
+  if program.Symbols["start"] != 3 || program.Symbols["end"] != 4 {
+    t.Errorf("got symbols %v", program.Symbols)
+  }
+  if !equal_words(program.Image(), []uint16{3, 5, 6, 0x1000, 0x0000}) {
+    t.Errorf("got image %04X", program.Image())
+  }
+}
@@ -0,0 +1,228 @@
+package assembler
+
+import (
+  "strconv"
+  "strings"
+  "unicode/utf8"
+)
+
+/**
+ * CONSTANTS
+ * =============================================================================
+ *
+ * .const gives a value a name, which any number operand after it can use in
+ * place of the value:
+ *
+ *   .const WIDTH 320
+ *   .const NEWLINE '\n'
+ *
+ *   CONST WIDTH
+ *   ADD r0 r0 #NEWLINE
+ *
+ * LOADI r0 1234 loads a value without a CONST line for it. The assembler puts
+ * the value into the constant pool, behind the constants listed with CONST and
+ * only once no matter how often it is loaded, and turns the LOADI into a LOADC
+ * of its index. LOADC can only reach the first 512 constants (its operand is 9
+ * bits wide), a LOADI needing more is an error.
+ *
+ * Characters can be written as 'A' or with an escape like '\n' wherever a
+ * number is expected. CONST "Hi" is short for CONST 'H' and CONST 'i', without
+ * a terminating zero.
+ */
+const CONST9_LIMIT = 0x200
+
+// Defines the constant of a .const statement
+func define_constant(stmt statement, constants map[string]int, definitions map[string]statement, diags *Diagnostics) {
+  if len(stmt.tokens) != 3 {
+    *diags = append(*diags, stmt.errorf(1, ".const takes a name and a value"))
+    return
+  }
+
+  name := stmt.tokens[1].text
+  if !is_identifier(name) {
+    *diags = append(*diags, stmt.errorf(1, "invalid constant name %q", name))
+    return
+  }
+  if _, err := parse_register(stmt, 1); err == nil {
+    *diags = append(*diags, stmt.errorf(1, "%s is a register", name))
+    return
+  }
+  if _, exists := constants[name]; exists {
+    *diags = append(*diags, stmt.errorf(1, "constant %q is already defined", name))
+    return
+  }
+
+  value, err := parse_number(stmt, 2, -0x8000, 0xFFFF)
+  if err != nil {
+    *diags = append(*diags, err.(Diagnostic))
+    return
+  }
+
+  constants[name] = value
+  definitions[name] = stmt
+}
+
+// Replaces the names of constants in the operands by their values. Jump
+// targets are labels and stay as they are.
+func substitute_constants(stmt *statement, constants map[string]int) {
+  if len(constants) == 0 || stmt.instr == ".EXPORT" || stmt.instr == ".IMPORT" {
+    return
+  }
+
+  first := 1
+  if stmt.instr == ".CONST" || is_jump(stmt.instr) {
+    first = 2
+  }
+
+  for i := first; i < len(stmt.tokens); i++ {
+    text := stmt.tokens[i].text
+    hash := ""
+    if strings.HasPrefix(text, "#") {
+      hash, text = "#", text[1:]
+    }
+
+    if value, ok := constants[text]; ok {
+      if i == first {
+        stmt.tokens = append([]token{}, stmt.tokens...)
+      }
+      stmt.tokens[i].text = hash + strconv.Itoa(value)
+    }
+  }
+}
+
+// Splits CONST "text" into a CONST per character
+func expand_string(stmt statement, diags *Diagnostics) []statement {
+  text, err := strconv.Unquote(stmt.tokens[1].text)
+  if err != nil {
+    *diags = append(*diags, stmt.errorf(1, "invalid string %s", stmt.tokens[1].text))
+    return nil
+  }
+  if text == "" {
+    *diags = append(*diags, stmt.errorf(1, "empty string"))
+    return nil
+  }
+
+  statements := []statement{}
+  for _, c := range text {
+    if c > 0xFFFF {
+      *diags = append(*diags, stmt.errorf(1, "%q does not fit into 16 bits", c))
+      return nil
+    }
+
+    s := stmt
+    s.tokens = []token{stmt.tokens[0], {text: strconv.Itoa(int(c)), column: stmt.tokens[1].column}}
+    statements = append(statements, s)
+  }
+  return statements
+}
+
+// Places the values of the LOADI statements in the constant pool and turns the
+// statements into LOADCs. The code behind the pool moves up by the number of
+// new constants.
+func place_loads(u *unit, loads []int) {
+  if len(loads) == 0 {
+    return
+  }
+
+  // The pool as written
+  pool := map[int]int{}
+  size := u.prog_start - 1
+  for i := size - 1; i >= 0; i-- {
+    stmt := u.statements[i]
+    if (stmt.instr != "CONST" && stmt.instr != ".WORD") || len(stmt.tokens) != 2 {
+      continue
+    }
+    if value, err := parse_number(stmt, 1, -0x8000, 0xFFFF); err == nil {
+      pool[int(uint16(value))] = i
+    }
+  }
+
+  // A LOADI left as it is gets reported by its encoder
+  added := []statement{}
+  for _, i := range loads {
+    stmt := &u.statements[i]
+    if len(stmt.tokens) != 3 {
+      continue
+    }
+
+    value, err := parse_number(*stmt, 2, -0x8000, 0xFFFF)
+    if err != nil {
+      continue
+    }
+
+    index, ok := pool[int(uint16(value))]
+    if !ok {
+      if size + len(added) >= CONST9_LIMIT {
+        continue
+      }
+
+      index = size + len(added)
+      pool[int(uint16(value))] = index
+
+      c := *stmt
+      c.instr = "CONST"
+      c.tokens = []token{{text: "CONST", column: stmt.tokens[0].column}, {text: strconv.Itoa(value), column: stmt.tokens[2].column}}
+      added = append(added, c)
+    }
+
+    if index >= CONST9_LIMIT {
+      continue
+    }
+
+    stmt.instr = "LOADC"
+    stmt.tokens = []token{stmt.tokens[0], stmt.tokens[1], {text: strconv.Itoa(index), column: stmt.tokens[2].column}}
+  }
+
+  if len(added) == 0 {
+    return
+  }
+
+  statements := append([]statement{}, u.statements[:size]...)
+  statements = append(statements, added...)
+  statements = append(statements, u.statements[size:]...)
+
+  for i := range statements {
+    statements[i].address = uint16(i + 1)
+  }
+  for name, address := range u.labels {
+    if int(address) >= u.prog_start {
+      u.labels[name] = address + uint16(len(added))
+    }
+  }
+
+  u.statements = statements
+  u.prog_start += len(added)
+}
+
+// LOADI reg value, for a LOADI that could not be placed in the pool
+func encode_loadi(stmt statement, labels map[string]uint16) (uint16, error) {
+  if err := operand_count(stmt, 2); err != nil {
+    return 0, err
+  }
+  if _, err := parse_register(stmt, 1); err != nil {
+    return 0, err
+  }
+  if _, err := parse_number(stmt, 2, -0x8000, 0xFFFF); err != nil {
+    return 0, err
+  }
+  return 0, stmt.errorf(2, "the constant pool is full, LOADC can only reach the first %d constants", CONST9_LIMIT)
+}
+
+// Parses a character literal like 'A' or '\n'
+func parse_char(text string) (int, bool) {
+  if len(text) < 3 || text[0] != '\'' {
+    return 0, false
+  }
+
+  s, err := strconv.Unquote(text)
+  if err != nil || utf8.RuneCountInString(s) != 1 {
+    return 0, false
+  }
+
+  c, _ := utf8.DecodeRuneInString(s)
+  return int(c), true
+}
+
+func is_quoted(text string) bool {
+  return strings.HasPrefix(text, "'") || strings.HasPrefix(text, "\"")
+}
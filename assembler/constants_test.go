@@ -0,0 +1,124 @@
+package assembler
+
+import (
+  "strings"
+  "testing"
+)
+
+// Every case assembles to the same image as its form without names, LOADI and
+// character literals
+var constant_tests = []struct {
+  name string
+  code string
+  plain string
+}{
+  {
+    "named constants",
+    ".const WIDTH 320\n.const STEP -2\nCONST WIDTH\nSTART\nLOADC r0 0\nADD r0 r0 #STEP",
+    "CONST 320\nSTART\nLOADC r0 0\nADD r0 r0 #-2",
+  },
+  {
+    "a constant as a register offset",
+    ".const SLOT 12\nSTOREM r0 SLOT",
+    "STOREM r0 12",
+  },
+  {
+    "LOADI goes behind the pool",
+    "CONST 5\nSTART\nLOADI r1 1234\nHALT",
+    "CONST 5\nCONST 1234\nSTART\nLOADC r1 1\nHALT",
+  },
+  {
+    "LOADI of a value in the pool",
+    "CONST 7\nCONST 8\nSTART\nLOADI r0 8",
+    "CONST 7\nCONST 8\nSTART\nLOADC r0 1",
+  },
+  {
+    "LOADI places a value once",
+    "START\nLOADI r0 -1\nLOADI r1 0xFFFF\nLOADI r2 3\nLOADI r3 -1",
+    "CONST -1\nCONST 3\nSTART\nLOADC r0 0\nLOADC r1 0\nLOADC r2 1\nLOADC r3 0",
+  },
+  {
+    "labels move with the code",
+    "START\nJUMP end\nLOADI r0 9\nend: HALT",
+    "CONST 9\nSTART\nJUMP end\nLOADC r0 0\nend: HALT",
+  },
+  {
+    "LOADI of a named constant",
+    ".const ANSWER 42\nSTART\nLOADI r0 ANSWER",
+    "CONST 42\nSTART\nLOADC r0 0",
+  },
+  {
+    "character literals",
+    ".const NEWLINE '\\n'\nCONST 'A'\nSTART\nLOADI r0 'x'\nADD r0 r0 #NEWLINE\nEQ r0 #'\\t'",
+    "CONST 65\nCONST 120\nSTART\nLOADC r0 1\nADD r0 r0 #10\nEQ r0 #9",
+  },
+  {
+    "strings",
+    "CONST \"Hi\"\nCONST 'j'\nSTART\nHALT",
+    "CONST 72\nCONST 105\nCONST 106\nSTART\nHALT",
+  },
+}
+
+func TestConstants(t *testing.T) {
+  for _, test := range constant_tests {
+    got, err := Assemble(test.code)
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+
+    want, err := Assemble(test.plain)
+    if err != nil {
+      t.Fatalf("%s: the plain form does not assemble: %v", test.name, err)
+    }
+
+    if !equal_words(got, want) {
+      t.Errorf("%s: got %04X, want %04X", test.name, got, want)
+    }
+  }
+}
+
+var constant_error_tests = []struct {
+  name string
+  code string
+  want string
+}{
+  {"missing value", ".const A", "prog.asm:1:8: error: .const takes a name and a value"},
+  {"register name", ".const r1 5", "prog.asm:1:8: error: r1 is a register"},
+  {"invalid name", ".const 1A 5", `prog.asm:1:8: error: invalid constant name "1A"`},
+  {"defined twice", ".const A 1\n.const A 2", `prog.asm:2:8: error: constant "A" is already defined`},
+  {"value out of range", ".const A 70000", "prog.asm:1:10: error: 70000 is out of range"},
+  {"unknown constant", "START\nLOADI r0 B", `prog.asm:2:10: error: "B" is not a number`},
+  {"constant and label", ".const loop 3\nloop: JUMP loop", `prog.asm:1:8: error: "loop" is both a constant and a label`},
+  {"empty string", "CONST \"\"", "prog.asm:1:7: error: empty string"},
+  {
+    "LOADC past the pool",
+    "START\nLOADC r0 512",
+    "prog.asm:2:10: error: constant 512 is out of reach, LOADC can only reach the first 512 constants",
+  },
+  {
+    "full pool",
+    strings.Repeat("CONST 0\n", 512) + "START\nLOADI r0 1",
+    "prog.asm:514:10: error: the constant pool is full, LOADC can only reach the first 512 constants",
+  },
+}
+
+func TestConstantErrors(t *testing.T) {
+  for _, test := range constant_error_tests {
+    _, err := AssembleFile("prog.asm", test.code)
+    if err == nil || !strings.HasPrefix(err.Error(), test.want) {
+      t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+    }
+  }
+}
+
+// A LOADI of a value already in the pool works even when the pool is full
+func TestLoadiFromAFullPool(t *testing.T) {
+  program, err := Assemble(strings.Repeat("CONST 0\n", 511) + "CONST 7\nSTART\nLOADI r0 7")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if program[len(program) - 1] != 0x1000 | 511 {
+    t.Errorf("got 0x%04X, want a LOADC of constant 511", program[len(program) - 1])
+  }
+}
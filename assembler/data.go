@@ -0,0 +1,126 @@
+package assembler
+
+import (
+  "strconv"
+  "vm/instructions"
+)
+
+/**
+ * DATA SEGMENT
+ * =============================================================================
+ *
+ * The read/write memory behind the code (the data window R_MAR points at) can
+ * be given initial contents. Everything after .data goes into the data segment
+ * and .code switches back to the code:
+ *
+ *   .data
+ *   counter:  .word 0
+ *   table:    .word 1 2 4 8
+ *   zeros:    .fill 8 0        ; 8 words of 0
+ *   greeting: .string "Hi\n"   ; one word per character and a zero
+ *   name:     .pstring "vm"    ; the length and one word per character
+ *   buffer:   .blkw 32         ; 32 words reserved, set to 0
+ *   .code
+ *
+ *   LOADM r0 counter
+ *   LOADI r1 greeting
+ *
+ * Labels in the data segment stand for their offset in the window, which is
+ * what LOADM and STOREM take. The segment ends where the standard devices are
+ * mapped, data or a label behind that would be hidden by a device.
+ */
+const DATA_LIMIT = instructions.DEVICE_OFFSET
+
+// Returns the number of words a data directive takes up. The size has to be
+// known in the first pass, so the counts of .fill and .blkw cannot use labels.
+func data_size(stmt statement) (int, error) {
+  switch stmt.instr {
+    case ".WORD":
+      if len(stmt.tokens) < 2 {
+        return 0, stmt.errorf(1, ".word needs at least one value")
+      }
+      return len(stmt.tokens) - 1, nil
+    case ".FILL", ".BLKW":
+      if stmt.instr == ".FILL" {
+        if err := operand_count(stmt, 2); err != nil {
+          return 0, err
+        }
+      } else if err := operand_count(stmt, 1); err != nil {
+        return 0, err
+      }
+      return parse_number(stmt, 1, 0, DATA_LIMIT)
+    case ".STRING", ".PSTRING":
+      if err := operand_count(stmt, 1); err != nil {
+        return 0, err
+      }
+      text, err := parse_string(stmt, 1)
+      if err != nil {
+        return 0, err
+      }
+      return len(text) + 1, nil
+  }
+  return 0, stmt.errorf(0, "only .word, .fill, .string, .pstring and .blkw can go in the data segment")
+}
+
+// Encodes a data directive into the words it stands for
+func encode_data(stmt statement) ([]uint16, error) {
+  words := []uint16{}
+
+  switch stmt.instr {
+    case ".WORD":
+      for i := 1; i < len(stmt.tokens); i++ {
+        value, err := parse_number(stmt, i, -0x8000, 0xFFFF)
+        if err != nil {
+          return nil, err
+        }
+        words = append(words, uint16(value))
+      }
+    case ".FILL":
+      count, _ := parse_number(stmt, 1, 0, DATA_LIMIT)
+      value, err := parse_number(stmt, 2, -0x8000, 0xFFFF)
+      if err != nil {
+        return nil, err
+      }
+      for i := 0; i < count; i++ {
+        words = append(words, uint16(value))
+      }
+    case ".BLKW":
+      count, _ := parse_number(stmt, 1, 0, DATA_LIMIT)
+      words = make([]uint16, count)
+    case ".STRING", ".PSTRING":
+      text, _ := parse_string(stmt, 1)
+      if stmt.instr == ".PSTRING" {
+        words = append(words, uint16(len(text)))
+      }
+      words = append(words, text...)
+      if stmt.instr == ".STRING" {
+        words = append(words, 0)
+      }
+  }
+
+  return words, nil
+}
+
+// Parses a quoted string into one word per character
+func parse_string(stmt statement, index int) ([]uint16, error) {
+  text, err := strconv.Unquote(stmt.tokens[index].text)
+  if err != nil || !is_quoted(stmt.tokens[index].text) {
+    return nil, stmt.errorf(index, "invalid string %s", stmt.tokens[index].text)
+  }
+
+  words := []uint16{}
+  for _, c := range text {
+    if c > 0xFFFF {
+      return nil, stmt.errorf(index, "%q does not fit into 16 bits", c)
+    }
+    words = append(words, uint16(c))
+  }
+  return words, nil
+}
+
+// Reports whether a name would be read as a register. Data labels are used as
+// operands, so they cannot be named like one.
+func is_register(name string) bool {
+  _, err := parse_register(statement{tokens: []token{{text: name}}}, 0)
+  return err == nil
+}
@@ -0,0 +1,111 @@
+package assembler
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+)
+
+// Every case assembles to the code of its plain form and the given data
+var data_tests = []struct {
+  name string
+  code string
+  plain string
+  data []uint16
+}{
+  {
+    "words",
+    ".data\ncounter: .word 0\ntable: .word 1 2 -1\n.code\nSTART\nLOADM r0 table",
+    "START\nLOADM r0 1",
+    []uint16{0, 1, 2, 0xFFFF},
+  },
+  {
+    "fill and blkw",
+    ".data\n.fill 3 'x'\nbuffer: .blkw 2\nend: .word 9\n.code\nSTART\nSTOREM r1 end",
+    "START\nSTOREM r1 5",
+    []uint16{'x', 'x', 'x', 0, 0, 9},
+  },
+  {
+    "strings",
+    ".data\ngreeting: .string \"Hi\\n\"\nname: .pstring \"vm\"\n.code\nSTART\nLOADM r0 name",
+    "START\nLOADM r0 4",
+    []uint16{'H', 'i', '\n', 0, 2, 'v', 'm'},
+  },
+  {
+    "data between the code",
+    "START\nLOADM r0 a\n.data\na: .word 5\n.code\nHALT\n.data\nb: .word 6\n.code\nLOADM r1 b",
+    "START\nLOADM r0 0\nHALT\nLOADM r1 1",
+    []uint16{5, 6},
+  },
+  {
+    "labels as counts and values",
+    ".const SIZE 2\n.data\nfirst: .word SIZE\nrest: .blkw SIZE\nlast: .word rest\n.code\nSTART\nHALT",
+    "START\nHALT",
+    []uint16{2, 0, 0, 1},
+  },
+}
+
+func TestData(t *testing.T) {
+  for _, test := range data_tests {
+    got, err := AssembleProgram("prog.asm", test.code)
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+
+    want, err := Assemble(test.plain)
+    if err != nil {
+      t.Fatalf("%s: the plain form does not assemble: %v", test.name, err)
+    }
+
+    if !equal_words(got.Image(), want) {
+      t.Errorf("%s: got code %04X, want %04X", test.name, got.Image(), want)
+    }
+    if !reflect.DeepEqual(got.Data, test.data) {
+      t.Errorf("%s: got data %04X, want %04X", test.name, got.Data, test.data)
+    }
+  }
+}
+
+var data_error_tests = []struct {
+  name string
+  code string
+  want string
+}{
+  {"instruction in the data segment", ".data\nADD r0 r0 r1", "prog.asm:2:1: error: only .word, .fill, .string, .pstring and .blkw can go in the data segment"},
+  {"empty word", ".data\n.word", "prog.asm:2:6: error: .word needs at least one value"},
+  {"fill without a value", ".data\n.fill 3", "prog.asm:2:8: error: .FILL takes 2 operands, got 1"},
+  {"count out of range", ".data\n.blkw 600", "prog.asm:2:7: error: 600 is out of range"},
+  {"invalid string", ".data\n.string hi", "prog.asm:2:9: error: invalid string hi"},
+  {"operands on .data", ".data 5", "prog.asm:1:7: error: .data takes no operands"},
+  {"START in the data segment", ".data\nSTART", "prog.asm:2:1: error: START cannot go in the data segment, use .code first"},
+  {"register as a label", ".data\nr2: .word 0", "prog.asm:2:1: error: r2 is a register"},
+  {"label defined twice", ".data\nx: .word 0\nx: .word 1", `prog.asm:3:1: error: label "x" is already defined`},
+  {"code and data label", "x: HALT\n.data\nx: .word 1", `prog.asm:3:1: error: label "x" is already defined`},
+  {"full segment", ".data\n.blkw 300\n.blkw 300", "prog.asm:3:1: error: the data segment is full, it can hold 496 words before the devices"},
+  {
+    "label behind the devices",
+    ".data\n.blkw 496\nlate: .word 1",
+    `prog.asm:3:1: error: label "late" is at offset 496, the devices are mapped from offset 496 on`,
+  },
+}
+
+func TestDataErrors(t *testing.T) {
+  for _, test := range data_error_tests {
+    _, err := AssembleFile("prog.asm", test.code)
+    if err == nil || !strings.HasPrefix(err.Error(), test.want) {
+      t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+    }
+  }
+}
+
+// A label behind the devices is reported once, not again where it is used
+func TestDataLabelBehindTheDevices(t *testing.T) {
+  _, err := AssembleFile("prog.asm", ".data\n.blkw 496\nlate: .word 1\n.code\nSTART\nLOADM r0 late")
+  if err == nil {
+    t.Fatal("a label behind the devices was accepted")
+  }
+  if strings.Contains(err.Error(), "not a number") {
+    t.Errorf("got %v, want no error where the label is used", err)
+  }
+}
@@ -0,0 +1,80 @@
+package assembler
+
+import (
+  "fmt"
+  "strings"
+)
+
+/**
+ * DIAGNOSTICS
+ * =============================================================================
+ *
+ * The assembler does not stop at the first problem. Every problem found is
+ * recorded as a Diagnostic pointing at the file, line and column it was found
+ * at, and all of them are returned together as Diagnostics.
+ *
+ * Notes attached to a diagnostic point at further places involved, like the
+ * invocation of the macro a problem was found in.
+ */
+type Severity int
+
+const (
+  SEVERITY_ERROR Severity = iota
+  SEVERITY_WARNING
+  SEVERITY_NOTE
+)
+
+func (s Severity) String() string {
+  switch s {
+    case SEVERITY_WARNING:
+      return "warning"
+    case SEVERITY_NOTE:
+      return "note"
+  }
+  return "error"
+}
+
+type Diagnostic struct {
+  File string
+  Line int
+  Column int
+  Message string
+  Severity Severity
+
+  Notes []Diagnostic
+}
+
+// Formats the diagnostic as file:line:column: severity: message, followed by
+// its notes on lines of their own
+func (d Diagnostic) Error() string {
+  file := d.File
+  if file == "" {
+    file = "<input>"
+  }
+
+  text := fmt.Sprintf("%s:%d:%d: %s: %s", file, d.Line, d.Column, d.Severity, d.Message)
+  for _, note := range d.Notes {
+    text += "\n" + note.Error()
+  }
+  return text
+}
+
+type Diagnostics []Diagnostic
+
+func (l Diagnostics) Error() string {
+  lines := make([]string, len(l))
+  for i, d := range l {
+    lines[i] = d.Error()
+  }
+  return strings.Join(lines, "\n")
+}
+
+// Reports whether any of the diagnostics is an error rather than a warning
+func (l Diagnostics) HasErrors() bool {
+  for _, d := range l {
+    if d.Severity == SEVERITY_ERROR {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,101 @@
+package assembler
+
+import (
+  "testing"
+)
+
+var diagnostic_tests = []struct {
+  name string
+  code string
+  want []string
+}{
+  {
+    "operand column",
+    "HALT\n  MOVE r1 r9",
+    []string{`prog.asm:2:11: error: "r9" is not a register (r0-r7)`},
+  },
+  {
+    "missing operand points behind the statement",
+    "ADD r0 r1",
+    []string{"prog.asm:1:10: error: ADD takes 3 operands, got 2"},
+  },
+  {
+    "unknown instruction",
+    "\tFOO r0",
+    []string{`prog.asm:1:2: error: unknown instruction "FOO"`},
+  },
+  {
+    "every error is reported",
+    "MOVE r9 r1\nFOO\nJUMP nowhere",
+    []string{
+      `prog.asm:1:6: error: "r9" is not a register (r0-r7)`,
+      `prog.asm:2:1: error: unknown instruction "FOO"`,
+      `prog.asm:3:6: error: undefined label "nowhere"`,
+    },
+  },
+  {
+    "both passes are reported in source order",
+    "JUMP nowhere\na: HALT\na: HALT",
+    []string{
+      `prog.asm:1:6: error: undefined label "nowhere"`,
+      `prog.asm:3:1: error: label "a" is already defined`,
+    },
+  },
+  {
+    "only the first bad operand of a statement is reported",
+    "ADD r9 r8 x",
+    []string{
+      `prog.asm:1:5: error: "r9" is not a register (r0-r7)`,
+    },
+  },
+  {
+    "START takes no operands",
+    "START now",
+    []string{"prog.asm:1:7: error: START takes no operands"},
+  },
+}
+
+func TestDiagnostics(t *testing.T) {
+  for _, test := range diagnostic_tests {
+    _, err := AssembleFile("prog.asm", test.code)
+
+    diags, ok := err.(Diagnostics)
+    if !ok {
+      t.Errorf("%s: got %v, want diagnostics", test.name, err)
+      continue
+    }
+
+    if len(diags) != len(test.want) {
+      t.Errorf("%s: got\n%v\nwant %d diagnostics", test.name, diags, len(test.want))
+      continue
+    }
+    for i, d := range diags {
+      if d.Error() != test.want[i] {
+        t.Errorf("%s: got %q, want %q", test.name, d.Error(), test.want[i])
+      }
+    }
+  }
+}
+
+func TestWarningsKeepTheProgram(t *testing.T) {
+  program, err := AssembleFile("prog.asm", "START\nCONST 5\nHALT")
+
+  diags, ok := err.(Diagnostics)
+  if !ok || len(diags) != 1 || diags.HasErrors() {
+    t.Fatalf("got %v, want a single warning", err)
+  }
+  if diags[0].Severity != SEVERITY_WARNING || diags[0].Line != 2 {
+    t.Errorf("got %v, want a warning on line 2", diags[0])
+  }
+  if len(program) != 3 {
+    t.Errorf("got %04X, want the program alongside the warning", program)
+  }
+}
+
+func TestDiagnosticWithoutFile(t *testing.T) {
+  _, err := Assemble("FOO")
+
+  if err == nil || err.Error() != `<input>:1:1: error: unknown instruction "FOO"` {
+    t.Errorf("got %v", err)
+  }
+}
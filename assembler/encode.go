@@ -0,0 +1,396 @@
+package assembler
+
+import (
+  "strconv"
+  "strings"
+  "vm/instructions"
+)
+
+/**
+ * ENCODING
+ * =============================================================================
+ *
+ * Every mnemonic has an encoder turning its operands into an instruction word.
+ * The bit layouts follow the diagrams next to each instruction in the
+ * interpreter.
+ *
+ * Registers are written as r0-r7 (or just 0-7), immediates are prefixed with
+ * a hash and can be negative or hexadecimal, e.g. #-3 or #0x1F.
+ *
+ * The .word directive places a raw word at the current address. LOADI is
+ * turned into a LOADC before encoding, see constants.go.
+ */
+type encoder func(stmt statement, labels map[string]uint16) (uint16, error)
+
+var encoders = map[string]encoder{
+  "HALT":   encode_none(instructions.OP_HALT),
+  "CONST":  encode_const,
+  "LOADC":  encode_reg_addr9(instructions.OP_LOADC),
+  "LOADI":  encode_loadi,
+  "MOVE":   encode_reg_reg(instructions.OP_MOVE),
+  "LOADM":  encode_reg_addr9(instructions.OP_LOADM),
+  "STOREM": encode_reg_addr9(instructions.OP_STOREM),
+  "JUMP":   encode_jump(0),
+  "CALL":   encode_jump(1),
+  "ADD":    encode_arith(instructions.OP_ADD),
+  "SUB":    encode_arith(instructions.OP_SUB),
+  "MUL":    encode_arith(instructions.OP_MUL),
+  "DIV":    encode_arith(instructions.OP_DIV),
+  "NOT":    encode_reg_reg(instructions.OP_NOT),
+  "EQ":     encode_compare(instructions.OP_EQ),
+  "LT":     encode_compare(instructions.OP_LT),
+  "LE":     encode_compare(instructions.OP_LE),
+  "DBG":    encode_ext(instructions.EXT_DBG, false),
+  "PUSH":   encode_ext(instructions.EXT_PUSH, true),
+  "POP":    encode_ext(instructions.EXT_POP, true),
+  "RET":    encode_ext(instructions.EXT_RET, false),
+  "TRAP":   encode_trap,
+  "GETC":   encode_trap_alias(instructions.TRAP_GETC),
+  "PUTC":   encode_trap_alias(instructions.TRAP_PUTC),
+  "PUTS":   encode_trap_alias(instructions.TRAP_PUTS),
+  "PUTI":   encode_trap_alias(instructions.TRAP_PUTI),
+  "PUTX":   encode_trap_alias(instructions.TRAP_PUTX),
+  "EXIT":   encode_trap_alias(instructions.TRAP_HALT),
+  "GETI":   encode_trap_alias(instructions.TRAP_GETI),
+  ".WORD":  encode_const,
+}
+
+// Finds the encoder for a mnemonic. Branches are looked up by their prefix, as
+// any combination of conditions can follow it.
+func lookup_encoder(instr string) (encoder, bool) {
+  if encode, ok := encoders[instr]; ok {
+    return encode, true
+  }
+
+  if _, ok := branch_conditions(instr); ok {
+    return encode_branch, true
+  }
+
+  return nil, false
+}
+
+// HALT
+func encode_none(op uint16) encoder {
+  return func(stmt statement, labels map[string]uint16) (uint16, error) {
+    if err := operand_count(stmt, 0); err != nil {
+      return 0, err
+    }
+    return op << 12, nil
+  }
+}
+
+// CONST value, .word value
+func encode_const(stmt statement, labels map[string]uint16) (uint16, error) {
+  if err := operand_count(stmt, 1); err != nil {
+    return 0, err
+  }
+
+  value, err := parse_number(stmt, 1, -0x8000, 0xFFFF)
+  if err != nil {
+    return 0, err
+  }
+
+  return uint16(value), nil
+}
+
+// LOADC reg const9, LOADM reg addr9, STOREM reg addr9
+func encode_reg_addr9(op uint16) encoder {
+  return func(stmt statement, labels map[string]uint16) (uint16, error) {
+    if err := operand_count(stmt, 2); err != nil {
+      return 0, err
+    }
+
+    r1, err := parse_register(stmt, 1)
+    if err != nil {
+      return 0, err
+    }
+
+    addr, err := parse_number(stmt, 2, -0x8000, 0xFFFF)
+    if err != nil {
+      return 0, err
+    }
+
+    if addr < 0 || addr > 0x1FF {
+      if op == instructions.OP_LOADC && addr > 0 {
+        return 0, stmt.errorf(2, "constant %d is out of reach, LOADC can only reach the first %d constants", addr, CONST9_LIMIT)
+      }
+      return 0, stmt.errorf(2, "%d is out of range (0 to 511)", addr)
+    }
+
+    return op << 12 | r1 << 9 | uint16(addr), nil
+  }
+}
+
+// MOVE src dst, NOT dst src
+func encode_reg_reg(op uint16) encoder {
+  return func(stmt statement, labels map[string]uint16) (uint16, error) {
+    if err := operand_count(stmt, 2); err != nil {
+      return 0, err
+    }
+
+    r1, err := parse_register(stmt, 1)
+    if err != nil {
+      return 0, err
+    }
+
+    r2, err := parse_register(stmt, 2)
+    if err != nil {
+      return 0, err
+    }
+
+    return op << 12 | r1 << 9 | r2 << 6, nil
+  }
+}
+
+// JUMP label, JUMP #offset, CALL label, CALL #offset
+//
+// A CALL is a JUMP with the link bit set.
+func encode_jump(link uint16) encoder {
+  return func(stmt statement, labels map[string]uint16) (uint16, error) {
+    if err := operand_count(stmt, 1); err != nil {
+      return 0, err
+    }
+
+    offset, err := parse_target(stmt, 1, labels, -0x3FF, 0x3FF)
+    if err != nil {
+      return 0, err
+    }
+
+    word := instructions.OP_JUMP << 12 | link << 10
+    if offset < 0 {
+      return word | 1 << 11 | uint16(-offset), nil
+    }
+    return word | uint16(offset), nil
+  }
+}
+
+// DBG, PUSH reg, POP reg, RET
+func encode_ext(ext uint16, has_reg bool) encoder {
+  return func(stmt statement, labels map[string]uint16) (uint16, error) {
+    word := uint16(instructions.OP_EXT << 12 | ext << 9)
+
+    if !has_reg {
+      if err := operand_count(stmt, 0); err != nil {
+        return 0, err
+      }
+      return word, nil
+    }
+
+    if err := operand_count(stmt, 1); err != nil {
+      return 0, err
+    }
+
+    r1, err := parse_register(stmt, 1)
+    if err != nil {
+      return 0, err
+    }
+
+    return word | r1 << 6, nil
+  }
+}
+
+// BRnzp label, BRnzp #offset
+//
+// Any combination of the n, z, p, c and v conditions can follow BR, a plain BR
+// branches on n, z and p and therefore always.
+func encode_branch(stmt statement, labels map[string]uint16) (uint16, error) {
+  if err := operand_count(stmt, 1); err != nil {
+    return 0, err
+  }
+
+  cond, _ := branch_conditions(stmt.instr)
+
+  offset, err := parse_target(stmt, 1, labels, -64, 63)
+  if err != nil {
+    return 0, err
+  }
+
+  return instructions.OP_BR << 12 | cond << 7 | uint16(offset) & 0x7F, nil
+}
+
+var branch_flags = map[rune]uint16{
+  'N': instructions.BR_N,
+  'Z': instructions.BR_Z,
+  'P': instructions.BR_P,
+  'C': instructions.BR_C,
+  'V': instructions.BR_V,
+}
+
+// Returns the condition mask of a branch mnemonic like BRNZ
+func branch_conditions(instr string) (uint16, bool) {
+  if !strings.HasPrefix(instr, "BR") {
+    return 0, false
+  }
+
+  conditions := instr[2:]
+  if conditions == "" {
+    return instructions.BR_N | instructions.BR_Z | instructions.BR_P, true
+  }
+
+  var cond uint16 = 0
+  for _, c := range conditions {
+    flag, ok := branch_flags[c]
+    if !ok || cond & flag != 0 {
+      return 0, false
+    }
+    cond |= flag
+  }
+
+  return cond, true
+}
+
+// TRAP vector, the vector can also be written LC-3 style as x21
+func encode_trap(stmt statement, labels map[string]uint16) (uint16, error) {
+  if err := operand_count(stmt, 1); err != nil {
+    return 0, err
+  }
+
+  // x20 is short for 0x20. The tokens are shared with the caller's statement,
+  // the operand is rewritten in a copy.
+  if text := stmt.tokens[1].text; strings.HasPrefix(text, "x") || strings.HasPrefix(text, "X") {
+    stmt.tokens = append([]token{}, stmt.tokens...)
+    stmt.tokens[1].text = "0x" + text[1:]
+  }
+
+  vector, err := parse_number(stmt, 1, 0, 0xFF)
+  if err != nil {
+    return 0, err
+  }
+
+  return instructions.OP_TRAP << 12 | uint16(vector), nil
+}
+
+// GETC, PUTC, PUTS, PUTI, PUTX, EXIT, GETI
+func encode_trap_alias(vector uint16) encoder {
+  return func(stmt statement, labels map[string]uint16) (uint16, error) {
+    if err := operand_count(stmt, 0); err != nil {
+      return 0, err
+    }
+    return instructions.OP_TRAP << 12 | vector, nil
+  }
+}
+
+// ADD dr r1 r2, ADD dr r1 #imm5 (same for SUB, MUL and DIV)
+func encode_arith(op uint16) encoder {
+  return func(stmt statement, labels map[string]uint16) (uint16, error) {
+    if err := operand_count(stmt, 3); err != nil {
+      return 0, err
+    }
+
+    dr, err := parse_register(stmt, 1)
+    if err != nil {
+      return 0, err
+    }
+
+    r1, err := parse_register(stmt, 2)
+    if err != nil {
+      return 0, err
+    }
+
+    if is_immediate(stmt, 3) {
+      imm5, err := parse_number(stmt, 3, -16, 15)
+      if err != nil {
+        return 0, err
+      }
+      return op << 12 | dr << 9 | 1 << 8 | r1 << 5 | uint16(imm5) & 0x1F, nil
+    }
+
+    r2, err := parse_register(stmt, 3)
+    if err != nil {
+      return 0, err
+    }
+
+    return op << 12 | dr << 9 | r1 << 5 | r2, nil
+  }
+}
+
+// EQ r1 r2, EQ r1 #imm8 (same for LT and LE)
+func encode_compare(op uint16) encoder {
+  return func(stmt statement, labels map[string]uint16) (uint16, error) {
+    if err := operand_count(stmt, 2); err != nil {
+      return 0, err
+    }
+
+    r1, err := parse_register(stmt, 1)
+    if err != nil {
+      return 0, err
+    }
+
+    if is_immediate(stmt, 2) {
+      imm8, err := parse_number(stmt, 2, -128, 127)
+      if err != nil {
+        return 0, err
+      }
+      return op << 12 | r1 << 9 | 1 << 8 | uint16(imm8) & 0xFF, nil
+    }
+
+    r2, err := parse_register(stmt, 2)
+    if err != nil {
+      return 0, err
+    }
+
+    return op << 12 | r1 << 9 | r2, nil
+  }
+}
+
+/**
+ * OPERANDS
+ * =============================================================================
+ */
+func operand_count(stmt statement, count int) error {
+  got := len(stmt.tokens) - 1
+
+  if got < count {
+    return stmt.errorf(got + 1, "%s takes %d operands, got %d", stmt.instr, count, got)
+  }
+  if got > count {
+    return stmt.errorf(count + 1, "%s takes %d operands, got %d", stmt.instr, count, got)
+  }
+  return nil
+}
+
+// Parses a jump target, either a label or an #offset
+func parse_target(stmt statement, index int, labels map[string]uint16, min int, max int) (int, error) {
+  if is_immediate(stmt, index) {
+    return parse_number(stmt, index, min, max)
+  }
+  return relative_offset(stmt, index, labels, min, max)
+}
+
+func is_immediate(stmt statement, index int) bool {
+  return strings.HasPrefix(stmt.tokens[index].text, "#")
+}
+
+func parse_register(stmt statement, index int) (uint16, error) {
+  text := stmt.tokens[index].text
+  name := strings.TrimPrefix(strings.TrimPrefix(text, "r"), "R")
+
+  r, err := strconv.Atoi(name)
+  if err != nil || r < 0 || r > 7 {
+    return 0, stmt.errorf(index, "%q is not a register (r0-r7)", text)
+  }
+
+  return uint16(r), nil
+}
+
+// Parses a number operand, an optional leading hash is ignored. Characters
+// like 'A' are numbers as well.
+func parse_number(stmt statement, index int, min int, max int) (int, error) {
+  text := strings.TrimPrefix(stmt.tokens[index].text, "#")
+
+  n, err := strconv.ParseInt(text, 0, 32)
+  if c, ok := parse_char(text); ok {
+    n, err = int64(c), nil
+  } else if is_quoted(text) && err != nil {
+    return 0, stmt.errorf(index, "%s is not a single character", text)
+  }
+  if err != nil {
+    return 0, stmt.errorf(index, "%q is not a number", text)
+  }
+
+  if int(n) < min || int(n) > max {
+    return 0, stmt.errorf(index, "%d is out of range (%d to %d)", n, min, max)
+  }
+
+  return int(n), nil
+}
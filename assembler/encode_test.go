@@ -0,0 +1,104 @@
+package assembler
+
+import (
+  "strings"
+  "testing"
+)
+
+var encode_tests = []struct {
+  code string
+  want uint16
+}{
+  {"HALT", 0x0000},
+  {"CONST 42", 0x002A},
+  {"CONST -1", 0xFFFF},
+  {"CONST 0xFFFF", 0xFFFF},
+  {"LOADC r3 511", 0x17FF},
+  {"LOADC 3 #7", 0x1607},
+  {"MOVE r1 r2", 0x2280},
+  {"LOADM r0 5", 0x3005},
+  {"STOREM r7 0x1FF", 0x4FFF},
+  {"JUMP #0", 0x5000},
+  {"JUMP #3", 0x5003},
+  {"JUMP #-3", 0x5803},
+  {"ADD r0 r1 r2", 0x6022},
+  {"ADD r0, r1, r2", 0x6022},
+  {"ADD r0 r1 #-16", 0x6130},
+  {"SUB r7 r7 #15", 0x7FEF},
+  {"MUL r1 r2 r3", 0x8243},
+  {"DIV r2 r3 #1", 0x9561},
+  {"NOT r4 r5", 0xA940},
+  {"EQ r1 r2", 0xB202},
+  {"LT r1 #-128", 0xC380},
+  {"LE r0 #127", 0xD17F},
+  {"DBG", 0xE000},
+  {"BRnzp #0", 0x0380},
+  {"BR #0", 0x0380},
+  {"BRz #5", 0x0105},
+  {"BRv #-1", 0x087F},
+  {"BRnc #63", 0x063F},
+  {"TRAP x25", 0xF025},
+  {"TRAP #0xFF", 0xF0FF},
+  {"GETC", 0xF020},
+  {"PUTC", 0xF021},
+  {"EXIT", 0xF025},
+  {"CALL #5", 0x5405},
+  {"CALL #-2", 0x5C02},
+  {"PUSH r3", 0xE2C0},
+  {"POP r1", 0xE440},
+  {"RET", 0xE600},
+}
+
+func TestEncode(t *testing.T) {
+  for _, test := range encode_tests {
+    got, err := Assemble(test.code)
+    if err != nil {
+      t.Errorf("%s: %v", test.code, err)
+      continue
+    }
+    if len(got) != 2 || got[1] != test.want {
+      t.Errorf("%s: got %04X, want %04X", test.code, got, test.want)
+    }
+  }
+}
+
+var encode_error_tests = []struct {
+  code string
+  want string
+}{
+  {"HALT r0", "HALT takes 0 operands, got 1"},
+  {"ADD r0 r1", "ADD takes 3 operands, got 2"},
+  {"MOVE r0 r8", `"r8" is not a register`},
+  {"MOVE x r1", `"x" is not a register`},
+  {"LOADC r0 512", "constant 512 is out of reach, LOADC can only reach the first 512 constants"},
+  {"ADD r0 r1 #16", "16 is out of range (-16 to 15)"},
+  {"EQ r0 #128", "128 is out of range (-128 to 127)"},
+  {"JUMP #1024", "1024 is out of range (-1023 to 1023)"},
+  {"CONST 0x10000", "65536 is out of range"},
+  {"CONST five", `"five" is not a number`},
+  {"PUSH", "PUSH takes 1 operands, got 0"},
+  {"RET r0", "RET takes 0 operands, got 1"},
+  {"BRz #64", "64 is out of range (-64 to 63)"},
+  {"BRx #0", `unknown instruction "BRx"`},
+}
+
+func TestEncodeErrors(t *testing.T) {
+  for _, test := range encode_error_tests {
+    _, err := Assemble(test.code)
+    if err == nil || !strings.Contains(err.Error(), test.want) {
+      t.Errorf("%s: got %v, want %q", test.code, err, test.want)
+    }
+  }
+}
+
+// Encoding leaves the statement as it was written
+func TestEncodeTrapKeepsItsOperand(t *testing.T) {
+  stmt := statement{instr: "TRAP", tokens: tokenize("TRAP x21")}
+
+  if word, err := encode_trap(stmt, nil); err != nil || word != 0xF021 {
+    t.Fatalf("got 0x%04X, %v, want 0xF021", word, err)
+  }
+  if stmt.tokens[1].text != "x21" {
+    t.Errorf("the operand was changed to %q", stmt.tokens[1].text)
+  }
+}
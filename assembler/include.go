@@ -0,0 +1,85 @@
+package assembler
+
+import (
+  "errors"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+/**
+ * INCLUDES
+ * =============================================================================
+ *
+ * .include "lib/math.asm" pastes in the lines of another file. The path is
+ * relative to the file containing the directive, or to the working directory
+ * for source that did not come from a file.
+ *
+ * Every file is included only once, later includes of the same file are
+ * skipped, so libraries can include what they need without defining labels
+ * twice. A file including itself, directly or through other files, is an
+ * error.
+ */
+func (e *expander) include(l source_line, first int) []source_line {
+  if len(l.tokens) != first + 2 {
+    *e.diags = append(*e.diags, l.errorf(first, ".include takes a single quoted file name"))
+    return nil
+  }
+
+  arg := l.tokens[first + 1].text
+  if len(arg) < 3 || !strings.HasPrefix(arg, "\"") || !strings.HasSuffix(arg, "\"") {
+    *e.diags = append(*e.diags, l.errorf(first + 1, "file name must be quoted, like \"lib/math.asm\""))
+    return nil
+  }
+
+  path := arg[1:len(arg) - 1]
+  if !filepath.IsAbs(path) && l.file != "" {
+    path = filepath.Join(filepath.Dir(l.file), path)
+  }
+  id := file_id(path)
+
+  for i, other := range e.stack {
+    if other == id {
+      cycle := []string{}
+      for _, f := range append(e.stack[i:len(e.stack):len(e.stack)], id) {
+        cycle = append(cycle, filepath.Base(f))
+      }
+      *e.diags = append(*e.diags, l.errorf(first + 1, "include cycle: %s", strings.Join(cycle, " -> ")))
+      return nil
+    }
+  }
+
+  if e.included[id] {
+    return nil
+  }
+
+  code, err := os.ReadFile(path)
+  if err != nil {
+    var path_err *os.PathError
+    if errors.As(err, &path_err) {
+      err = path_err.Err
+    }
+    *e.diags = append(*e.diags, l.errorf(first + 1, "cannot include %s: %v", arg, err))
+    return nil
+  }
+
+  e.files = append(e.files, path)
+  e.included[id] = true
+
+  e.stack = append(e.stack, id)
+  lines := e.process(split_lines(path, string(code)))
+  e.stack = e.stack[:len(e.stack) - 1]
+
+  return lines
+}
+
+// Identifies a file independent of the path it was reached through
+func file_id(path string) string {
+  if path == "" {
+    return ""
+  }
+  if abs, err := filepath.Abs(path); err == nil {
+    return abs
+  }
+  return filepath.Clean(path)
+}
@@ -0,0 +1,180 @@
+package assembler
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// Writes the files into a temporary directory and assembles main.asm
+func assemble_files(t *testing.T, files map[string]string) ([]uint16, error) {
+  t.Helper()
+
+  dir := t.TempDir()
+  for name, code := range files {
+    path := filepath.Join(dir, name)
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+      t.Fatal(err)
+    }
+    if err := os.WriteFile(path, []byte(code), 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  main := filepath.Join(dir, "main.asm")
+  return AssembleFile(main, files["main.asm"])
+}
+
+// Every case assembles to the same image as its expanded form
+var include_tests = []struct {
+  name string
+  files map[string]string
+  expanded string
+}{
+  {
+    "include",
+    map[string]string{
+      "main.asm": "START\nCALL square\nHALT\n.include \"square.asm\"",
+      "square.asm": "square:\n  MUL r0 r0 r0\n  RET",
+    },
+    "START\nCALL square\nHALT\nsquare:\nMUL r0 r0 r0\nRET",
+  },
+  {
+    "relative to the including file",
+    map[string]string{
+      "main.asm": ".include \"lib/all.asm\"\nHALT",
+      "lib/all.asm": ".include \"zero.asm\"",
+      "lib/zero.asm": "SUB r0 r0 r0",
+    },
+    "SUB r0 r0 r0\nHALT",
+  },
+  {
+    "included once",
+    map[string]string{
+      "main.asm": ".include \"a.asm\"\n.include \"b.asm\"\n.include \"./b.asm\"",
+      "a.asm": ".include \"b.asm\"\nADD r1 r1 #1",
+      "b.asm": "ADD r2 r2 #2",
+    },
+    "ADD r2 r2 #2\nADD r1 r1 #1",
+  },
+  {
+    "macros from an included file",
+    map[string]string{
+      "main.asm": ".include \"macros.asm\"\nZERO r3",
+      "macros.asm": ".macro ZERO r\n  SUB \\r \\r \\r\n.endm",
+    },
+    "SUB r3 r3 r3",
+  },
+  {
+    "included from a macro",
+    map[string]string{
+      "main.asm": ".macro LIB\n  .include \"lib.asm\"\n.endm\nLIB\nLIB",
+      "lib.asm": "HALT",
+    },
+    "HALT",
+  },
+}
+
+func TestIncludes(t *testing.T) {
+  for _, test := range include_tests {
+    got, err := assemble_files(t, test.files)
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+
+    want, err := Assemble(test.expanded)
+    if err != nil {
+      t.Fatalf("%s: the expanded form does not assemble: %v", test.name, err)
+    }
+
+    if !equal_words(got, want) {
+      t.Errorf("%s: got %04X, want %04X", test.name, got, want)
+    }
+  }
+}
+
+var include_error_tests = []struct {
+  name string
+  files map[string]string
+  want string
+}{
+  {
+    "missing file",
+    map[string]string{"main.asm": ".include \"nowhere.asm\""},
+    `main.asm:1:10: error: cannot include "nowhere.asm": no such file or directory`,
+  },
+  {
+    "unquoted name",
+    map[string]string{"main.asm": ".include lib.asm"},
+    `main.asm:1:10: error: file name must be quoted, like "lib/math.asm"`,
+  },
+  {
+    "missing name",
+    map[string]string{"main.asm": "HALT\n.include"},
+    "main.asm:2:1: error: .include takes a single quoted file name",
+  },
+  {
+    "including itself",
+    map[string]string{"main.asm": ".include \"main.asm\""},
+    "main.asm:1:10: error: include cycle: main.asm -> main.asm",
+  },
+  {
+    "cycle through other files",
+    map[string]string{
+      "main.asm": ".include \"a.asm\"",
+      "a.asm": ".include \"b.asm\"",
+      "b.asm": "HALT\n.include \"a.asm\"",
+    },
+    "b.asm:2:10: error: include cycle: a.asm -> b.asm -> a.asm",
+  },
+  {
+    "errors name the included file",
+    map[string]string{
+      "main.asm": ".include \"bad.asm\"",
+      "bad.asm": "HALT\nMOVE r9 r0",
+    },
+    `bad.asm:2:6: error: "r9" is not a register (r0-r7)`,
+  },
+}
+
+func TestIncludeErrors(t *testing.T) {
+  for _, test := range include_error_tests {
+    _, err := assemble_files(t, test.files)
+
+    diags, ok := err.(Diagnostics)
+    if !ok || len(diags) != 1 {
+      t.Errorf("%s: got %v, want one diagnostic", test.name, err)
+      continue
+    }
+
+    d := diags[0]
+    d.File = filepath.Base(d.File)
+    if got := strings.SplitN(d.Error(), "\n", 2)[0]; got != test.want {
+      t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+    }
+  }
+}
+
+// Diagnostics are ordered by the file they are in, in the order the files were
+// included, then by their position
+func TestIncludeDiagnosticOrder(t *testing.T) {
+  _, err := assemble_files(t, map[string]string{
+    "main.asm": "FOO\n.include \"a.asm\"\nJUMP nowhere",
+    "a.asm": "BAR",
+  })
+
+  diags, ok := err.(Diagnostics)
+  if !ok || len(diags) != 3 {
+    t.Fatalf("got %v, want three diagnostics", err)
+  }
+
+  want := []string{"main.asm:1", "main.asm:3", "a.asm:1"}
+  for i, d := range diags {
+    if got := fmt.Sprintf("%s:%d", filepath.Base(d.File), d.Line); got != want[i] {
+      t.Errorf("diagnostic %d is at %s, want %s", i, got, want[i])
+    }
+  }
+}
@@ -0,0 +1,319 @@
+package assembler
+
+import (
+  "fmt"
+  "strings"
+)
+
+/**
+ * MACROS
+ * =============================================================================
+ *
+ * A macro names a sequence of lines that is pasted in wherever the name is
+ * used like an instruction. The body refers to parameters as \name, they are
+ * replaced by the arguments of the invocation.
+ *
+ *   .macro ADDC dst, a, b   ; dst = constant a + constant b
+ *     LOADC \dst \a
+ *     LOADC r7 \b
+ *     ADD \dst \dst r7
+ *   .endm
+ *
+ *     ADDC r0, 0, 1
+ *
+ * Labels defined in a macro body are local to every expansion, so a macro
+ * with a loop can be used more than once. Macros can use other macros defined
+ * before them, up to MACRO_DEPTH expansions deep.
+ *
+ * Problems within an expansion are reported at the line of the macro body,
+ * with a note for every invocation that led there.
+ */
+const MACRO_DEPTH = 16
+
+type macro struct {
+  name string
+  params []string
+  body []source_line
+
+  // Labels defined in the body
+  labels map[string]bool
+}
+
+// A single use of a macro, the invocation is at file, line and column
+type expansion struct {
+  macro *macro
+  file string
+  line int
+  column int
+  parent *expansion
+}
+
+func (e *expansion) depth() int {
+  depth := 0
+  for ; e != nil; e = e.parent {
+    depth++
+  }
+  return depth
+}
+
+// A line of source split into tokens. Lines pasted in by a macro keep the
+// position in the macro body and remember the expansion they came from.
+type source_line struct {
+  file string
+  line int
+  tokens []token
+  expansion *expansion
+}
+
+// Creates a diagnostic at the token with the given index, see statement.errorf
+func (l source_line) errorf(index int, format string, args ...interface{}) Diagnostic {
+  return statement{file: l.file, line: l.line, tokens: l.tokens, expansion: l.expansion}.errorf(index, format, args...)
+}
+
+type expander struct {
+  macros map[string]*macro
+  diags *Diagnostics
+
+  // Number of expansions so far, makes local labels unique
+  count int
+
+  // Files in the order they were read and the files currently being read,
+  // see include.go
+  files []string
+  included map[string]bool
+  stack []string
+}
+
+// Splits the source into lines of tokens, collecting macro definitions,
+// replacing the invocations of macros by their bodies and .include directives
+// by the lines of the included file. Returns the lines and the files read.
+func expand(file string, code string, diags *Diagnostics) ([]source_line, []string) {
+  e := &expander{macros: map[string]*macro{}, diags: diags, included: map[string]bool{}}
+
+  id := file_id(file)
+  e.files = append(e.files, file)
+  e.included[id] = true
+  e.stack = append(e.stack, id)
+
+  return e.process(split_lines(file, code)), e.files
+}
+
+func split_lines(file string, code string) []source_line {
+  lines := []source_line{}
+  for i, text := range strings.Split(code, "\n") {
+    lines = append(lines, source_line{file: file, line: i + 1, tokens: tokenize(text)})
+  }
+  return lines
+}
+
+func (e *expander) process(lines []source_line) []source_line {
+  out := []source_line{}
+
+  for i := 0; i < len(lines); i++ {
+    l := lines[i]
+
+    // Labels in front of the instruction
+    first := 0
+    for first < len(l.tokens) && strings.HasSuffix(l.tokens[first].text, ":") {
+      first++
+    }
+    if first == len(l.tokens) {
+      out = append(out, l)
+      continue
+    }
+
+    name := strings.ToUpper(l.tokens[first].text)
+
+    switch {
+      case name == ".MACRO":
+        if first > 0 {
+          *e.diags = append(*e.diags, l.errorf(0, "a macro definition cannot be labelled"))
+        }
+        i = e.define(lines, i, first)
+
+      case name == ".ENDM":
+        *e.diags = append(*e.diags, l.errorf(first, ".endm without .macro"))
+
+      case name == ".INCLUDE":
+        if first > 0 {
+          out = append(out, source_line{file: l.file, line: l.line, tokens: l.tokens[:first], expansion: l.expansion})
+        }
+        out = append(out, e.include(l, first)...)
+
+      case e.macros[name] != nil:
+        if first > 0 {
+          out = append(out, source_line{file: l.file, line: l.line, tokens: l.tokens[:first], expansion: l.expansion})
+        }
+        out = append(out, e.invoke(e.macros[name], l, first)...)
+
+      default:
+        out = append(out, l)
+    }
+  }
+
+  return out
+}
+
+// Records the macro defined at lines[start] and returns the index of its
+// .endm line
+func (e *expander) define(lines []source_line, start int, first int) int {
+  l := lines[start]
+  tokens := l.tokens[first:]
+
+  end := start + 1
+  for ; end < len(lines); end++ {
+    body := lines[end].tokens
+    if len(body) > 0 && strings.ToUpper(body[0].text) == ".ENDM" {
+      break
+    }
+  }
+
+  if end == len(lines) {
+    *e.diags = append(*e.diags, l.errorf(first, "macro has no .endm"))
+    return end
+  }
+
+  if len(tokens) < 2 {
+    *e.diags = append(*e.diags, l.errorf(first + 1, ".macro needs a name"))
+    return end
+  }
+
+  m := &macro{name: strings.ToUpper(tokens[1].text), body: lines[start + 1:end], labels: map[string]bool{}}
+
+  if !is_identifier(tokens[1].text) {
+    *e.diags = append(*e.diags, l.errorf(first + 1, "invalid macro name %q", tokens[1].text))
+    return end
+  }
+  if _, ok := lookup_encoder(m.name); ok || m.name == "START" {
+    *e.diags = append(*e.diags, l.errorf(first + 1, "macro %q has the name of an instruction", tokens[1].text))
+    return end
+  }
+  if e.macros[m.name] != nil {
+    *e.diags = append(*e.diags, l.errorf(first + 1, "macro %q is already defined", tokens[1].text))
+    return end
+  }
+
+  params := map[string]bool{}
+  for i, param := range tokens[2:] {
+    if !is_identifier(param.text) || strings.Contains(param.text, ".") {
+      *e.diags = append(*e.diags, l.errorf(first + 2 + i, "invalid parameter name %q", param.text))
+    } else if params[param.text] {
+      *e.diags = append(*e.diags, l.errorf(first + 2 + i, "parameter %q is already defined", param.text))
+    }
+    params[param.text] = true
+    m.params = append(m.params, param.text)
+  }
+
+  for _, body := range m.body {
+    for i, t := range body.tokens {
+      if i == 0 && strings.ToUpper(t.text) == ".MACRO" {
+        *e.diags = append(*e.diags, body.errorf(i, "macro definitions cannot be nested"))
+      }
+      if strings.HasSuffix(t.text, ":") && !strings.Contains(t.text, "\\") {
+        m.labels[strings.TrimSuffix(t.text, ":")] = true
+      }
+      for _, ref := range parameter_references(t.text) {
+        if !params[ref] {
+          *e.diags = append(*e.diags, body.errorf(i, "macro %s has no parameter %q", tokens[1].text, ref))
+        }
+      }
+    }
+  }
+
+  e.macros[m.name] = m
+  return end
+}
+
+// Returns the lines of the macro body with the arguments of the invocation at
+// l filled in. Macros used by the body are expanded as well.
+func (e *expander) invoke(m *macro, l source_line, first int) []source_line {
+  ex := &expansion{macro: m, file: l.file, line: l.line, column: l.tokens[first].column, parent: l.expansion}
+
+  args := l.tokens[first + 1:]
+  if len(args) != len(m.params) {
+    *e.diags = append(*e.diags, l.errorf(first, "macro %s takes %d %s, got %d", m.name, len(m.params), plural(len(m.params), "argument"), len(args)))
+    return nil
+  }
+  if ex.depth() > MACRO_DEPTH {
+    *e.diags = append(*e.diags, l.errorf(first, "macro %s is nested more than %d expansions deep", m.name, MACRO_DEPTH))
+    return nil
+  }
+
+  values := map[string]string{}
+  for i, param := range m.params {
+    values[param] = args[i].text
+  }
+
+  e.count++
+
+  lines := []source_line{}
+  for _, body := range m.body {
+    tokens := make([]token, len(body.tokens))
+
+    for i, t := range body.tokens {
+      text := t.text
+
+      // Local labels get a name unique to this expansion
+      if name := strings.TrimSuffix(text, ":"); m.labels[name] {
+        text = fmt.Sprintf("%s.%s.%d", m.name, name, e.count) + strings.TrimPrefix(text, name)
+      }
+
+      tokens[i] = token{text: substitute(text, values), column: t.column}
+    }
+
+    lines = append(lines, source_line{file: body.file, line: body.line, tokens: tokens, expansion: ex})
+  }
+
+  return e.process(lines)
+}
+
+// Returns the names of the parameters referred to as \name in the text
+func parameter_references(text string) []string {
+  refs := []string{}
+  if is_quoted(strings.TrimPrefix(text, "#")) {
+    return refs
+  }
+  for i := 0; i < len(text); i++ {
+    if text[i] == '\\' {
+      end := parameter_end(text, i)
+      refs = append(refs, text[i + 1:end])
+      i = end - 1
+    }
+  }
+  return refs
+}
+
+// Replaces every \name in the text by the value of the parameter
+func substitute(text string, values map[string]string) string {
+  if !strings.Contains(text, "\\") || is_quoted(strings.TrimPrefix(text, "#")) {
+    return text
+  }
+
+  var b strings.Builder
+  for i := 0; i < len(text); i++ {
+    if text[i] != '\\' {
+      b.WriteByte(text[i])
+      continue
+    }
+    end := parameter_end(text, i)
+    b.WriteString(values[text[i + 1:end]])
+    i = end - 1
+  }
+  return b.String()
+}
+
+// Returns the end of the parameter name following the backslash at start
+func parameter_end(text string, start int) int {
+  end := start + 1
+  for end < len(text) && text[end] != '.' && is_identifier(text[start + 1:end + 1]) {
+    end++
+  }
+  return end
+}
+
+func plural(n int, word string) string {
+  if n == 1 {
+    return word
+  }
+  return word + "s"
+}
@@ -0,0 +1,146 @@
+package assembler
+
+import (
+  "fmt"
+  "strings"
+  "testing"
+)
+
+// Every case assembles to the same image as its expanded form
+var macro_tests = []struct {
+  name string
+  code string
+  expanded string
+}{
+  {
+    "parameters",
+    ".macro ADDC dst, a, b\n  LOADC \\dst \\a\n  LOADC r7 \\b\n  ADD \\dst \\dst r7\n.endm\nCONST 1\nCONST 2\nSTART\nADDC r0, 0, 1",
+    "CONST 1\nCONST 2\nSTART\nLOADC r0 0\nLOADC r7 1\nADD r0 r0 r7",
+  },
+  {
+    "parameters inside tokens",
+    ".macro INC n\n  ADD r\\n r\\n #1\n.endm\nINC 3",
+    "ADD r3 r3 #1",
+  },
+  {
+    "local labels in every expansion",
+    ".macro COUNTDOWN r\nloop:\n  SUB \\r \\r #1\n  BRp loop\n.endm\nCOUNTDOWN r0\nCOUNTDOWN r1",
+    "a:\nSUB r0 r0 #1\nBRp a\nb:\nSUB r1 r1 #1\nBRp b",
+  },
+  {
+    "labels outside the macro",
+    ".macro SKIP\n  JUMP end\n.endm\nSKIP\nHALT\nend: HALT",
+    "JUMP end\nHALT\nend: HALT",
+  },
+  {
+    "label in front of an invocation",
+    ".macro ZERO r\n  SUB \\r \\r \\r\n.endm\nJUMP here\nhere: ZERO r2",
+    "JUMP here\nhere: SUB r2 r2 r2",
+  },
+  {
+    "macros using macros",
+    ".macro ZERO r\n  SUB \\r \\r \\r\n.endm\n.macro ZERO2 a, b\n  ZERO \\a\n  ZERO \\b\n.endm\nZERO2 r1, r2",
+    "SUB r1 r1 r1\nSUB r2 r2 r2",
+  },
+  {
+    "names are not case sensitive",
+    ".macro zero r\n  SUB \\r \\r \\r\n.endm\nZero r1",
+    "SUB r1 r1 r1",
+  },
+  {
+    "an unused macro adds nothing",
+    ".macro ZERO r\n  SUB \\r \\r \\r\n.endm\nHALT",
+    "HALT",
+  },
+}
+
+func TestMacros(t *testing.T) {
+  for _, test := range macro_tests {
+    got, err := Assemble(test.code)
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+
+    want, err := Assemble(test.expanded)
+    if err != nil {
+      t.Fatalf("%s: the expanded form does not assemble: %v", test.name, err)
+    }
+
+    if !equal_words(got, want) {
+      t.Errorf("%s: got %04X, want %04X", test.name, got, want)
+    }
+  }
+}
+
+var macro_error_tests = []struct {
+  name string
+  code string
+  want string
+}{
+  {"wrong argument count", ".macro ZERO r\n  SUB \\r \\r \\r\n.endm\nZERO r1, r2", "prog.asm:4:1: error: macro ZERO takes 1 argument, got 2"},
+  {"missing .endm", ".macro ZERO r\n  SUB \\r \\r \\r", "prog.asm:1:1: error: macro has no .endm"},
+  {".endm without .macro", "HALT\n.endm", "prog.asm:2:1: error: .endm without .macro"},
+  {"missing name", ".macro\n.endm", "prog.asm:1:7: error: .macro needs a name"},
+  {"instruction name", ".macro ADD\n.endm", `prog.asm:1:8: error: macro "ADD" has the name of an instruction`},
+  {"defined twice", ".macro A\n.endm\n.macro A\n.endm", `prog.asm:3:8: error: macro "A" is already defined`},
+  {"duplicate parameter", ".macro A x, x\n.endm", `prog.asm:1:13: error: parameter "x" is already defined`},
+  {"unknown parameter", ".macro A x\n  MOVE \\y r0\n.endm", `prog.asm:2:8: error: macro A has no parameter "y"`},
+  {"nested definition", ".macro A\n.macro B\n.endm", "prog.asm:2:1: error: macro definitions cannot be nested"},
+  {"labelled definition", "here: .macro A\n.endm", "prog.asm:1:1: error: a macro definition cannot be labelled"},
+  {
+    "recursion stops at the depth limit",
+    ".macro LOOP\n  LOOP\n.endm\nLOOP",
+    "prog.asm:2:3: error: macro LOOP is nested more than 16 expansions deep",
+  },
+}
+
+func TestMacroErrors(t *testing.T) {
+  for _, test := range macro_error_tests {
+    _, err := AssembleFile("prog.asm", test.code)
+    if err == nil || !strings.HasPrefix(err.Error(), test.want) {
+      t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+    }
+  }
+}
+
+func TestMacroExpansionNotes(t *testing.T) {
+  code := ".macro BAD r\n  ADD \\r \\r #99\n.endm\n.macro OUTER\n  BAD r1\n.endm\nHALT\nOUTER"
+
+  _, err := AssembleFile("prog.asm", code)
+
+  diags, ok := err.(Diagnostics)
+  if !ok || len(diags) != 1 {
+    t.Fatalf("got %v, want one diagnostic", err)
+  }
+
+  want := "prog.asm:2:13: error: 99 is out of range (-16 to 15)\n" +
+    "prog.asm:5:3: note: in expansion of macro BAD\n" +
+    "prog.asm:8:1: note: in expansion of macro OUTER"
+  if diags[0].Error() != want {
+    t.Errorf("got\n%s\nwant\n%s", diags[0].Error(), want)
+  }
+}
+
+func TestMacroDepthLimit(t *testing.T) {
+  // A chain of MACRO_DEPTH macros each using the next one is allowed
+  var b strings.Builder
+  b.WriteString(".macro M1\n  HALT\n.endm\n")
+  for i := 2; i <= MACRO_DEPTH; i++ {
+    fmt.Fprintf(&b, ".macro M%d\n  M%d\n.endm\n", i, i - 1)
+  }
+
+  program, err := Assemble(b.String() + fmt.Sprintf("M%d", MACRO_DEPTH))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(program) != 2 {
+    t.Errorf("got %04X, want a single HALT", program)
+  }
+
+  // One more is not
+  fmt.Fprintf(&b, ".macro TOO_DEEP\n  M%d\n.endm\n", MACRO_DEPTH)
+  if _, err := Assemble(b.String() + "TOO_DEEP"); err == nil {
+    t.Errorf("expanded %d macros deep", MACRO_DEPTH + 1)
+  }
+}
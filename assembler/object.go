@@ -0,0 +1,133 @@
+package assembler
+
+import (
+  "sort"
+  "strings"
+  "vm/object"
+)
+
+/**
+ * OBJECT FILES
+ * =============================================================================
+ *
+ * Modules can be assembled on their own into object files and linked into a
+ * program later. A module lists the labels other modules may use with .export
+ * and the labels of other modules it uses with .import:
+ *
+ *   .import print_number
+ *   .export main
+ *   START
+ *   main:
+ *     LOADC r0 0
+ *     CALL print_number
+ *     HALT
+ *
+ * Imported labels can be the target of JUMP, CALL and branches. When a whole
+ * program is assembled at once the directives only document the module, every
+ * label has to be defined somewhere in the program.
+ *
+ * Object files carry no data segment, .data is only allowed when a program is
+ * assembled at once.
+ */
+
+// Assembles the source code of a module into a relocatable object. Problems
+// are reported the same way as by AssembleFile.
+func AssembleObject(file string, code string) (*object.Object, error) {
+  var diags Diagnostics
+
+  u := first_pass(file, code, &diags)
+  obj := &object.Object{}
+
+  if len(u.data) > 0 {
+    diags = append(diags, u.data[0].errorf(0, "object files have no data segment, assemble the whole program at once"))
+  }
+
+  for name, stmt := range u.imports {
+    if _, defined := u.labels[name]; defined {
+      diags = append(diags, stmt.errorf(0, "label %q is imported but also defined here", name))
+    }
+    obj.Imports = append(obj.Imports, name)
+  }
+  sort.Strings(obj.Imports)
+
+  for name, stmt := range u.exports {
+    address, defined := u.labels[name]
+    if !defined {
+      diags = append(diags, stmt.errorf(0, "exported label %q is not defined", name))
+    } else if int(address) < u.prog_start {
+      diags = append(diags, stmt.errorf(0, "exported label %q is not in the code", name))
+    } else {
+      obj.Exports = append(obj.Exports, object.Symbol{Name: name, Offset: address - uint16(u.prog_start)})
+    }
+  }
+  sort.Slice(obj.Exports, func(i, j int) bool { return obj.Exports[i].Offset < obj.Exports[j].Offset })
+
+  for name, address := range u.labels {
+    if int(address) >= u.prog_start {
+      obj.Labels = append(obj.Labels, object.Symbol{Name: name, Offset: address - uint16(u.prog_start)})
+    }
+  }
+  sort.Slice(obj.Labels, func(i, j int) bool { return obj.Labels[i].Offset < obj.Labels[j].Offset })
+
+  for _, stmt := range u.statements {
+    encode, _ := lookup_encoder(stmt.instr)
+    in_code := int(stmt.address) >= u.prog_start
+    offset := stmt.address - uint16(u.prog_start)
+
+    // A jump to an imported label is encoded with offset 0 for now, the
+    // linker fills in the distance
+    var reloc *object.Relocation
+    if in_code && len(stmt.tokens) == 2 {
+      if kind, ok := relocatable(stmt.instr); ok {
+        if _, imported := u.imports[stmt.tokens[1].text]; imported {
+          reloc = &object.Relocation{Kind: kind, Offset: offset, Symbol: stmt.tokens[1].text}
+          u.labels[reloc.Symbol] = stmt.address + 1
+        }
+      }
+    }
+
+    word, err := encode(stmt, u.labels)
+
+    if reloc != nil {
+      delete(u.labels, reloc.Symbol)
+      obj.Relocations = append(obj.Relocations, *reloc)
+    }
+    if in_code && stmt.instr == "LOADC" {
+      obj.Relocations = append(obj.Relocations, object.Relocation{Kind: object.RELOC_CONST, Offset: offset})
+    }
+
+    if err != nil {
+      diags = append(diags, err.(Diagnostic))
+      continue
+    }
+
+    if in_code {
+      obj.Code = append(obj.Code, word)
+    } else {
+      obj.Constants = append(obj.Constants, word)
+    }
+  }
+
+  diags.sort(u.files)
+
+  if diags.HasErrors() {
+    return nil, diags
+  }
+  if len(diags) > 0 {
+    return obj, diags
+  }
+  return obj, nil
+}
+
+// Returns the relocation for instructions that can refer to imported labels
+func relocatable(instr string) (object.RelocationKind, bool) {
+  switch {
+    case instr == "JUMP" || instr == "CALL":
+      return object.RELOC_JUMP, true
+    case strings.HasPrefix(instr, "BR"):
+      if _, ok := branch_conditions(instr); ok {
+        return object.RELOC_BRANCH, true
+      }
+  }
+  return 0, false
+}
@@ -0,0 +1,58 @@
+package assembler
+
+import (
+  "strings"
+  "testing"
+  "vm/object"
+)
+
+func TestAssembleObject(t *testing.T) {
+  code := "CONST 5\n.import print\n.export main\nSTART\nmain:\n  LOADC r0 0\nloop:\n  CALL print\n  BRnzp loop\n  HALT"
+
+  obj, err := AssembleObject("main.asm", code)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if !equal_words(obj.Constants, []uint16{5}) || len(obj.Code) != 4 {
+    t.Errorf("got constants %d and code %04X", obj.Constants, obj.Code)
+  }
+  if len(obj.Imports) != 1 || obj.Imports[0] != "print" {
+    t.Errorf("got imports %v", obj.Imports)
+  }
+  if len(obj.Exports) != 1 || obj.Exports[0] != (object.Symbol{Name: "main", Offset: 0}) {
+    t.Errorf("got exports %v", obj.Exports)
+  }
+
+  want := []object.Relocation{
+    {Kind: object.RELOC_CONST, Offset: 0},
+    {Kind: object.RELOC_JUMP, Offset: 1, Symbol: "print"},
+  }
+  if len(obj.Relocations) != len(want) || obj.Relocations[0] != want[0] || obj.Relocations[1] != want[1] {
+    t.Errorf("got relocations %v, want %v", obj.Relocations, want)
+  }
+
+  // The jump to the import is left at offset 0, the local branch is resolved
+  if obj.Code[1] & 0x3FF != 0 || obj.Code[2] & 0x7F != 0x7E {
+    t.Errorf("got code %04X", obj.Code)
+  }
+}
+
+var object_error_tests = []struct {
+  name string
+  code string
+  want string
+}{
+  {"import defined here", ".import f\nSTART\nf: HALT", `main.asm:1:9: error: label "f" is imported but also defined here`},
+  {"export not defined", ".export f\nSTART\nHALT", `main.asm:1:9: error: exported label "f" is not defined`},
+  {"export of a constant", "c: CONST 1\n.export c\nSTART\nHALT", `main.asm:2:9: error: exported label "c" is not in the code`},
+}
+
+func TestAssembleObjectErrors(t *testing.T) {
+  for _, test := range object_error_tests {
+    _, err := AssembleObject("main.asm", test.code)
+    if err == nil || !strings.HasPrefix(err.Error(), test.want) {
+      t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+    }
+  }
+}
@@ -0,0 +1,520 @@
+package assembler
+
+import (
+  "fmt"
+  "strings"
+)
+
+/**
+ * OPTIMIZER
+ * =============================================================================
+ *
+ * An optional peephole pass between the first pass and encoding. It applies a
+ * set of rules to the code until none of them fires any more:
+ *
+ *   self-move   MOVE r1 r1 is dropped
+ *   add-zero    ADD r1 r1 #0 and SUB r1 r1 #0 are dropped
+ *   mul-one     MUL r1 r1 #1 and DIV r1 r1 #1 are dropped
+ *   jump-next   a JUMP or BR to the instruction right after it is dropped
+ *   reload      a LOADC of the constant the register already holds is dropped
+ *   hoist       a LOADC into a register the loop writes nothing else to is
+ *               moved in front of the loop
+ *
+ * The rules keep the behaviour of the program, down to the final state of the
+ * machine:
+ *
+ *   - An instruction right after a compare is never touched, the compare
+ *     decides whether it runs. Nothing is inserted right after a compare.
+ *   - Most instructions set the flags. One is only dropped if the flags are
+ *     set again before any branch, jump, compare or trap could look at them.
+ *   - Jumps with an #offset are turned into jumps to labels first, so they
+ *     still reach the same instruction when code before it is dropped.
+ *
+ * Labels in front of a dropped instruction move to the instruction after it.
+ */
+type Optimization struct {
+  Rule string
+  File string
+  Line int
+  Message string
+}
+
+func (o Optimization) String() string {
+  file := o.File
+  if file == "" {
+    file = "<input>"
+  }
+  return fmt.Sprintf("%s:%d: %s: %s", file, o.Line, o.Rule, o.Message)
+}
+
+type optimizer struct {
+  statements []statement
+
+  // Statement index of every label and of the entry point
+  targets map[string]int
+  entry int
+
+  // Labels made up for jumps with an #offset and the offset they replace
+  synthetic map[string]string
+
+  report []Optimization
+}
+
+type rule struct {
+  name string
+  apply func(o *optimizer, i int) (string, bool)
+}
+
+var rules = []rule{
+  {"self-move", self_move},
+  {"add-zero", identity("ADD", "SUB", "#0")},
+  {"mul-one", identity("MUL", "DIV", "#1")},
+  {"jump-next", jump_next},
+  {"reload", reload},
+  {"hoist", hoist},
+}
+
+// Runs the rules on the code of the unit and updates its addresses and labels.
+// Returns what was done and the labels made up along the way, which are needed
+// to encode the unit but are no symbols of the program.
+func optimize(u *unit) ([]Optimization, map[string]string) {
+  o := &optimizer{
+    statements: u.statements,
+    targets: map[string]int{},
+    entry: u.prog_start - 1,
+    synthetic: map[string]string{},
+  }
+  for name, address := range u.labels {
+    o.targets[name] = int(address) - 1
+  }
+
+  if !o.label_offsets() {
+    return nil, nil
+  }
+
+  for changed := true; changed; {
+    changed = false
+    for i := o.entry; i < len(o.statements) && !changed; i++ {
+      for _, r := range rules {
+        stmt := o.statements[i]
+        if message, ok := r.apply(o, i); ok {
+          o.report = append(o.report, Optimization{r.name, stmt.file, stmt.line, message})
+          changed = true
+          break
+        }
+      }
+    }
+  }
+
+  u.statements = o.statements
+  for i := range u.statements {
+    u.statements[i].address = uint16(i + 1)
+  }
+  for name, i := range o.targets {
+    u.labels[name] = uint16(i + 1)
+  }
+  u.prog_start = o.entry + 1
+
+  return o.report, o.synthetic
+}
+
+// Turns every jump with an #offset into a jump to a made up label. Reports
+// false if one of them leaves the program, it is then left alone.
+func (o *optimizer) label_offsets() bool {
+  for i := range o.statements {
+    stmt := &o.statements[i]
+    if !is_jump(stmt.instr) || len(stmt.tokens) != 2 || !is_immediate(*stmt, 1) {
+      continue
+    }
+
+    offset, err := parse_number(*stmt, 1, -0x3FF, 0x3FF)
+    if err != nil {
+      return false
+    }
+
+    target := i + 1 + offset
+    if target < 0 || target > len(o.statements) {
+      return false
+    }
+
+    name := fmt.Sprintf(".opt.%d", len(o.synthetic))
+    for _, exists := o.targets[name]; exists; _, exists = o.targets[name] {
+      name += "_"
+    }
+
+    o.targets[name] = target
+    o.synthetic[name] = stmt.tokens[1].text
+
+    tokens := append([]token{}, stmt.tokens...)
+    tokens[1].text = name
+    stmt.tokens = tokens
+  }
+  return true
+}
+
+/**
+ * EFFECTS
+ * =============================================================================
+ */
+
+// What an instruction does to the registers and flags. Control covers
+// everything the optimizer cannot see past: jumps, branches, calls, traps,
+// compares, data and statements it does not understand.
+type effect struct {
+  reads uint8
+  writes uint8
+  flags bool
+  control bool
+}
+
+func effects(stmt statement) effect {
+  register := func(index int) uint8 {
+    r, _ := parse_register(stmt, index)
+    return 1 << r
+  }
+
+  valid := func(count int, registers ...int) bool {
+    if len(stmt.tokens) != count + 1 {
+      return false
+    }
+    for _, index := range registers {
+      if _, err := parse_register(stmt, index); err != nil {
+        return false
+      }
+    }
+    return true
+  }
+
+  switch stmt.instr {
+    case "LOADC", "LOADM":
+      if valid(2, 1) {
+        return effect{writes: register(1), flags: true}
+      }
+
+    case "STOREM":
+      if valid(2, 1) {
+        return effect{reads: register(1)}
+      }
+
+    case "MOVE":
+      if valid(2, 1, 2) {
+        return effect{reads: register(1), writes: register(2), flags: true}
+      }
+
+    case "NOT":
+      if valid(2, 1, 2) {
+        return effect{reads: register(2), writes: register(1), flags: true}
+      }
+
+    case "ADD", "SUB", "MUL", "DIV":
+      if valid(3, 1, 2) {
+        e := effect{reads: register(2), writes: register(1), flags: true}
+        if !is_immediate(stmt, 3) {
+          if !valid(3, 3) {
+            break
+          }
+          e.reads |= register(3)
+        }
+        return e
+      }
+
+    case "PUSH":
+      if valid(1, 1) {
+        return effect{reads: register(1)}
+      }
+
+    case "POP":
+      if valid(1, 1) {
+        return effect{writes: register(1), flags: true}
+      }
+  }
+
+  return effect{control: true}
+}
+
+func is_jump(instr string) bool {
+  if instr == "JUMP" || instr == "CALL" {
+    return true
+  }
+  _, ok := branch_conditions(instr)
+  return ok
+}
+
+func is_compare(instr string) bool {
+  return instr == "EQ" || instr == "LT" || instr == "LE"
+}
+
+// Reports whether the statement only runs if the compare before it holds
+func (o *optimizer) conditional(i int) bool {
+  return i > 0 && is_compare(o.statements[i - 1].instr)
+}
+
+// Reports whether the flags at statement i are set again before anything
+// could look at them
+func (o *optimizer) flags_dead(i int) bool {
+  for ; i < len(o.statements); i++ {
+    e := effects(o.statements[i])
+    if e.control {
+      return false
+    }
+    if e.flags {
+      return true
+    }
+  }
+  return false
+}
+
+// Reports whether a label at statement i is the target of a jump
+func (o *optimizer) labelled(i int) bool {
+  for _, target := range o.targets {
+    if target == i {
+      return true
+    }
+  }
+  return false
+}
+
+/**
+ * EDITING
+ * =============================================================================
+ */
+func (o *optimizer) remove(i int) {
+  o.statements = append(o.statements[:i:i], o.statements[i + 1:]...)
+
+  for name, target := range o.targets {
+    if target > i {
+      o.targets[name] = target - 1
+    }
+  }
+  if o.entry > i {
+    o.entry--
+  }
+}
+
+// Inserts the statement in front of statement i. Labels at i move along with
+// statement i, a program starting at i starts with the new statement.
+func (o *optimizer) insert(i int, stmt statement) {
+  o.statements = append(o.statements[:i:i], append([]statement{stmt}, o.statements[i:]...)...)
+
+  for name, target := range o.targets {
+    if target >= i {
+      o.targets[name] = target + 1
+    }
+  }
+  if o.entry > i {
+    o.entry++
+  }
+}
+
+// Returns the statement as written
+func (o *optimizer) text(stmt statement) string {
+  parts := make([]string, len(stmt.tokens))
+  for i, t := range stmt.tokens {
+    parts[i] = t.text
+    if offset, ok := o.synthetic[t.text]; ok {
+      parts[i] = offset
+    }
+  }
+  return strings.Join(parts, " ")
+}
+
+// Drops statement i if that is safe and describes what was done
+func (o *optimizer) drop(i int, reason string) (string, bool) {
+  if o.conditional(i) {
+    return "", false
+  }
+
+  stmt := o.statements[i]
+  if effects(stmt).flags && !o.flags_dead(i + 1) {
+    return "", false
+  }
+
+  o.remove(i)
+  return fmt.Sprintf("removed %s%s", o.text(stmt), reason), true
+}
+
+/**
+ * RULES
+ * =============================================================================
+ */
+
+// MOVE r1 r1
+func self_move(o *optimizer, i int) (string, bool) {
+  stmt := o.statements[i]
+  e := effects(stmt)
+  if stmt.instr != "MOVE" || e.control || e.reads != e.writes {
+    return "", false
+  }
+  return o.drop(i, "")
+}
+
+// ADD r1 r1 #0 and the like
+func identity(first string, second string, operand string) func(o *optimizer, i int) (string, bool) {
+  return func(o *optimizer, i int) (string, bool) {
+    stmt := o.statements[i]
+    if stmt.instr != first && stmt.instr != second {
+      return "", false
+    }
+
+    e := effects(stmt)
+    if e.control || e.reads != e.writes || !is_immediate(stmt, 3) {
+      return "", false
+    }
+
+    if value, err := parse_number(stmt, 3, -16, 15); err != nil || fmt.Sprintf("#%d", value) != operand {
+      return "", false
+    }
+    return o.drop(i, "")
+  }
+}
+
+// JUMP next, BRnz next
+func jump_next(o *optimizer, i int) (string, bool) {
+  stmt := o.statements[i]
+  if stmt.instr == "CALL" || !is_jump(stmt.instr) || len(stmt.tokens) != 2 {
+    return "", false
+  }
+
+  if target, ok := o.targets[stmt.tokens[1].text]; !ok || target != i + 1 {
+    return "", false
+  }
+  return o.drop(i, ", it goes to the next instruction anyway")
+}
+
+// LOADC r1 3 when r1 already holds constant 3 from an earlier LOADC in the
+// same straight run of code
+func reload(o *optimizer, i int) (string, bool) {
+  stmt := o.statements[i]
+  e := effects(stmt)
+  if stmt.instr != "LOADC" || e.control {
+    return "", false
+  }
+
+  for j := i - 1; j >= o.entry; j-- {
+    if o.labelled(j + 1) {
+      return "", false
+    }
+
+    prev := o.statements[j]
+    pe := effects(prev)
+
+    if pe.control && !is_compare(prev.instr) {
+      return "", false
+    }
+    if pe.writes & e.writes == 0 {
+      continue
+    }
+
+    if prev.instr != "LOADC" || prev.tokens[2].text != stmt.tokens[2].text || o.conditional(j) {
+      return "", false
+    }
+    return o.drop(i, fmt.Sprintf(", %s already holds constant %s", stmt.tokens[1].text, stmt.tokens[2].text))
+  }
+
+  return "", false
+}
+
+// Moves LOADC r1 3 in front of the loop it is in, if the loop writes nothing
+// else to r1 and nothing before it in the loop reads r1. Every other LOADC r1 3
+// in the loop is dropped as well.
+//
+// A loop runs from a label to a JUMP back to it. It must only be entered at
+// the top, and the LOADC must run on every entry before anything could leave
+// the loop.
+func hoist(o *optimizer, i int) (string, bool) {
+  stmt := o.statements[i]
+  e := effects(stmt)
+  if stmt.instr != "LOADC" || e.control || o.conditional(i) {
+    return "", false
+  }
+
+  top, bottom := -1, -1
+  for j := i + 1; j < len(o.statements) && top < 0; j++ {
+    s := o.statements[j]
+    if s.instr == "JUMP" && len(s.tokens) == 2 {
+      if target, ok := o.targets[s.tokens[1].text]; ok && target <= i && target >= o.entry {
+        top, bottom = target, j
+      }
+    }
+  }
+  if top < 0 || o.conditional(top) {
+    return "", false
+  }
+
+  // Nothing outside jumps into the loop, and the program does not start in it
+  if o.entry > top && o.entry <= bottom {
+    return "", false
+  }
+  for name, target := range o.targets {
+    if target < top || target > bottom {
+      continue
+    }
+    for j, s := range o.statements {
+      if (j < top || j > bottom) && is_jump(s.instr) && len(s.tokens) == 2 && s.tokens[1].text == name {
+        return "", false
+      }
+    }
+  }
+
+  // The LOADC runs first thing on every entry
+  for j := top; j < i; j++ {
+    je := effects(o.statements[j])
+    if je.control || (je.reads | je.writes) & e.writes != 0 {
+      return "", false
+    }
+  }
+
+  // The loop writes nothing else to the register and calls nothing that could
+  // change it behind the optimizer's back: CALL, traps, data and anything else
+  // it cannot see past rule the move out. Jumps, compares and RET only repeat
+  // or leave the loop.
+  removable := []int{}
+  for j := top; j <= bottom; j++ {
+    s := o.statements[j]
+    je := effects(s)
+
+    if s.instr == "CALL" || strings.HasPrefix(s.instr, ".") || (je.control && !is_jump(s.instr) && !is_compare(s.instr) && s.instr != "RET") {
+      return "", false
+    }
+    if je.writes & e.writes == 0 {
+      continue
+    }
+    if s.instr != "LOADC" || s.tokens[2].text != stmt.tokens[2].text {
+      return "", false
+    }
+    if !o.conditional(j) {
+      removable = append(removable, j)
+    }
+  }
+
+  // Try it out on a copy and check the flags of everything moved or dropped
+  trial := &optimizer{
+    statements: append([]statement{}, o.statements...),
+    targets: map[string]int{},
+    entry: o.entry,
+  }
+  for name, target := range o.targets {
+    trial.targets[name] = target
+  }
+
+  gaps := []int{}
+  for n := len(removable) - 1; n >= 0; n-- {
+    trial.remove(removable[n])
+  }
+  for n, j := range removable {
+    gaps = append(gaps, j - n + 1)
+  }
+  trial.insert(top, stmt)
+
+  if !trial.flags_dead(top + 1) {
+    return "", false
+  }
+  for _, gap := range gaps {
+    if !trial.flags_dead(gap) {
+      return "", false
+    }
+  }
+
+  o.statements, o.targets, o.entry = trial.statements, trial.targets, trial.entry
+  return fmt.Sprintf("moved %s out of the loop ending at line %d", o.text(stmt), o.statements[bottom - len(removable) + 1].line), true
+}
@@ -0,0 +1,254 @@
+package assembler_test
+
+import (
+  "bytes"
+  "context"
+  "strings"
+  "testing"
+  "vm/assembler"
+  "vm/compiler"
+  "vm/vm"
+)
+
+/**
+ * OPTIMIZER
+ * =============================================================================
+ *
+ * Every program is run once as written and once optimized. Both runs have to
+ * end in the same state: the general registers, the flags, the output and the
+ * read/write memory. The program counter and the stack pointer may differ, as
+ * the optimized code is shorter.
+ */
+
+// The state of a machine that ran a program to its end
+type final_state struct {
+  reg [8]uint16
+  cond uint16
+  exit_code uint16
+  output string
+  data []uint16
+}
+
+func run_program(t *testing.T, program *assembler.Program) final_state {
+  t.Helper()
+
+  out := &bytes.Buffer{}
+  m := vm.New()
+  m.In = strings.NewReader("")
+  m.Out = out
+  m.MaxSteps = 1 << 20
+  m.Load(program.Image())
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatalf("run failed: %v", err)
+  }
+
+  state := final_state{cond: m.Reg[vm.R_COND], exit_code: m.ExitCode, output: out.String()}
+  copy(state.reg[:], m.Reg[:8])
+  state.data = append(state.data, m.Memory[m.Reg[vm.R_MAR]:int(m.Reg[vm.R_MAR]) + vm.DATA_SIZE]...)
+  return state
+}
+
+// Assembles the program with and without the optimizer, checks both end in the
+// same state and returns the rules applied
+func compare_optimized(t *testing.T, source string) map[string]bool {
+  t.Helper()
+
+  plain, err := assembler.AssembleProgram("plain.asm", source)
+  if err != nil {
+    t.Fatalf("assembling failed: %v", err)
+  }
+  optimized, report, err := assembler.AssembleOptimized("plain.asm", source)
+  if err != nil {
+    t.Fatalf("assembling with the optimizer failed: %v", err)
+  }
+
+  want := run_program(t, plain)
+  got := run_program(t, optimized)
+
+  if got.reg != want.reg {
+    t.Errorf("registers %v, want %v", got.reg, want.reg)
+  }
+  if got.cond != want.cond {
+    t.Errorf("flags %s, want %s", vm.FlagNames(got.cond), vm.FlagNames(want.cond))
+  }
+  if got.exit_code != want.exit_code {
+    t.Errorf("exit code %d, want %d", got.exit_code, want.exit_code)
+  }
+  if got.output != want.output {
+    t.Errorf("output %q, want %q", got.output, want.output)
+  }
+  for i := range want.data {
+    if got.data[i] != want.data[i] {
+      t.Errorf("data offset %d holds 0x%04X, want 0x%04X", i, got.data[i], want.data[i])
+    }
+  }
+
+  rules := map[string]bool{}
+  for _, o := range report {
+    rules[o.Rule] = true
+  }
+  return rules
+}
+
+var optimizer_tests = []struct {
+  rule string
+  source string
+}{
+  {"self-move", `
+CONST 5
+START
+  LOADC r1 0
+  MOVE r1 r1
+  ADD r2 r1 #1
+  MOVE r2 r0
+  PUTI
+  STOREM r2 3
+  HALT
+`},
+  {"add-zero", `
+CONST 7
+START
+  LOADC r1 0
+  ADD r1 r1 #0
+  SUB r1 r1 #0
+  MOVE r1 r0
+  STOREM r0 1
+  PUTI
+  HALT
+`},
+  {"mul-one", `
+CONST 9
+START
+  LOADC r1 0
+  MUL r1 r1 #1
+  DIV r1 r1 #1
+  NOT r2 r1
+  STOREM r2 0
+  HALT
+`},
+  {"jump-next", `
+CONST 2
+START
+  LOADC r0 0
+  JUMP next
+next:
+  BRz after
+after:
+  PUTI
+  STOREM r0 2
+  HALT
+`},
+  {"reload", `
+CONST 3
+START
+  LOADC r1 0
+  ADD r2 r1 r1
+  LOADC r1 0
+  MUL r0 r2 r1
+  STOREM r0 4
+  PUTI
+  HALT
+`},
+  {"hoist", `
+CONST 4
+CONST 1
+START
+  LOADC r0 0
+loop:
+  LOADC r1 1
+  SUB r0 r0 r1
+  STOREM r0 2
+  EQ r0 #0
+  JUMP done
+  JUMP loop
+done:
+  PUTI
+  HALT
+`},
+}
+
+func TestOptimizerRules(t *testing.T) {
+  for _, test := range optimizer_tests {
+    t.Run(test.rule, func(t *testing.T) {
+      rules := compare_optimized(t, test.source)
+      if !rules[test.rule] {
+        t.Errorf("rule %s did not fire, applied %v", test.rule, rules)
+      }
+    })
+  }
+}
+
+// Code the rules must leave alone: an instruction after a compare, flags read
+// by a branch and a loop writing the register it loads
+func TestOptimizerKeepsBehaviour(t *testing.T) {
+  programs := []string{`
+CONST 0
+START
+  LOADC r1 0
+  EQ r1 #1
+  MOVE r1 r1
+  ADD r0 r1 #0
+  BRz zero
+  LOADC r0 0
+zero:
+  HALT
+`, `
+CONST 1
+START
+  LOADC r0 0
+loop:
+  LOADC r1 0
+  ADD r1 r1 r0
+  ADD r0 r0 #1
+  STOREM r1 0
+  LT r0 #5
+  JUMP loop
+  HALT
+`}
+
+  for _, source := range programs {
+    compare_optimized(t, source)
+  }
+}
+
+const optimizer_expression = `
+fn fact(n) {
+  if n <= 1 { 1 } else { n * fact(n - 1) }
+}
+
+fn main() {
+  let i = 1;
+  let total = 0;
+  while i <= 6 {
+    print(fact(i));
+    putc(10);
+    total = total + i;
+    i = i + 1
+  }
+  total
+}
+`
+
+const optimizer_lisp = `
+(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))
+(define i 0)
+(while (< i 10)
+  (display (fib i))
+  (newline)
+  (set! i (+ i 1)))
+`
+
+func TestOptimizerOnCompiledPrograms(t *testing.T) {
+  expression, err := compiler.Compile("prog.vl", optimizer_expression)
+  if err != nil {
+    t.Fatal(err)
+  }
+  compare_optimized(t, expression)
+
+  lisp, err := compiler.CompileLisp("prog.lisp", optimizer_lisp)
+  if err != nil {
+    t.Fatal(err)
+  }
+  compare_optimized(t, lisp)
+}
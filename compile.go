@@ -0,0 +1,59 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "vm/compiler"
+)
+
+/**
+ * COMPILE
+ * =============================================================================
+ *
+ * Compiles a program in the expression language to assembly, which vm asm,
+ * vm run and vm debug take from there. With -o - the assembly is written to
+ * stdout.
+ */
+func compile_command(args []string) int {
+  flags := flag.NewFlagSet("compile", flag.ExitOnError)
+  output := flags.String("o", "", "assembly file to write, defaults to the program name with a .asm extension")
+  flags.Parse(args)
+
+  if flags.NArg() != 1 {
+    fmt.Println("vm compile [-o prog.asm] prog.vl")
+    return EXIT_USAGE
+  }
+
+  source_file := flags.Arg(0)
+
+  source, err := os.ReadFile(source_file)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  code, err := compiler.Compile(source_file, string(source))
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  if *output == "-" {
+    fmt.Print(code)
+    return 0
+  }
+
+  if *output == "" {
+    *output = strings.TrimSuffix(source_file, filepath.Ext(source_file)) + ".asm"
+  }
+
+  if err := os.WriteFile(*output, []byte(code), 0644); err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  return 0
+}
@@ -0,0 +1,101 @@
+package compiler
+
+/**
+ * SYNTAX TREE
+ * =============================================================================
+ *
+ * The parsers produce a tree of expressions, the code generator turns it into
+ * assembly. Everything is an expression with a value: a block has the value
+ * of its last expression, a while loop and an empty block have the value 0.
+ */
+type position struct {
+  line int
+  column int
+}
+
+func (p position) pos() position {
+  return p
+}
+
+type node interface {
+  pos() position
+}
+
+type number_node struct {
+  position
+  value int
+}
+
+type variable_node struct {
+  position
+  name string
+}
+
+type assign_node struct {
+  position
+  name string
+  value node
+}
+
+// Defines a new variable in the enclosing block
+type let_node struct {
+  position
+  name string
+  value node
+}
+
+type unary_node struct {
+  position
+  op string
+  operand node
+}
+
+type binary_node struct {
+  position
+  op string
+  left node
+  right node
+}
+
+type call_node struct {
+  position
+  name string
+  args []node
+}
+
+// Else may be nil
+type if_node struct {
+  position
+  cond node
+  then node
+  otherwise node
+}
+
+type while_node struct {
+  position
+  cond node
+  body node
+}
+
+type block_node struct {
+  position
+  exprs []node
+}
+
+type return_node struct {
+  position
+  value node
+}
+
+type function struct {
+  position
+  name string
+  params []string
+  body node
+}
+
+// Globals are only declared here, assignments in main give them their values
+type program struct {
+  functions []*function
+  globals []string
+}
@@ -0,0 +1,720 @@
+package compiler
+
+import (
+  "fmt"
+  "strings"
+  "vm/assembler"
+  "vm/instructions"
+)
+
+/**
+ * CODE GENERATION
+ * =============================================================================
+ *
+ * The generator walks the tree and writes assembly. Every expression leaves
+ * its value in a temporary, which lives in a register or, when the registers
+ * run out, in a slot of the data window (LOADM/STOREM).
+ *
+ *   R0      return values and trap arguments
+ *   R1-R3   the first three variables of a function
+ *   R4-R6   temporaries
+ *   R7      scratch
+ *
+ * Variables beyond the third and temporaries that do not fit into registers
+ * are spilled to slots. When a temporary is needed and all registers are
+ * taken, the oldest temporary held in a register is spilled. The variables of
+ * a block give their register or slot back when the block ends.
+ *
+ * Before control flow splits (if, while) all temporaries are spilled, so both
+ * paths agree on where every value is when they meet again.
+ *
+ * Global variables have slots of their own at the start of the window, which
+ * are never spilled to or saved.
+ *
+ * Calls follow a caller saves convention: the caller pushes the variable
+ * registers and every slot in use, passes the arguments in the registers and
+ * slots the callee's parameters live in and pops everything back after the
+ * callee returned with its value in R0. This makes recursion work even
+ * though the slots are at fixed addresses.
+ */
+const (
+  VAR_REGISTERS = 3
+  FIRST_VAR_REGISTER = 1
+  TEMP_REGISTERS = 3
+  FIRST_TEMP_REGISTER = 4
+  SCRATCH = 7
+
+  // Slots stop short of the memory mapped devices at the end of the window
+  SLOT_LIMIT = instructions.DEVICE_OFFSET
+
+  // LOADC can only address this many constants
+  CONSTANT_LIMIT = 0x200
+
+  // Added to both operands of an ordered comparison to turn the machine's
+  // unsigned comparison into a signed one
+  SIGN_BIAS = 0x8000
+)
+
+// A register, or a slot if register is -1
+type location struct {
+  register int
+  slot int
+}
+
+func (l location) in_register() bool {
+  return l.register >= 0
+}
+
+type variable struct {
+  home location
+}
+
+type temp struct {
+  loc location
+}
+
+type builtin struct {
+  args int
+  trap string
+}
+
+// Built in functions, each is a single trap. print and putc return their
+// argument.
+var builtins = map[string]builtin{
+  "print": {1, "PUTI"},
+  "putc": {1, "PUTC"},
+  "getc": {0, "GETC"},
+  "geti": {0, "GETI"},
+}
+
+type generator struct {
+  file string
+  lines []string
+  code strings.Builder
+  diags assembler.Diagnostics
+
+  constants []uint16
+  pool map[uint16]int
+  functions map[string]*function
+  globals map[string]*variable
+  labels int
+
+  // State of the function being generated
+  fn *function
+  scopes []map[string]*variable
+  var_count int
+  slots []bool
+  temps []*temp
+  registers [8]bool
+  last_line int
+}
+
+func generate(file string, source string, prog *program) (string, error) {
+  g := &generator{
+    file: file,
+    lines: strings.Split(source, "\n"),
+    pool: map[uint16]int{},
+    functions: map[string]*function{},
+    globals: map[string]*variable{},
+  }
+
+  for i, name := range prog.globals {
+    g.globals[name] = &variable{location{-1, i}}
+  }
+
+  for _, f := range prog.functions {
+    if _, exists := builtins[f.name]; exists {
+      g.errorf(f, "%s is a built in function", f.name)
+    } else if _, exists := g.functions[f.name]; exists {
+      g.errorf(f, "function %s is already defined", f.name)
+    } else {
+      g.functions[f.name] = f
+    }
+  }
+
+  if main, ok := g.functions["main"]; !ok {
+    g.errorf(position{1, 1}, "there is no main function")
+  } else if len(main.params) > 0 {
+    g.errorf(main, "main takes no parameters")
+  }
+
+  for _, f := range prog.functions {
+    if g.functions[f.name] == f {
+      g.function(f)
+    }
+  }
+
+  if len(g.diags) > 0 {
+    return "", g.diags
+  }
+
+  var out strings.Builder
+  name := file
+  if name == "" {
+    name = "<input>"
+  }
+  fmt.Fprintf(&out, "; Compiled from %s\n", name)
+  for i, c := range g.constants {
+    fmt.Fprintf(&out, "CONST %d ; %d\n", int16(c), i)
+  }
+  out.WriteString("START\n")
+  out.WriteString("  CALL main\n")
+  out.WriteString("  EXIT\n")
+  out.WriteString(g.code.String())
+
+  return out.String(), nil
+}
+
+func (g *generator) errorf(n node, format string, args ...interface{}) {
+  g.diags = append(g.diags, diagnostic(g.file, n.pos(), format, args...))
+}
+
+func (g *generator) emit(format string, args ...interface{}) {
+  fmt.Fprintf(&g.code, "  " + format + "\n", args...)
+}
+
+func (g *generator) place(name string) {
+  fmt.Fprintf(&g.code, "%s:\n", name)
+}
+
+// Labels contain a dot followed by a word, which function labels cannot
+func (g *generator) new_label(kind string) string {
+  g.labels++
+  return fmt.Sprintf("%s.%s.%d", label(g.fn.name), kind, g.labels)
+}
+
+// Turns a function name into a label. Characters labels cannot hold, like the
+// dashes of Lisp names, are written as a dot and their hex code.
+func label(name string) string {
+  var l strings.Builder
+  for i, c := range name {
+    if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9' && i > 0) {
+      l.WriteRune(c)
+    } else {
+      fmt.Fprintf(&l, ".%02x", c)
+    }
+  }
+  return l.String()
+}
+
+// Notes the source line an expression comes from in the output
+func (g *generator) source_line(n node) {
+  line := n.pos().line
+  if line == g.last_line || line > len(g.lines) {
+    return
+  }
+  g.last_line = line
+  fmt.Fprintf(&g.code, "  ; %d: %s\n", line, strings.TrimSpace(g.lines[line - 1]))
+}
+
+// Returns the index of the value in the constant pool
+func (g *generator) constant(n node, value int) int {
+  v := uint16(value)
+
+  if index, ok := g.pool[v]; ok {
+    return index
+  }
+  if len(g.constants) == CONSTANT_LIMIT {
+    g.errorf(n, "more than %d different constants", CONSTANT_LIMIT)
+  }
+
+  g.pool[v] = len(g.constants)
+  g.constants = append(g.constants, v)
+  return g.pool[v]
+}
+
+/**
+ * STORAGE
+ * =============================================================================
+ */
+func (g *generator) alloc_slot() int {
+  for i, used := range g.slots {
+    if !used {
+      g.slots[i] = true
+      return i
+    }
+  }
+
+  if len(g.slots) == SLOT_LIMIT {
+    g.errorf(g.fn, "function %s needs more than %d slots", g.fn.name, SLOT_LIMIT)
+  }
+
+  g.slots = append(g.slots, true)
+  return len(g.slots) - 1
+}
+
+// Returns a free temporary register, spilling the oldest temporary held in a
+// register unless it is pinned
+func (g *generator) alloc_register(pinned ...*temp) int {
+  for r := FIRST_TEMP_REGISTER; r < FIRST_TEMP_REGISTER + TEMP_REGISTERS; r++ {
+    if !g.registers[r] {
+      g.registers[r] = true
+      return r
+    }
+  }
+
+  // Every taken register holds a temporary. At most two temporaries are pinned,
+  // the operands of a binary operator, and the one being loaded is not in a
+  // register yet, so one of the others can always be spilled.
+  var oldest *temp
+  for _, t := range g.temps {
+    if t.loc.in_register() && !contains(pinned, t) {
+      oldest = t
+      break
+    }
+  }
+
+  r := oldest.loc.register
+  oldest.loc = location{-1, g.alloc_slot()}
+  g.emit("STOREM R%d %d", r, oldest.loc.slot)
+  return r
+}
+
+func contains(temps []*temp, t *temp) bool {
+  for _, p := range temps {
+    if p == t {
+      return true
+    }
+  }
+  return false
+}
+
+func (g *generator) release(l location) {
+  if l.in_register() {
+    g.registers[l.register] = false
+  } else {
+    g.slots[l.slot] = false
+  }
+}
+
+// Pushes a new temporary held in a register
+func (g *generator) push_temp() *temp {
+  t := &temp{location{g.alloc_register(), 0}}
+  g.temps = append(g.temps, t)
+  return t
+}
+
+func (g *generator) top() *temp {
+  return g.temps[len(g.temps) - 1]
+}
+
+// Drops the temporary on top
+func (g *generator) pop_temp() {
+  g.release(g.top().loc)
+  g.temps = g.temps[:len(g.temps) - 1]
+}
+
+// Makes sure the temporary is in a register and returns it. The pinned
+// temporaries are not spilled to make room.
+func (g *generator) in_register(t *temp, pinned ...*temp) int {
+  if !t.loc.in_register() {
+    r := g.alloc_register(append(pinned, t)...)
+    g.emit("LOADM R%d %d", r, t.loc.slot)
+    g.release(t.loc)
+    t.loc = location{r, 0}
+  }
+  return t.loc.register
+}
+
+// Spills every temporary held in a register
+func (g *generator) flush() {
+  for _, t := range g.temps {
+    if t.loc.in_register() {
+      r := t.loc.register
+      g.registers[r] = false
+      t.loc = location{-1, g.alloc_slot()}
+      g.emit("STOREM R%d %d", r, t.loc.slot)
+    }
+  }
+}
+
+// Where parameter i of any function lives, as the first variables declared
+func (g *generator) param_home(i int) location {
+  if i < VAR_REGISTERS {
+    return location{FIRST_VAR_REGISTER + i, 0}
+  }
+  return location{-1, len(g.globals) + i - VAR_REGISTERS}
+}
+
+func (g *generator) declare(name string) *variable {
+  v := &variable{}
+  if g.var_count < VAR_REGISTERS {
+    v.home = location{FIRST_VAR_REGISTER + g.var_count, 0}
+  } else {
+    v.home = location{-1, g.alloc_slot()}
+  }
+  g.var_count++
+
+  g.scopes[len(g.scopes) - 1][name] = v
+  return v
+}
+
+// Drops the innermost scope. Its variables cannot be used after it, their
+// registers and slots are free again for the variables that follow.
+func (g *generator) close_scope(var_count int) {
+  for _, v := range g.scopes[len(g.scopes) - 1] {
+    if !v.home.in_register() {
+      g.release(v.home)
+    }
+  }
+  g.scopes = g.scopes[:len(g.scopes) - 1]
+  g.var_count = var_count
+}
+
+func (g *generator) lookup(n node, name string) *variable {
+  for i := len(g.scopes) - 1; i >= 0; i-- {
+    if v, ok := g.scopes[i][name]; ok {
+      return v
+    }
+  }
+  if v, ok := g.globals[name]; ok {
+    return v
+  }
+  g.errorf(n, "undefined variable %s", name)
+  return nil
+}
+
+// Copies the register into the variable's home
+func (g *generator) store(v *variable, r int) {
+  if v.home.in_register() {
+    g.emit("MOVE R%d R%d", r, v.home.register)
+  } else {
+    g.emit("STOREM R%d %d", r, v.home.slot)
+  }
+}
+
+/**
+ * FUNCTIONS
+ * =============================================================================
+ */
+func (g *generator) function(f *function) {
+  g.fn = f
+  g.scopes = []map[string]*variable{{}}
+  g.var_count = 0
+  g.slots = make([]bool, len(g.globals))
+  for i := range g.slots {
+    g.slots[i] = true
+  }
+  g.temps = nil
+  g.registers = [8]bool{}
+
+  g.code.WriteString("\n")
+  g.place(label(f.name))
+  g.last_line = 0
+  g.source_line(f)
+
+  for _, p := range f.params {
+    if _, exists := g.scopes[0][p]; exists {
+      g.errorf(f, "parameter %s is listed twice", p)
+    }
+    g.declare(p)
+  }
+
+  g.gen(f.body)
+  g.emit("MOVE R%d R0", g.in_register(g.top()))
+  g.emit("RET")
+  g.pop_temp()
+}
+
+func arguments(n int) string {
+  if n == 1 {
+    return "1 argument"
+  }
+  return fmt.Sprintf("%d arguments", n)
+}
+
+func (g *generator) call(n *call_node) {
+  if b, ok := builtins[n.name]; ok {
+    if len(n.args) != b.args {
+      g.errorf(n, "%s takes %s, got %d", n.name, arguments(b.args), len(n.args))
+    }
+
+    if len(n.args) == 0 {
+      g.emit(b.trap)
+      g.emit("MOVE R0 R%d", g.push_temp().loc.register)
+      return
+    }
+
+    for _, arg := range n.args {
+      g.gen(arg)
+    }
+    for range n.args[1:] {
+      g.pop_temp()
+    }
+    g.emit("MOVE R%d R0", g.in_register(g.top()))
+    g.emit(b.trap)
+    return
+  }
+
+  f, ok := g.functions[n.name]
+  if !ok {
+    g.errorf(n, "undefined function %s", n.name)
+  } else if len(n.args) != len(f.params) {
+    g.errorf(n, "%s takes %s, got %d", n.name, arguments(len(f.params)), len(n.args))
+  }
+
+  for _, arg := range n.args {
+    g.gen(arg)
+  }
+  g.flush()
+
+  args := g.temps[len(g.temps) - len(n.args):]
+  is_arg := map[int]bool{}
+  for _, a := range args {
+    is_arg[a.loc.slot] = true
+  }
+
+  // Save the state of this function, the callee reuses registers and slots
+  saved_registers := g.var_count
+  if saved_registers > VAR_REGISTERS {
+    saved_registers = VAR_REGISTERS
+  }
+  saved_slots := []int{}
+  for s, used := range g.slots[len(g.globals):] {
+    s += len(g.globals)
+    if used && !is_arg[s] {
+      saved_slots = append(saved_slots, s)
+    }
+  }
+
+  for i := 0; i < saved_registers; i++ {
+    g.emit("PUSH R%d", FIRST_VAR_REGISTER + i)
+  }
+  for _, s := range saved_slots {
+    g.emit("LOADM R%d %d", SCRATCH, s)
+    g.emit("PUSH R%d", SCRATCH)
+  }
+
+  // Move the arguments over through the stack, as the callee's parameters may
+  // live where the arguments are
+  for _, a := range args {
+    g.emit("LOADM R%d %d", SCRATCH, a.loc.slot)
+    g.emit("PUSH R%d", SCRATCH)
+  }
+  for i := len(args) - 1; i >= 0; i-- {
+    home := g.param_home(i)
+    if home.in_register() {
+      g.emit("POP R%d", home.register)
+    } else {
+      g.emit("POP R%d", SCRATCH)
+      g.emit("STOREM R%d %d", SCRATCH, home.slot)
+    }
+  }
+
+  g.emit("CALL %s", label(n.name))
+
+  for i := len(saved_slots) - 1; i >= 0; i-- {
+    g.emit("POP R%d", SCRATCH)
+    g.emit("STOREM R%d %d", SCRATCH, saved_slots[i])
+  }
+  for i := saved_registers - 1; i >= 0; i-- {
+    g.emit("POP R%d", FIRST_VAR_REGISTER + i)
+  }
+
+  for range args {
+    g.pop_temp()
+  }
+  g.emit("MOVE R0 R%d", g.push_temp().loc.register)
+}
+
+/**
+ * EXPRESSIONS
+ * =============================================================================
+ *
+ * Each case leaves exactly one new temporary on the stack.
+ */
+func (g *generator) gen(n node) {
+  switch n := n.(type) {
+    case *number_node:
+      index := g.constant(n, n.value)
+      g.emit("LOADC R%d %d", g.push_temp().loc.register, index)
+
+    case *variable_node:
+      r := g.push_temp().loc.register
+      if v := g.lookup(n, n.name); v == nil {
+        break
+      } else if v.home.in_register() {
+        g.emit("MOVE R%d R%d", v.home.register, r)
+      } else {
+        g.emit("LOADM R%d %d", r, v.home.slot)
+      }
+
+    case *assign_node:
+      g.gen(n.value)
+      if v := g.lookup(n, n.name); v != nil {
+        g.store(v, g.in_register(g.top()))
+      }
+
+    case *let_node:
+      g.gen(n.value)
+      r := g.in_register(g.top())
+      g.store(g.declare(n.name), r)
+
+    case *unary_node:
+      g.gen(n.operand)
+      r := g.in_register(g.top())
+
+      if n.op == "-" {
+        g.emit("NOT R%d R%d", r, r)
+        g.emit("ADD R%d R%d #1", r, r)
+      } else {
+        g.emit("SUB R%d R%d R%d", SCRATCH, SCRATCH, SCRATCH)
+        g.emit("EQ R%d #0", r)
+        g.emit("ADD R%d R%d #1", SCRATCH, SCRATCH)
+        g.emit("MOVE R%d R%d", SCRATCH, r)
+      }
+
+    case *binary_node:
+      g.gen(n.left)
+      g.gen(n.right)
+      g.binary(n)
+
+    case *call_node:
+      g.call(n)
+
+    case *block_node:
+      if len(n.exprs) == 0 {
+        g.gen(&number_node{n.position, 0})
+        break
+      }
+
+      g.scopes = append(g.scopes, map[string]*variable{})
+      var_count := g.var_count
+      for i, e := range n.exprs {
+        g.source_line(e)
+        g.gen(e)
+        if i < len(n.exprs) - 1 {
+          g.pop_temp()
+        }
+      }
+      g.close_scope(var_count)
+
+    case *if_node:
+      g.if_expr(n)
+
+    case *while_node:
+      g.while_loop(n)
+
+    case *return_node:
+      g.gen(n.value)
+      g.emit("MOVE R%d R0", g.in_register(g.top()))
+      g.emit("RET")
+  }
+}
+
+var arithmetic = map[string]string{
+  "+": "ADD",
+  "-": "SUB",
+  "*": "MUL",
+  "/": "DIV",
+}
+
+// Comparisons as the machine instruction and whether the operands swap
+var comparisons = map[string]struct{instr string; swap bool}{
+  "<": {"LT", false},
+  ">": {"LT", true},
+  "<=": {"LE", false},
+  ">=": {"LE", true},
+}
+
+// Combines the two temporaries on top into the lower one
+func (g *generator) binary(n *binary_node) {
+  a := g.temps[len(g.temps) - 2]
+  b := g.top()
+  ra := g.in_register(a, b)
+  rb := g.in_register(b, a)
+
+  if instr, ok := arithmetic[n.op]; ok {
+    g.emit("%s R%d R%d R%d", instr, ra, ra, rb)
+    g.pop_temp()
+    return
+  }
+
+  // Comparisons set R7 to 0, then skip incrementing it if they do not hold
+  switch n.op {
+    case "%":
+      g.emit("DIV R%d R%d R%d", SCRATCH, ra, rb)
+      g.emit("MUL R%d R%d R%d", SCRATCH, SCRATCH, rb)
+      g.emit("SUB R%d R%d R%d", ra, ra, SCRATCH)
+      g.pop_temp()
+      return
+
+    case "==":
+      g.emit("SUB R%d R%d R%d", SCRATCH, SCRATCH, SCRATCH)
+      g.emit("EQ R%d R%d", ra, rb)
+      g.emit("ADD R%d R%d #1", SCRATCH, SCRATCH)
+
+    case "!=":
+      g.emit("SUB R%d R%d R%d", SCRATCH, SCRATCH, SCRATCH)
+      g.emit("ADD R%d R%d #1", SCRATCH, SCRATCH)
+      g.emit("EQ R%d R%d", ra, rb)
+      g.emit("SUB R%d R%d #1", SCRATCH, SCRATCH)
+
+    default:
+      cmp := comparisons[n.op]
+      g.emit("LOADC R%d %d", SCRATCH, g.constant(n, SIGN_BIAS))
+      g.emit("ADD R%d R%d R%d", ra, ra, SCRATCH)
+      g.emit("ADD R%d R%d R%d", rb, rb, SCRATCH)
+      g.emit("SUB R%d R%d R%d", SCRATCH, SCRATCH, SCRATCH)
+      if cmp.swap {
+        g.emit("%s R%d R%d", cmp.instr, rb, ra)
+      } else {
+        g.emit("%s R%d R%d", cmp.instr, ra, rb)
+      }
+      g.emit("ADD R%d R%d #1", SCRATCH, SCRATCH)
+  }
+
+  g.emit("MOVE R%d R%d", SCRATCH, ra)
+  g.pop_temp()
+}
+
+// Evaluates the condition and jumps to the label if it is zero
+func (g *generator) jump_unless(cond node, target string) {
+  g.flush()
+  g.gen(cond)
+  g.emit("EQ R%d #0", g.in_register(g.top()))
+  g.emit("JUMP %s", target)
+  g.pop_temp()
+}
+
+// Both branches store their value in the same slot
+func (g *generator) if_expr(n *if_node) {
+  otherwise := g.new_label("else")
+  end := g.new_label("end")
+
+  g.jump_unless(n.cond, otherwise)
+
+  result := location{-1, g.alloc_slot()}
+  branch := func(b node) {
+    g.gen(b)
+    g.emit("STOREM R%d %d", g.in_register(g.top()), result.slot)
+    g.pop_temp()
+  }
+
+  branch(n.then)
+  g.emit("JUMP %s", end)
+  g.place(otherwise)
+  if n.otherwise != nil {
+    branch(n.otherwise)
+  } else {
+    branch(&number_node{n.position, 0})
+  }
+  g.place(end)
+
+  g.temps = append(g.temps, &temp{result})
+}
+
+func (g *generator) while_loop(n *while_node) {
+  top := g.new_label("while")
+  end := g.new_label("done")
+
+  g.flush()
+  g.place(top)
+  g.jump_unless(n.cond, end)
+  g.gen(n.body)
+  g.pop_temp()
+  g.emit("JUMP %s", top)
+  g.place(end)
+
+  g.gen(&number_node{n.position, 0})
+}
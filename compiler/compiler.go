@@ -0,0 +1,40 @@
+package compiler
+
+/**
+ * COMPILER
+ * =============================================================================
+ *
+ * Compiles a small expression language to assembly for the assembler. A
+ * program is a list of functions, running it calls main and exits with the
+ * value main returns.
+ *
+ *   fn fact(n) {
+ *     if n <= 1 { 1 } else { n * fact(n - 1) }
+ *   }
+ *
+ *   fn main() {
+ *     let i = 1;
+ *     while i <= 7 {
+ *       print(fact(i));
+ *       putc(10);
+ *       i = i + 1
+ *     }
+ *   }
+ *
+ * Values are 16-bit integers. Comparisons are signed and yield 0 or 1, / and %
+ * are unsigned. Any value other than 0 is true. See parser.go for the grammar
+ * and codegen.go for how values are kept in registers and the data window.
+ *
+ * The built in functions print, putc, getc and geti wrap the traps of the
+ * same name.
+ */
+
+// Compiles the source code of the given file to assembly. The file name is
+// used in diagnostics. Errors are returned as assembler.Diagnostics.
+func Compile(file string, source string) (string, error) {
+  prog, err := parse(file, source)
+  if err != nil {
+    return "", err
+  }
+  return generate(file, source, prog)
+}
@@ -0,0 +1,165 @@
+package compiler
+
+import (
+  "bytes"
+  "context"
+  "strings"
+  "testing"
+  "vm/assembler"
+  "vm/vm"
+)
+
+// Compiles and runs a program, returning its output and exit code
+func run(t *testing.T, source string, input string) (string, uint16) {
+  t.Helper()
+
+  code, err := Compile("prog.vl", source)
+  if err != nil {
+    t.Fatalf("compiling failed:\n%v", err)
+  }
+  return execute(t, "prog.vl.asm", code, input)
+}
+
+// Assembles and runs compiled code, returning its output and exit code
+func execute(t *testing.T, file string, code string, input string) (string, uint16) {
+  t.Helper()
+
+  program, err := assembler.AssembleFile(file, code)
+  if err != nil {
+    t.Fatalf("assembling failed:\n%v\n%s", err, code)
+  }
+
+  out := &bytes.Buffer{}
+  m := vm.New()
+  m.In = strings.NewReader(input)
+  m.Out = out
+  m.MaxSteps = 1 << 20
+  m.Load(program)
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatalf("run failed: %v\n%s", err, code)
+  }
+  return out.String(), m.ExitCode
+}
+
+var program_tests = []struct {
+  name string
+  source string
+  input string
+  output string
+  exit uint16
+}{
+  {"exit with the value of main", "fn main() { 42 }", "", "", 42},
+  {"precedence", "fn main() { 7 + 3 * 2 - 8 / 4 }", "", "", 11},
+  {"parentheses", "fn main() { (7 + 3) * 2 }", "", "", 20},
+  {"remainder", "fn main() { 17 % 5 }", "", "", 2},
+  {"division is unsigned", "fn main() { -2 / 2 }", "", "", 0x7FFF},
+  {"negation", "fn main() { -(3 - 5) }", "", "", 2},
+  {"not", "fn main() { !0 + !7 * 10 }", "", "", 1},
+  {"comparisons are signed", "fn main() { (-1 < 1) + (2 >= 2) * 2 + (3 > 4) * 4 + (1 != 1) * 8 + (5 == 5) * 16 }", "", "", 19},
+  {"large constants", "fn main() { 40000 + 1000 }", "", "", 41000},
+  {"variables", "fn main() { let a = 3; let b = a * a; a = b + 1; a }", "", "", 10},
+  {"shadowing in a block", "fn main() { let a = 1; { let a = 2; a }; a }", "", "", 1},
+  {
+    "variables of a closed block",
+    "fn main() { let a = 1; { let b = 2; let c = 3; let d = 4; a = b + c + d }; let e = 5; let f = 6; let g = 7; a + e + f + g }",
+    "", "", 27,
+  },
+  {"if", "fn main() { if 1 < 2 { 10 } else { 20 } }", "", "", 10},
+  {"else if", "fn main() { let x = 3; if x == 1 { 1 } else if x == 3 { 3 } else { 0 } }", "", "", 3},
+  {"if without else is 0", "fn main() { if 0 { 5 } }", "", "", 0},
+  {"while", "fn main() { let i = 0; let s = 0; while i < 10 { i = i + 1; s = s + i }; s }", "", "", 55},
+  {"return", "fn f(x) { if x > 5 { return 1 }; 2 }\nfn main() { f(9) * 10 + f(1) }", "", "", 12},
+  {"recursion", "fn fib(n) { if n < 2 { n } else { fib(n - 1) + fib(n - 2) } }\nfn main() { fib(12) }", "", "", 144},
+  {"arguments", "fn sub(a, b) { a - b }\nfn main() { sub(10, 3) }", "", "", 7},
+  {
+    "calls keep the caller's values",
+    "fn id(x) { x }\nfn main() { let a = 1; let b = 2; let c = 3; a + id(b * 10) + id(c * 100) + a }",
+    "", "", 322,
+  },
+  {
+    "spilling into the data window",
+    "fn main() {\n" +
+      "  let a = 1; let b = 2; let c = 3; let d = 4; let e = 5; let f = 6; let g = 7; let h = 8; let i = 9;\n" +
+      "  (a + (b + (c + (d + (e + (f + (g + (h + i))))))))\n" +
+      "}",
+    "", "", 45,
+  },
+  {"print", "fn main() { print(-12); putc(10); print(3); 0 }", "", "-12\n3", 0},
+  {
+    "factorials",
+    "fn fact(n) { if n <= 1 { 1 } else { n * fact(n - 1) } }\nfn main() { let i = 1; while i <= 7 { print(fact(i)); putc(32); i = i + 1 } }",
+    "", "1 2 6 24 120 720 5040 ", 0,
+  },
+  {"getc", "fn main() { getc() + getc() }", "ab", "", 'a' + 'b'},
+  {"geti", "fn main() { geti() * geti() }", "6\n7\n", "", 42},
+}
+
+func TestPrograms(t *testing.T) {
+  for _, test := range program_tests {
+    t.Run(test.name, func(t *testing.T) {
+      output, exit := run(t, test.source, test.input)
+
+      if output != test.output {
+        t.Errorf("output %q, want %q", output, test.output)
+      }
+      if exit != test.exit {
+        t.Errorf("exit code %d, want %d", exit, test.exit)
+      }
+    })
+  }
+}
+
+// The slots of a block's variables are reused after the block, a function
+// with more blocks than slots still compiles
+func TestBlockVariablesFreeTheirSlots(t *testing.T) {
+  source := "fn main() {\n  let a = 0; let b = 0; let c = 0;\n" +
+    strings.Repeat("  { let x = 1; a = a + x };\n", 600) +
+    "  a\n}"
+
+  if _, exit := run(t, source, ""); exit != 600 {
+    t.Errorf("exit code %d, want 600", exit)
+  }
+}
+
+var error_tests = []struct {
+  name string
+  source string
+  want string
+}{
+  {"unexpected character", "fn main() {\n  1 @ 2\n}", `prog.vl:2:5: error: unexpected character "@"`},
+  {"missing operand", "fn main() { 1 + }", "prog.vl:1:17:"},
+  {"undefined variable", "fn main() {\n  let a = 1;\n  a + b\n}", "prog.vl:3:7: error: undefined variable b"},
+  {"undefined function", "fn main() { f(1) }", "prog.vl:1:13: error: undefined function f"},
+  {"argument count", "fn f(a, b) { a }\nfn main() { f(1) }", "prog.vl:2:13: error: f takes 2 arguments, got 1"},
+  {"built in argument count", "fn main() { print() }", "prog.vl:1:13: error: print takes 1 argument, got 0"},
+  {"defined twice", "fn f() { 1 }\nfn f() { 2 }\nfn main() { f() }", "prog.vl:2:1: error: function f is already defined"},
+  {"built in redefined", "fn print(x) { x }\nfn main() { 0 }", "prog.vl:1:1: error: print is a built in function"},
+  {"parameter listed twice", "fn f(a, a) { a }\nfn main() { 0 }", "prog.vl:1:1: error: parameter a is listed twice"},
+  {"no main", "fn f() { 1 }", "prog.vl:1:1: error: there is no main function"},
+  {"main with parameters", "fn main(x) { x }", "prog.vl:1:1: error: main takes no parameters"},
+}
+
+func TestErrors(t *testing.T) {
+  for _, test := range error_tests {
+    _, err := Compile("prog.vl", test.source)
+
+    if _, ok := err.(assembler.Diagnostics); !ok {
+      t.Errorf("%s: got %v, want diagnostics", test.name, err)
+      continue
+    }
+    if !strings.HasPrefix(err.Error(), test.want) {
+      t.Errorf("%s: got %q, want %q", test.name, err.Error(), test.want)
+    }
+  }
+}
+
+// Every problem the code generator finds is reported, not just the first
+func TestAllErrorsAreReported(t *testing.T) {
+  _, err := Compile("prog.vl", "fn main() {\n  a;\n  b\n}")
+
+  diags, ok := err.(assembler.Diagnostics)
+  if !ok || len(diags) != 2 {
+    t.Fatalf("got %v, want two diagnostics", err)
+  }
+}
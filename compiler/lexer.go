@@ -0,0 +1,117 @@
+package compiler
+
+import (
+  "strings"
+)
+
+/**
+ * LEXER
+ * =============================================================================
+ *
+ * Splits source into tokens: numbers, identifiers, keywords and operators.
+ * Comments start with // and run to the end of the line.
+ */
+type token_kind int
+
+const (
+  TOKEN_EOF token_kind = iota
+  TOKEN_NUMBER
+  TOKEN_IDENT
+  TOKEN_KEYWORD
+  TOKEN_OP
+)
+
+type lex_token struct {
+  position
+  kind token_kind
+  text string
+}
+
+var keywords = map[string]bool{
+  "fn": true,
+  "let": true,
+  "if": true,
+  "else": true,
+  "while": true,
+  "return": true,
+}
+
+// Operators, longest first so == is not read as two =
+var operators = []string{"==", "!=", "<=", ">=", "(", ")", "{", "}", ",", ";", "=", "<", ">", "+", "-", "*", "/", "%", "!"}
+
+func lex(source string) ([]lex_token, *lex_token) {
+  tokens := []lex_token{}
+  line, column := 1, 1
+
+  for i := 0; i < len(source); {
+    c := source[i]
+    pos := position{line, column}
+
+    advance := func(n int) {
+      for ; n > 0; n-- {
+        if source[i] == '\n' {
+          line++
+          column = 1
+        } else {
+          column++
+        }
+        i++
+      }
+    }
+
+    switch {
+      case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+        advance(1)
+
+      case strings.HasPrefix(source[i:], "//"):
+        end := strings.IndexByte(source[i:], '\n')
+        if end < 0 {
+          end = len(source) - i
+        }
+        advance(end)
+
+      case is_digit(c):
+        start := i
+        for i < len(source) && (is_digit(source[i]) || is_letter(source[i])) {
+          advance(1)
+        }
+        tokens = append(tokens, lex_token{pos, TOKEN_NUMBER, source[start:i]})
+
+      case is_letter(c):
+        start := i
+        for i < len(source) && (is_digit(source[i]) || is_letter(source[i])) {
+          advance(1)
+        }
+
+        kind := TOKEN_IDENT
+        if keywords[source[start:i]] {
+          kind = TOKEN_KEYWORD
+        }
+        tokens = append(tokens, lex_token{pos, kind, source[start:i]})
+
+      default:
+        matched := false
+        for _, op := range operators {
+          if strings.HasPrefix(source[i:], op) {
+            tokens = append(tokens, lex_token{pos, TOKEN_OP, op})
+            advance(len(op))
+            matched = true
+            break
+          }
+        }
+        if !matched {
+          return nil, &lex_token{pos, TOKEN_OP, string(c)}
+        }
+    }
+  }
+
+  return append(tokens, lex_token{position{line, column}, TOKEN_EOF, ""}), nil
+}
+
+func is_digit(c byte) bool {
+  return c >= '0' && c <= '9'
+}
+
+func is_letter(c byte) bool {
+  return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,538 @@
+package compiler
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+  "vm/assembler"
+)
+
+/**
+ * LISP
+ * =============================================================================
+ *
+ * A front end for a core subset of Lisp. S-expressions are read and turned into
+ * the same tree the expression language parses into, code generation is
+ * shared.
+ *
+ *   (define (fact n)
+ *     (if (<= n 1) 1 (* n (fact (- n 1)))))
+ *
+ *   (display (fact 7))
+ *   (newline)
+ *
+ * Top level expressions run in order as the program's main function, which
+ * exits with 0. Definitions at the top level define functions or global
+ * variables, inside a body they define local variables.
+ *
+ * Supported are define, lambda (as the value of a definition or applied right
+ * away), if, let, let*, begin, set!, while, and, or, not, + - * / modulo
+ * remainder, = < > <= >=, display and newline as well as the built in
+ * functions of the expression language. Values are 16-bit integers, 0 and #f
+ * are false.
+ */
+type sexpr struct {
+  position
+  atom string
+  list []sexpr
+  is_list bool
+}
+
+func (s sexpr) is(atom string) bool {
+  return !s.is_list && s.atom == atom
+}
+
+// Compiles Lisp source code of the given file to assembly
+func CompileLisp(file string, source string) (string, error) {
+  forms, err := read(file, source)
+  if err != nil {
+    return "", err
+  }
+
+  l := &lisp{file: file}
+  prog := l.program(forms)
+  if len(l.diags) > 0 {
+    return "", l.diags
+  }
+  return generate(file, source, prog)
+}
+
+/**
+ * READER
+ * =============================================================================
+ */
+func read(file string, source string) ([]sexpr, error) {
+  forms := []sexpr{}
+  stack := [][]sexpr{}
+  opened := []position{}
+  line, column := 1, 1
+
+  for i := 0; i < len(source); {
+    c := source[i]
+    pos := position{line, column}
+
+    switch {
+      case c == '\n':
+        line++
+        column = 1
+        i++
+        continue
+
+      case c == ' ' || c == '\t' || c == '\r':
+        i++
+        column++
+        continue
+
+      case c == ';':
+        for i < len(source) && source[i] != '\n' {
+          i++
+        }
+        continue
+
+      case c == '(':
+        stack = append(stack, forms)
+        opened = append(opened, pos)
+        forms = []sexpr{}
+        i++
+        column++
+        continue
+
+      case c == ')':
+        if len(stack) == 0 {
+          return nil, assembler.Diagnostics{diagnostic(file, pos, "unexpected \")\"")}
+        }
+        list := sexpr{position: opened[len(opened) - 1], list: forms, is_list: true}
+        forms = append(stack[len(stack) - 1], list)
+        stack = stack[:len(stack) - 1]
+        opened = opened[:len(opened) - 1]
+        i++
+        column++
+        continue
+
+      case c == '"':
+        return nil, assembler.Diagnostics{diagnostic(file, pos, "strings are not supported")}
+
+      case c == '\'' || c == '`':
+        return nil, assembler.Diagnostics{diagnostic(file, pos, "quoting is not supported")}
+    }
+
+    start := i
+    for i < len(source) && strings.IndexByte(" \t\r\n();\"'`", source[i]) < 0 {
+      i++
+    }
+    column += i - start
+    forms = append(forms, sexpr{position: pos, atom: source[start:i]})
+  }
+
+  if len(opened) > 0 {
+    return nil, assembler.Diagnostics{diagnostic(file, opened[len(opened) - 1], "\"(\" is never closed")}
+  }
+
+  return forms, nil
+}
+
+/**
+ * TRANSLATION
+ * =============================================================================
+ */
+type lisp struct {
+  file string
+  diags assembler.Diagnostics
+
+  // Counts the hidden variables introduced by let, lambda and or
+  hidden int
+}
+
+func (l *lisp) errorf(s sexpr, format string, args ...interface{}) {
+  l.diags = append(l.diags, diagnostic(l.file, s.position, format, args...))
+}
+
+// Variables the translation introduces have a space in their name, which no
+// symbol can have
+func (l *lisp) hidden_name() string {
+  l.hidden++
+  return fmt.Sprintf(" %d", l.hidden)
+}
+
+func (l *lisp) program(forms []sexpr) *program {
+  prog := &program{}
+  main := &function{name: "main", position: position{1, 1}}
+  body := &block_node{position: position{1, 1}}
+  globals := map[string]bool{}
+
+  for _, form := range forms {
+    if !is_form(form, "define") {
+      body.exprs = append(body.exprs, l.expr(form))
+      continue
+    }
+
+    name, params, value, ok := l.definition(form)
+    if !ok {
+      continue
+    }
+
+    if name.atom == "main" {
+      l.errorf(name, "main is the name of the top level code")
+      continue
+    }
+
+    if params != nil {
+      prog.functions = append(prog.functions, &function{form.position, name.atom, params, l.body(form, value)})
+      continue
+    }
+
+    if !globals[name.atom] {
+      globals[name.atom] = true
+      prog.globals = append(prog.globals, name.atom)
+    }
+    body.exprs = append(body.exprs, &assign_node{form.position, name.atom, l.expr(value[0])})
+  }
+
+  body.exprs = append(body.exprs, &number_node{position{1, 1}, 0})
+  main.body = body
+  prog.functions = append(prog.functions, main)
+
+  return prog
+}
+
+func is_form(s sexpr, head string) bool {
+  return s.is_list && len(s.list) > 0 && s.list[0].is(head)
+}
+
+// Splits (define name value), (define (name params...) body...) and
+// (define name (lambda (params...) body...)). Params is nil if the definition
+// is not a function.
+func (l *lisp) definition(form sexpr) (name sexpr, params []string, value []sexpr, ok bool) {
+  if len(form.list) < 3 {
+    l.errorf(form, "define needs a name and a value")
+    return
+  }
+
+  target := form.list[1]
+
+  if target.is_list {
+    if len(target.list) == 0 || target.list[0].is_list {
+      l.errorf(target, "define needs a name")
+      return
+    }
+    return target.list[0], l.params(target, target.list[1:]), form.list[2:], true
+  }
+
+  if len(form.list) != 3 {
+    l.errorf(form, "define of a variable takes one value")
+    return
+  }
+
+  if lambda := form.list[2]; is_form(lambda, "lambda") {
+    if len(lambda.list) < 3 || !lambda.list[1].is_list {
+      l.errorf(lambda, "lambda needs a parameter list and a body")
+      return
+    }
+    return target, l.params(lambda, lambda.list[1].list), lambda.list[2:], true
+  }
+
+  return target, nil, form.list[2:], true
+}
+
+func (l *lisp) params(at sexpr, list []sexpr) []string {
+  params := []string{}
+  for _, p := range list {
+    if p.is_list {
+      l.errorf(p, "parameters must be names")
+      continue
+    }
+    params = append(params, p.atom)
+  }
+  return params
+}
+
+// Turns a body into a block, definitions in it become local variables
+func (l *lisp) body(at sexpr, forms []sexpr) node {
+  b := &block_node{position: at.position}
+
+  for _, form := range forms {
+    if !is_form(form, "define") {
+      b.exprs = append(b.exprs, l.expr(form))
+      continue
+    }
+
+    name, params, value, ok := l.definition(form)
+    if !ok {
+      continue
+    }
+    if params != nil {
+      l.errorf(form, "functions can only be defined at the top level")
+      continue
+    }
+    b.exprs = append(b.exprs, &let_node{form.position, name.atom, l.expr(value[0])})
+  }
+
+  return b
+}
+
+var lisp_operators = map[string]string{
+  "+": "+",
+  "-": "-",
+  "*": "*",
+  "/": "/",
+  "modulo": "%",
+  "remainder": "%",
+}
+
+var lisp_comparisons = map[string]string{
+  "=": "==",
+  "<": "<",
+  ">": ">",
+  "<=": "<=",
+  ">=": ">=",
+}
+
+func (l *lisp) expr(s sexpr) node {
+  if !s.is_list {
+    return l.atom(s)
+  }
+
+  if len(s.list) == 0 {
+    l.errorf(s, "() is not an expression")
+    return &number_node{s.position, 0}
+  }
+
+  head := s.list[0]
+  args := s.list[1:]
+
+  if head.is_list {
+    if is_form(head, "lambda") {
+      return l.apply_lambda(s, head, args)
+    }
+    l.errorf(head, "only names and lambdas can be called")
+    return &number_node{s.position, 0}
+  }
+
+  if op, ok := lisp_operators[head.atom]; ok {
+    return l.arithmetic(s, op, args)
+  }
+
+  if op, ok := lisp_comparisons[head.atom]; ok {
+    if len(args) != 2 {
+      l.errorf(s, "%s takes 2 arguments, got %d", head.atom, len(args))
+      return &number_node{s.position, 0}
+    }
+    return &binary_node{s.position, op, l.expr(args[0]), l.expr(args[1])}
+  }
+
+  switch head.atom {
+    case "define":
+      l.errorf(s, "define is only allowed at the top level or in a body")
+      return &number_node{s.position, 0}
+
+    case "lambda":
+      l.errorf(s, "lambda can only be defined or applied right away")
+      return &number_node{s.position, 0}
+
+    case "if":
+      if len(args) < 2 || len(args) > 3 {
+        l.errorf(s, "if takes a condition and one or two branches")
+        return &number_node{s.position, 0}
+      }
+      n := &if_node{s.position, l.expr(args[0]), l.expr(args[1]), nil}
+      if len(args) == 3 {
+        n.otherwise = l.expr(args[2])
+      }
+      return n
+
+    case "let", "let*":
+      return l.let(s, head.atom == "let*", args)
+
+    case "begin":
+      return l.body(s, args)
+
+    case "set!":
+      if len(args) != 2 || args[0].is_list {
+        l.errorf(s, "set! takes a name and a value")
+        return &number_node{s.position, 0}
+      }
+      return &assign_node{s.position, args[0].atom, l.expr(args[1])}
+
+    case "while":
+      if len(args) < 1 {
+        l.errorf(s, "while needs a condition")
+        return &number_node{s.position, 0}
+      }
+      return &while_node{s.position, l.expr(args[0]), l.body(s, args[1:])}
+
+    case "not":
+      if len(args) != 1 {
+        l.errorf(s, "not takes 1 argument, got %d", len(args))
+        return &number_node{s.position, 0}
+      }
+      return &unary_node{s.position, "!", l.expr(args[0])}
+
+    case "and":
+      return l.and(s, args)
+
+    case "or":
+      return l.or(s, args)
+
+    case "display":
+      if len(args) != 1 {
+        l.errorf(s, "display takes 1 argument, got %d", len(args))
+        return &number_node{s.position, 0}
+      }
+      return &call_node{s.position, "print", l.exprs(args)}
+
+    case "newline":
+      if len(args) != 0 {
+        l.errorf(s, "newline takes no arguments")
+      }
+      return &call_node{s.position, "putc", []node{&number_node{s.position, '\n'}}}
+  }
+
+  return &call_node{s.position, head.atom, l.exprs(args)}
+}
+
+func (l *lisp) exprs(forms []sexpr) []node {
+  nodes := make([]node, len(forms))
+  for i, f := range forms {
+    nodes[i] = l.expr(f)
+  }
+  return nodes
+}
+
+func (l *lisp) atom(s sexpr) node {
+  switch s.atom {
+    case "#t":
+      return &number_node{s.position, 1}
+    case "#f":
+      return &number_node{s.position, 0}
+  }
+
+  if n, err := strconv.ParseInt(s.atom, 0, 32); err == nil {
+    if n < -0x8000 || n > 0xFFFF {
+      l.errorf(s, "%s is not a 16-bit number", s.atom)
+    }
+    return &number_node{s.position, int(n)}
+  }
+
+  return &variable_node{s.position, s.atom}
+}
+
+// Folds the arguments from the left, (- x) negates
+func (l *lisp) arithmetic(s sexpr, op string, args []sexpr) node {
+  if len(args) == 0 {
+    if op == "+" || op == "*" {
+      return &number_node{s.position, map[string]int{"+": 0, "*": 1}[op]}
+    }
+    l.errorf(s, "%s needs at least 1 argument", s.list[0].atom)
+    return &number_node{s.position, 0}
+  }
+
+  if len(args) == 1 {
+    if op == "-" {
+      return &unary_node{s.position, "-", l.expr(args[0])}
+    }
+    if op == "+" || op == "*" {
+      return l.expr(args[0])
+    }
+    l.errorf(s, "%s needs 2 arguments, got 1", s.list[0].atom)
+    return &number_node{s.position, 0}
+  }
+
+  result := l.expr(args[0])
+  for _, arg := range args[1:] {
+    result = &binary_node{s.position, op, result, l.expr(arg)}
+  }
+  return result
+}
+
+// (let ((name value)...) body...). The values of a let are all evaluated
+// before any name is bound, let* binds each name right away.
+func (l *lisp) let(s sexpr, sequential bool, args []sexpr) node {
+  if len(args) < 2 || !args[0].is_list {
+    l.errorf(s, "%s needs a list of bindings and a body", s.list[0].atom)
+    return &number_node{s.position, 0}
+  }
+
+  names := []string{}
+  values := []sexpr{}
+  for _, binding := range args[0].list {
+    if !binding.is_list || len(binding.list) != 2 || binding.list[0].is_list {
+      l.errorf(binding, "a binding is a name and a value in parentheses")
+      continue
+    }
+    names = append(names, binding.list[0].atom)
+    values = append(values, binding.list[1])
+  }
+
+  return l.bind(s, names, l.exprs(values), sequential, args[1:])
+}
+
+// ((lambda (params...) body...) args...) is a let
+func (l *lisp) apply_lambda(s sexpr, lambda sexpr, args []sexpr) node {
+  if len(lambda.list) < 3 || !lambda.list[1].is_list {
+    l.errorf(lambda, "lambda needs a parameter list and a body")
+    return &number_node{s.position, 0}
+  }
+
+  params := l.params(lambda, lambda.list[1].list)
+  if len(params) != len(args) {
+    l.errorf(s, "the lambda takes %s, got %d", arguments(len(params)), len(args))
+    return &number_node{s.position, 0}
+  }
+
+  return l.bind(s, params, l.exprs(args), false, lambda.list[2:])
+}
+
+// Binds the values to the names in a new block around the body. Unless
+// sequential, several values go to hidden variables first so none of them
+// sees the names bound by the others.
+func (l *lisp) bind(s sexpr, names []string, values []node, sequential bool, body []sexpr) node {
+  b := &block_node{position: s.position}
+
+  if sequential || len(names) < 2 {
+    for i, name := range names {
+      b.exprs = append(b.exprs, &let_node{s.position, name, values[i]})
+    }
+  } else {
+    hidden := make([]string, len(names))
+    for i := range names {
+      hidden[i] = l.hidden_name()
+      b.exprs = append(b.exprs, &let_node{s.position, hidden[i], values[i]})
+    }
+    for i, name := range names {
+      b.exprs = append(b.exprs, &let_node{s.position, name, &variable_node{s.position, hidden[i]}})
+    }
+  }
+
+  b.exprs = append(b.exprs, l.body(s, body))
+  return b
+}
+
+// (and a b c) is (if a (if b c 0) 0)
+func (l *lisp) and(s sexpr, args []sexpr) node {
+  if len(args) == 0 {
+    return &number_node{s.position, 1}
+  }
+
+  result := l.expr(args[len(args) - 1])
+  for i := len(args) - 2; i >= 0; i-- {
+    result = &if_node{s.position, l.expr(args[i]), result, &number_node{s.position, 0}}
+  }
+  return result
+}
+
+// (or a b) evaluates a once: (let ((t a)) (if t t b))
+func (l *lisp) or(s sexpr, args []sexpr) node {
+  if len(args) == 0 {
+    return &number_node{s.position, 0}
+  }
+
+  result := l.expr(args[len(args) - 1])
+  for i := len(args) - 2; i >= 0; i-- {
+    t := l.hidden_name()
+    result = &block_node{s.position, []node{
+      &let_node{s.position, t, l.expr(args[i])},
+      &if_node{s.position, &variable_node{s.position, t}, &variable_node{s.position, t}, result},
+    }}
+  }
+  return result
+}
@@ -0,0 +1,103 @@
+package compiler
+
+import (
+  "strings"
+  "testing"
+  "vm/assembler"
+)
+
+// Compiles and runs a Lisp program, returning its output and exit code
+func run_lisp(t *testing.T, source string, input string) (string, uint16) {
+  t.Helper()
+
+  code, err := CompileLisp("prog.lisp", source)
+  if err != nil {
+    t.Fatalf("compiling failed:\n%v", err)
+  }
+  return execute(t, "prog.lisp.asm", code, input)
+}
+
+var lisp_tests = []struct {
+  name string
+  source string
+  input string
+  output string
+}{
+  {"display", "(display 42)", "", "42"},
+  {"newline", "(display 1) (newline) (display 2)", "", "1\n2"},
+  {"arithmetic", "(display (- (* 3 (+ 1 2 3)) (/ 8 4)))", "", "16"},
+  {"negation", "(display (- 5))", "", "-5"},
+  {"modulo and remainder", "(display (modulo 17 5)) (display (remainder 9 4))", "", "21"},
+  {"comparisons", "(display (+ (< 1 2) (= 2 2) (> 1 2) (<= 3 3) (>= 2 3)))", "", "3"},
+  {"if", "(display (if (< 2 1) 10 20))", "", "20"},
+  {"#f is false", "(display (if #f 1 2))", "", "2"},
+  {"and, or and not", "(display (+ (and 1 2) (or 0 3) (not 0) (and 1 0)))", "", "6"},
+  {"global variables", "(define x 5) (set! x (* x x)) (display x)", "", "25"},
+  {"functions", "(define (square x) (* x x)) (display (square 9))", "", "81"},
+  {"lambda definitions", "(define inc (lambda (x) (+ x 1))) (display (inc 1))", "", "2"},
+  {"lambda applied right away", "(display ((lambda (a b) (- a b)) 7 2))", "", "5"},
+  {"let", "(display (let ((a 1) (b 2)) (+ a b)))", "", "3"},
+  {"let*", "(display (let* ((a 2) (b (* a a))) b))", "", "4"},
+  {"begin", "(display (begin (display 1) 2))", "", "12"},
+  {"local define", "(define (f x) (define y (* x 2)) (+ x y)) (display (f 3))", "", "9"},
+  {
+    "while",
+    "(define i 0)\n(while (< i 5) (display i) (set! i (+ i 1)))",
+    "", "01234",
+  },
+  {
+    "recursion",
+    "(define (fact n)\n  (if (<= n 1) 1 (* n (fact (- n 1)))))\n(display (fact 7))",
+    "", "5040",
+  },
+  {"built in functions", "(putc (getc)) (print (geti))", "x-3\n", "x-3"},
+  {"comments", "; nothing\n(display 1) ; one", "", "1"},
+}
+
+func TestLisp(t *testing.T) {
+  for _, test := range lisp_tests {
+    t.Run(test.name, func(t *testing.T) {
+      output, exit := run_lisp(t, test.source, test.input)
+
+      if output != test.output {
+        t.Errorf("output %q, want %q", output, test.output)
+      }
+      if exit != 0 {
+        t.Errorf("exit code %d, want 0", exit)
+      }
+    })
+  }
+}
+
+var lisp_error_tests = []struct {
+  name string
+  source string
+  want string
+}{
+  {"unbalanced", "(display 1))", `prog.lisp:1:12: error: unexpected ")"`},
+  {"unclosed", "(display\n  (+ 1 2)", "prog.lisp:1:1:"},
+  {"strings", "(display \"hi\")", "prog.lisp:1:10: error: strings are not supported"},
+  {"quoting", "(display '(1))", "prog.lisp:1:10: error: quoting is not supported"},
+  {"undefined variable", "(display\n  (+ 1 x))", "prog.lisp:2:8: error: undefined variable x"},
+  {"number out of range", "(display 70000)", "prog.lisp:1:10: error: 70000 is not a 16-bit number"},
+  {"if without branches", "(if 1)", "prog.lisp:1:1: error: if takes a condition and one or two branches"},
+  {"nested function", "(define (f) (define (g) 1) (g))", "prog.lisp:1:13: error: functions can only be defined at the top level"},
+  {"lambda as a value", "(display (lambda (x) x))", "prog.lisp:1:10: error: lambda can only be defined or applied right away"},
+  {"main", "(define (main) 1)", "prog.lisp:1:10: error: main is the name of the top level code"},
+  {"calling a list", "(define (f) 1) ((f) 2)", "prog.lisp:1:17: error: only names and lambdas can be called"},
+  {"empty list", "(display ())", "prog.lisp:1:10: error: () is not an expression"},
+}
+
+func TestLispErrors(t *testing.T) {
+  for _, test := range lisp_error_tests {
+    _, err := CompileLisp("prog.lisp", test.source)
+
+    if _, ok := err.(assembler.Diagnostics); !ok {
+      t.Errorf("%s: got %v, want diagnostics", test.name, err)
+      continue
+    }
+    if !strings.HasPrefix(err.Error(), test.want) {
+      t.Errorf("%s: got %q, want %q", test.name, err.Error(), test.want)
+    }
+  }
+}
@@ -0,0 +1,308 @@
+package compiler
+
+import (
+  "fmt"
+  "strconv"
+  "vm/assembler"
+)
+
+/**
+ * PARSER
+ * =============================================================================
+ *
+ * A recursive descent parser for the expression language:
+ *
+ *   program    := function*
+ *   function   := "fn" name "(" [name ("," name)*] ")" block
+ *   block      := "{" [statement (";" statement)* [";"]] "}"
+ *   statement  := "let" name "=" expr | "return" expr | expr
+ *   expr       := name "=" expr | equality
+ *   equality   := comparison (("==" | "!=") comparison)*
+ *   comparison := sum (("<" | "<=" | ">" | ">=") sum)*
+ *   sum        := product (("+" | "-") product)*
+ *   product    := unary (("*" | "/" | "%") unary)*
+ *   unary      := ("-" | "!") unary | primary
+ *   primary    := number | name | name "(" [expr ("," expr)*] ")"
+ *               | "(" expr ")" | block | if | while
+ *   if         := "if" expr block ["else" (if | block)]
+ *   while      := "while" expr block
+ *
+ * A statement ending in a block, like an if or a while, needs no semicolon
+ * after it. The parser stops at the first error.
+ */
+type parser struct {
+  file string
+  tokens []lex_token
+  next int
+}
+
+type parse_error struct {
+  diag assembler.Diagnostic
+}
+
+func parse(file string, source string) (prog *program, err error) {
+  tokens, bad := lex(source)
+  if bad != nil {
+    return nil, assembler.Diagnostics{diagnostic(file, bad.position, "unexpected character %q", bad.text)}
+  }
+
+  p := &parser{file: file, tokens: tokens}
+
+  // Errors unwind the descent as a panic and are turned back into an error here
+  defer func() {
+    if r := recover(); r != nil {
+      e, ok := r.(parse_error)
+      if !ok {
+        panic(r)
+      }
+      prog, err = nil, assembler.Diagnostics{e.diag}
+    }
+  }()
+
+  prog = &program{}
+  for p.peek().kind != TOKEN_EOF {
+    prog.functions = append(prog.functions, p.function())
+  }
+  return prog, nil
+}
+
+func diagnostic(file string, pos position, format string, args ...interface{}) assembler.Diagnostic {
+  return assembler.Diagnostic{
+    File: file,
+    Line: pos.line,
+    Column: pos.column,
+    Message: fmt.Sprintf(format, args...),
+    Severity: assembler.SEVERITY_ERROR,
+  }
+}
+
+func (p *parser) fail(pos position, format string, args ...interface{}) {
+  panic(parse_error{diagnostic(p.file, pos, format, args...)})
+}
+
+func (p *parser) peek() lex_token {
+  return p.tokens[p.next]
+}
+
+func (p *parser) take() lex_token {
+  t := p.tokens[p.next]
+  if t.kind != TOKEN_EOF {
+    p.next++
+  }
+  return t
+}
+
+// Reports whether the next token is the given operator or keyword
+func (p *parser) at(text string) bool {
+  t := p.peek()
+  return (t.kind == TOKEN_OP || t.kind == TOKEN_KEYWORD) && t.text == text
+}
+
+func (p *parser) accept(text string) bool {
+  if p.at(text) {
+    p.take()
+    return true
+  }
+  return false
+}
+
+func (p *parser) expect(text string) lex_token {
+  if !p.at(text) {
+    p.fail(p.peek().position, "expected %q, found %s", text, describe(p.peek()))
+  }
+  return p.take()
+}
+
+func (p *parser) name() lex_token {
+  if p.peek().kind != TOKEN_IDENT {
+    p.fail(p.peek().position, "expected a name, found %s", describe(p.peek()))
+  }
+  return p.take()
+}
+
+func describe(t lex_token) string {
+  if t.kind == TOKEN_EOF {
+    return "end of file"
+  }
+  return strconv.Quote(t.text)
+}
+
+func (p *parser) function() *function {
+  start := p.expect("fn")
+  name := p.name()
+
+  f := &function{position: start.position, name: name.text}
+
+  p.expect("(")
+  if !p.at(")") {
+    for {
+      f.params = append(f.params, p.name().text)
+      if !p.accept(",") {
+        break
+      }
+    }
+  }
+  p.expect(")")
+
+  f.body = p.block()
+  return f
+}
+
+func (p *parser) block() node {
+  start := p.expect("{")
+  b := &block_node{position: start.position}
+
+  for !p.at("}") {
+    stmt := p.statement()
+    b.exprs = append(b.exprs, stmt)
+
+    if p.accept(";") {
+      continue
+    }
+    if !ends_in_block(stmt) && !p.at("}") {
+      p.fail(p.peek().position, "expected \";\" or \"}\", found %s", describe(p.peek()))
+    }
+  }
+  p.take()
+
+  return b
+}
+
+func ends_in_block(n node) bool {
+  switch n.(type) {
+    case *block_node, *if_node, *while_node:
+      return true
+  }
+  return false
+}
+
+func (p *parser) statement() node {
+  start := p.peek()
+
+  if p.accept("let") {
+    name := p.name()
+    p.expect("=")
+    return &let_node{start.position, name.text, p.expr()}
+  }
+
+  if p.accept("return") {
+    return &return_node{start.position, p.expr()}
+  }
+
+  return p.expr()
+}
+
+func (p *parser) expr() node {
+  if p.peek().kind == TOKEN_IDENT && p.tokens[p.next + 1].kind == TOKEN_OP && p.tokens[p.next + 1].text == "=" {
+    name := p.take()
+    p.take()
+    return &assign_node{name.position, name.text, p.expr()}
+  }
+  return p.binary(0)
+}
+
+// Binary operators by precedence, loosest first
+var precedence = [][]string{
+  {"==", "!="},
+  {"<", "<=", ">", ">="},
+  {"+", "-"},
+  {"*", "/", "%"},
+}
+
+func (p *parser) binary(level int) node {
+  if level == len(precedence) {
+    return p.unary()
+  }
+
+  left := p.binary(level + 1)
+
+  for {
+    op := ""
+    for _, candidate := range precedence[level] {
+      if p.at(candidate) {
+        op = candidate
+      }
+    }
+    if op == "" {
+      return left
+    }
+
+    t := p.take()
+    left = &binary_node{t.position, op, left, p.binary(level + 1)}
+  }
+}
+
+func (p *parser) unary() node {
+  if p.at("-") || p.at("!") {
+    t := p.take()
+    return &unary_node{t.position, t.text, p.unary()}
+  }
+  return p.primary()
+}
+
+func (p *parser) primary() node {
+  t := p.peek()
+
+  switch {
+    case t.kind == TOKEN_NUMBER:
+      p.take()
+      value, err := strconv.ParseInt(t.text, 0, 32)
+      if err != nil || value > 0xFFFF {
+        p.fail(t.position, "%q is not a 16-bit number", t.text)
+      }
+      return &number_node{t.position, int(value)}
+
+    case t.kind == TOKEN_IDENT:
+      p.take()
+      if !p.accept("(") {
+        return &variable_node{t.position, t.text}
+      }
+
+      call := &call_node{position: t.position, name: t.text}
+      if !p.at(")") {
+        for {
+          call.args = append(call.args, p.expr())
+          if !p.accept(",") {
+            break
+          }
+        }
+      }
+      p.expect(")")
+      return call
+
+    case p.at("("):
+      p.take()
+      e := p.expr()
+      p.expect(")")
+      return e
+
+    case p.at("{"):
+      return p.block()
+
+    case p.at("if"):
+      return p.if_expr()
+
+    case p.at("while"):
+      p.take()
+      cond := p.expr()
+      return &while_node{t.position, cond, p.block()}
+  }
+
+  p.fail(t.position, "expected an expression, found %s", describe(t))
+  return nil
+}
+
+func (p *parser) if_expr() node {
+  t := p.expect("if")
+  n := &if_node{position: t.position, cond: p.expr(), then: p.block()}
+
+  if p.accept("else") {
+    if p.at("if") {
+      n.otherwise = p.if_expr()
+    } else {
+      n.otherwise = p.block()
+    }
+  }
+
+  return n
+}
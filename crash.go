@@ -0,0 +1,126 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "vm/disassembler"
+  "vm/rom"
+  "vm/vm"
+)
+
+/**
+ * CRASH REPORTS
+ * =============================================================================
+ *
+ * A program stopped by a fault exits with a code telling the kind of fault
+ * apart, loosely following the signals a native program would die of:
+ *
+ *   132  illegal instruction          (SIGILL)
+ *   134  stack overflow or underflow  (SIGABRT)
+ *   135  pc ran off the end of memory (SIGBUS)
+ *   136  divide by zero               (SIGFPE)
+ *   139  memory violation             (SIGSEGV)
+ *
+ * A program running out of its step or time budget exits with 124, like a
+ * command killed by timeout. Other errors exit with 1, bad arguments with 2.
+ *
+ * A program that halts itself exits with the code it passed to EXIT, as long
+ * as the code is at most 123. Larger codes would be cut down to 8 bits by the
+ * shell or be mistaken for a fault, they exit with 1.
+ */
+const (
+  EXIT_ERROR = 1
+  EXIT_USAGE = 2
+  EXIT_PROGRAM_MAX = 123
+  EXIT_BUDGET = 124
+  EXIT_ILLEGAL_INSTRUCTION = 132
+  EXIT_STACK = 134
+  EXIT_PC_OVERFLOW = 135
+  EXIT_DIVIDE_BY_ZERO = 136
+  EXIT_MEMORY = 139
+)
+
+// Returns the exit code for an error the machine stopped with
+func exit_code(err error) int {
+  var budget *vm.BudgetExhausted
+  if errors.As(err, &budget) {
+    return EXIT_BUDGET
+  }
+
+  var fault *vm.Fault
+  if !errors.As(err, &fault) {
+    return EXIT_ERROR
+  }
+
+  switch fault.Kind {
+    case vm.FAULT_ILLEGAL_INSTRUCTION:
+      return EXIT_ILLEGAL_INSTRUCTION
+    case vm.FAULT_STACK_OVERFLOW, vm.FAULT_STACK_UNDERFLOW:
+      return EXIT_STACK
+    case vm.FAULT_PC_OVERFLOW:
+      return EXIT_PC_OVERFLOW
+    case vm.FAULT_DIVIDE_BY_ZERO:
+      return EXIT_DIVIDE_BY_ZERO
+    case vm.FAULT_MEMORY:
+      return EXIT_MEMORY
+  }
+  return EXIT_ERROR
+}
+
+// Returns the exit code for a program that halted with the given code
+func program_exit_code(code uint16) int {
+  if code > EXIT_PROGRAM_MAX {
+    return EXIT_ERROR
+  }
+  return int(code)
+}
+
+// Writes the error and, for faults, the faulting instruction and registers
+//
+//   divide by zero (pc 0x0009)
+//
+//     at 0x0009 <fact+3>  9A08  DIV r5 r0 #8
+//
+//     r0 0x0005      5    r4 0x0000      0
+//     ...
+func crash_report(w io.Writer, err error, symbols []rom.Symbol) {
+  fmt.Fprintln(w, err)
+
+  var fault *vm.Fault
+  if !errors.As(err, &fault) {
+    return
+  }
+
+  text, ok := disassembler.Instruction(fault.Word)
+  if !ok {
+    text = fmt.Sprintf(".word 0x%04X", fault.Word)
+  }
+
+  fmt.Fprintln(w)
+  fmt.Fprintf(w, "  at 0x%04X%s  %04X  %s\n", fault.PC, symbol_offset(fault.PC, symbols), fault.Word, text)
+  fmt.Fprintln(w)
+
+  for r := vm.R_R0; r <= vm.R_R3; r++ {
+    fmt.Fprintf(w, "  r%d 0x%04X %6d    r%d 0x%04X %6d\n", r, fault.Regs[r], int16(fault.Regs[r]), r + 4, fault.Regs[r + 4], int16(fault.Regs[r + 4]))
+  }
+  fmt.Fprintf(w, "  sp 0x%04X  mar 0x%04X  cond %s\n", fault.Regs[vm.R_SP], fault.Regs[vm.R_MAR], vm.FlagNames(fault.Regs[vm.R_COND]))
+}
+
+// Describes an address relative to the closest symbol before it, like <loop+2>
+func symbol_offset(address uint16, symbols []rom.Symbol) string {
+  var best *rom.Symbol
+  for i, sym := range symbols {
+    if sym.Address <= address && (best == nil || sym.Address > best.Address) {
+      best = &symbols[i]
+    }
+  }
+
+  if best == nil {
+    return ""
+  }
+  if best.Address == address {
+    return fmt.Sprintf(" <%s>", best.Name)
+  }
+  return fmt.Sprintf(" <%s+%d>", best.Name, address - best.Address)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "vm/debugger"
+)
+
+/**
+ * DEBUG
+ * =============================================================================
+ *
+ * Loads a program and hands it to the interactive debugger instead of running
+ * it. The program reads its input from the debugger's stdin, or with --input
+ * from a file of its own.
+ */
+func debug_command(args []string) int {
+  flags := flag.NewFlagSet("debug", flag.ExitOnError)
+  input_file := flags.String("input", "", "read the program's input from this file instead of stdin")
+  flags.Parse(args)
+
+  if flags.NArg() != 1 {
+    fmt.Println("vm debug prog.rom|prog.asm")
+    return EXIT_USAGE
+  }
+
+  img, err := load_image(flags.Arg(0), asm_options{})
+  if err != nil {
+    fmt.Println("Error loading program:", err)
+    return EXIT_ERROR
+  }
+
+  machine, err := boot(img)
+  if err != nil {
+    fmt.Println(err)
+    return EXIT_ERROR
+  }
+
+  if *input_file != "" {
+    file, err := os.Open(*input_file)
+    if err != nil {
+      fmt.Println(err)
+      return EXIT_ERROR
+    }
+    defer file.Close()
+    machine.In = file
+  }
+
+  if err := debugger.New(machine, img.Symbols, os.Stdout).Run(os.Stdin); err != nil {
+    fmt.Println(err)
+    return EXIT_ERROR
+  }
+
+  return 0
+}
@@ -0,0 +1,582 @@
+package debugger
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "sort"
+  "strconv"
+  "strings"
+  "vm/disassembler"
+  "vm/instructions"
+  "vm/rom"
+  "vm/vm"
+)
+
+/**
+ * DEBUGGER
+ * =============================================================================
+ *
+ * An interactive debugger driving a machine one instruction at a time. It reads
+ * commands line by line, an empty line repeats the previous command.
+ *
+ * Addresses can be given as numbers (decimal or 0x prefixed hexadecimal) or as
+ * labels from the program's symbol table.
+ *
+ * The debugger keeps a history of the last HISTORY_LIMIT steps, so execution
+ * can also go backwards.
+ */
+const HELP = `commands:
+  break|b <addr>          set a breakpoint
+  delete|d [addr]         delete a breakpoint, or all of them
+  info|i                  list the breakpoints and segments
+  step|s [n]              execute n instructions (default 1)
+  next|n                  step over the instruction at PC
+  continue|c              run until a breakpoint is hit or the program halts
+  step-back|sb [n]        undo the last n instructions (default 1)
+  reverse-continue|rc [reg|addr]
+                          run backwards to a breakpoint, or to the last
+                          instruction that wrote the register or address
+  history|hist <reg|addr> show every change of a register or memory word
+  regs|r                  show the registers
+  mem|x <addr> [n]        show n memory words (default 8)
+  set <reg|addr> <value>  change a register (r0-r7, pc, cond, mar, sp) or memory word
+  list|l [addr]           disassemble around PC or the given address
+  help|h                  show this help
+  quit|q                  leave the debugger`
+
+// How many instructions list shows before and after the address
+const LIST_CONTEXT = 5
+
+// How many steps the debugger can go back
+const HISTORY_LIMIT = 100000
+
+type Debugger struct {
+  Machine *vm.Machine
+
+  symbols map[string]uint16
+  labels map[uint16][]string
+  breakpoints map[uint16]bool
+  history *vm.History
+
+  out io.Writer
+  last string
+}
+
+// Creates a debugger for a machine that has the program already loaded
+func New(machine *vm.Machine, symbols []rom.Symbol, out io.Writer) *Debugger {
+  d := &Debugger{
+    Machine: machine,
+    symbols: map[string]uint16{},
+    labels: map[uint16][]string{},
+    breakpoints: map[uint16]bool{},
+    history: vm.NewHistory(HISTORY_LIMIT),
+    out: out,
+  }
+  machine.Attach(d.history)
+
+  for _, sym := range symbols {
+    d.symbols[sym.Name] = sym.Address
+    d.labels[sym.Address] = append(d.labels[sym.Address], sym.Name)
+  }
+
+  return d
+}
+
+// Reads and executes commands until the input ends or quit is entered. A
+// program reading from the same input as the debugger shares its buffer, so
+// commands and program input are read in the order they are typed.
+func (d *Debugger) Run(in io.Reader) error {
+  var reader *bufio.Reader
+  if d.Machine.In == in {
+    reader = d.Machine.Input()
+  } else {
+    reader = bufio.NewReader(in)
+  }
+
+  d.list(d.Machine.Reg[vm.R_PC])
+
+  for {
+    fmt.Fprint(d.out, "(vm) ")
+
+    line, err := reader.ReadString('\n')
+    if line == "" && err != nil {
+      fmt.Fprintln(d.out)
+      if err == io.EOF {
+        return nil
+      }
+      return err
+    }
+
+    if quit := d.Execute(strings.TrimRight(line, "\r\n")); quit {
+      return nil
+    }
+  }
+}
+
+// Executes a single command. Returns true if the debugger should quit.
+func (d *Debugger) Execute(line string) bool {
+  fields := strings.Fields(line)
+
+  if len(fields) == 0 {
+    if d.last == "" {
+      return false
+    }
+    fields = strings.Fields(d.last)
+  } else {
+    d.last = line
+  }
+
+  cmd, args := fields[0], fields[1:]
+  m := d.Machine
+
+  switch cmd {
+    case "break", "b":
+      if len(args) != 1 {
+        fmt.Fprintln(d.out, "usage: break <addr>")
+        break
+      }
+      if address, ok := d.address(args[0]); ok {
+        d.breakpoints[address] = true
+        fmt.Fprintf(d.out, "breakpoint at %s\n", d.describe(address))
+      }
+
+    case "delete", "d":
+      if len(args) == 0 {
+        d.breakpoints = map[uint16]bool{}
+        break
+      }
+      if address, ok := d.address(args[0]); ok {
+        delete(d.breakpoints, address)
+      }
+
+    case "info", "i":
+      addresses := []int{}
+      for address := range d.breakpoints {
+        addresses = append(addresses, int(address))
+      }
+      sort.Ints(addresses)
+
+      if len(addresses) == 0 {
+        fmt.Fprintln(d.out, "no breakpoints")
+      }
+      for _, address := range addresses {
+        fmt.Fprintf(d.out, "breakpoint at %s\n", d.describe(uint16(address)))
+      }
+
+      layout := d.Machine.Layout
+      for _, s := range []struct{ name string; segment vm.Segment }{
+        {"constants", layout.Constants},
+        {"code", layout.Code},
+        {"data", layout.Data},
+      } {
+        fmt.Fprintf(d.out, "%-9s 0x%04X-0x%04X (%d words)\n", s.name, s.segment.Start, int(s.segment.Start) + int(s.segment.Size), s.segment.Size)
+      }
+
+    case "step", "s":
+      count := 1
+      if len(args) > 0 {
+        n, err := strconv.Atoi(args[0])
+        if err != nil || n < 1 {
+          fmt.Fprintf(d.out, "invalid count %q\n", args[0])
+          break
+        }
+        count = n
+      }
+
+      for i := 0; i < count && !m.Halted; i++ {
+        if !d.step() {
+          break
+        }
+      }
+      d.stopped()
+
+    case "next", "n":
+      d.next()
+      d.stopped()
+
+    case "continue", "c":
+      d.resume()
+      d.stopped()
+
+    case "step-back", "sb":
+      count := 1
+      if len(args) > 0 {
+        n, err := strconv.Atoi(args[0])
+        if err != nil || n < 1 {
+          fmt.Fprintf(d.out, "invalid count %q\n", args[0])
+          break
+        }
+        count = n
+      }
+
+      for i := 0; i < count; i++ {
+        if _, ok := d.history.Undo(m); !ok {
+          fmt.Fprintln(d.out, "reached the start of the history")
+          break
+        }
+      }
+      d.stopped()
+
+    case "reverse-continue", "rc":
+      if len(args) > 0 {
+        if t, ok := d.target(args[0]); ok {
+          d.reverse(t)
+        }
+      } else {
+        d.reverse(nil)
+      }
+      d.stopped()
+
+    case "history", "hist":
+      if len(args) != 1 {
+        fmt.Fprintln(d.out, "usage: history <reg|addr>")
+        break
+      }
+      if t, ok := d.target(args[0]); ok {
+        d.changes(t)
+      }
+
+    case "regs", "r":
+      d.registers()
+
+    case "mem", "x":
+      if len(args) < 1 {
+        fmt.Fprintln(d.out, "usage: mem <addr> [n]")
+        break
+      }
+
+      address, ok := d.address(args[0])
+      if !ok {
+        break
+      }
+
+      count := 8
+      if len(args) > 1 {
+        n, err := strconv.Atoi(args[1])
+        if err != nil || n < 1 {
+          fmt.Fprintf(d.out, "invalid count %q\n", args[1])
+          break
+        }
+        count = n
+      }
+
+      d.memory(address, count)
+
+    case "set":
+      if len(args) != 2 {
+        fmt.Fprintln(d.out, "usage: set <reg|addr> <value>")
+        break
+      }
+
+      value, err := parse_number(args[1])
+      if err != nil {
+        fmt.Fprintln(d.out, err)
+        break
+      }
+
+      // Undoing steps from before the change would mix old and new state
+      if r, ok := register(args[0]); ok {
+        m.Reg[r] = value
+        d.history.Clear()
+      } else if address, ok := d.address(args[0]); ok {
+        m.Memory[address] = value
+        d.history.Clear()
+      }
+
+    case "list", "l":
+      address := m.Reg[vm.R_PC]
+      if len(args) > 0 {
+        a, ok := d.address(args[0])
+        if !ok {
+          break
+        }
+        address = a
+      }
+      d.list(address)
+
+    case "help", "h":
+      fmt.Fprintln(d.out, HELP)
+
+    case "quit", "q":
+      return true
+
+    default:
+      fmt.Fprintf(d.out, "unknown command %q, try help\n", cmd)
+  }
+
+  return false
+}
+
+/**
+ * EXECUTION
+ * =============================================================================
+ */
+
+// Executes a single instruction. Returns false if the machine failed.
+func (d *Debugger) step() bool {
+  if err := d.Machine.Step(); err != nil {
+    fmt.Fprintln(d.out, err)
+    return false
+  }
+  return true
+}
+
+// Steps over the instruction at PC. A CALL runs until the subroutine returns,
+// unless the program halts or reaches a breakpoint first.
+func (d *Debugger) next() {
+  m := d.Machine
+  pc := m.Reg[vm.R_PC]
+  sp := m.Reg[vm.R_SP]
+
+  // A CALL is a JUMP with the link bit set
+  word := m.Memory[pc]
+  if word >> 12 != instructions.OP_JUMP || (word >> 10) & 0x1 == 0 {
+    d.step()
+    return
+  }
+
+  for !m.Halted {
+    if !d.step() {
+      return
+    }
+    if m.Reg[vm.R_PC] == pc + 1 && m.Reg[vm.R_SP] == sp {
+      return
+    }
+    if d.breakpoints[m.Reg[vm.R_PC]] {
+      fmt.Fprintf(d.out, "breakpoint at %s\n", d.describe(m.Reg[vm.R_PC]))
+      return
+    }
+  }
+}
+
+// Runs until the program halts or reaches a breakpoint. The instruction at PC
+// is always executed, so continuing from a breakpoint does not stop right away.
+func (d *Debugger) resume() {
+  m := d.Machine
+
+  for !m.Halted {
+    if !d.step() {
+      return
+    }
+    if d.breakpoints[m.Reg[vm.R_PC]] {
+      fmt.Fprintf(d.out, "breakpoint at %s\n", d.describe(m.Reg[vm.R_PC]))
+      return
+    }
+  }
+}
+
+/**
+ * REVERSE EXECUTION
+ * =============================================================================
+ */
+
+// A register or memory word whose changes are looked for in the history
+type target struct {
+  name string
+  reg int
+  address uint16
+  is_reg bool
+}
+
+func (t *target) written(r *vm.Record) bool {
+  if t.is_reg {
+    return r.Wrote(t.reg)
+  }
+  return r.WroteMemory(t.address)
+}
+
+func (d *Debugger) target(arg string) (*target, bool) {
+  if r, ok := register(arg); ok {
+    return &target{name: vm.RegisterName(r), reg: r, is_reg: true}, true
+  }
+  if address, ok := d.address(arg); ok {
+    return &target{name: d.describe(address), address: address}, true
+  }
+  return nil, false
+}
+
+// Runs backwards until the instruction that last wrote the target is about to
+// execute again, or without a target until a breakpoint is reached
+func (d *Debugger) reverse(t *target) {
+  m := d.Machine
+
+  for {
+    r, ok := d.history.Undo(m)
+    if !ok {
+      fmt.Fprintln(d.out, "reached the start of the history")
+      return
+    }
+
+    if t != nil && t.written(&r) {
+      fmt.Fprintf(d.out, "%s written by step %d\n", t.name, r.Cycle)
+      return
+    }
+    if t == nil && d.breakpoints[m.Reg[vm.R_PC]] {
+      fmt.Fprintf(d.out, "breakpoint at %s\n", d.describe(m.Reg[vm.R_PC]))
+      return
+    }
+  }
+}
+
+// Lists every recorded change of the target, oldest first
+func (d *Debugger) changes(t *target) {
+  found := false
+
+  for _, r := range d.history.Records() {
+    text, ok := disassembler.Instruction(r.Word)
+    if !ok {
+      text = fmt.Sprintf(".word 0x%04X", r.Word)
+    }
+
+    if t.is_reg && r.Wrote(t.reg) {
+      fmt.Fprintf(d.out, "step %-8d 0x%04X  %-20s  0x%04X -> 0x%04X\n", r.Cycle, r.PC, text, r.Before[t.reg], r.After[t.reg])
+      found = true
+    }
+    for _, w := range r.Writes {
+      if !t.is_reg && w.Address == t.address {
+        fmt.Fprintf(d.out, "step %-8d 0x%04X  %-20s  0x%04X -> 0x%04X\n", r.Cycle, r.PC, text, w.Old, w.New)
+        found = true
+      }
+    }
+  }
+
+  if !found {
+    fmt.Fprintf(d.out, "no changes of %s in the last %d steps\n", t.name, d.history.Len())
+  }
+}
+
+// Shows where execution stopped
+func (d *Debugger) stopped() {
+  if d.Machine.Halted {
+    fmt.Fprintln(d.out, "program halted")
+    return
+  }
+  fmt.Fprintln(d.out, d.line(d.Machine.Reg[vm.R_PC]))
+}
+
+/**
+ * INSPECTION
+ * =============================================================================
+ */
+func (d *Debugger) registers() {
+  m := d.Machine
+
+  for r := vm.R_R0; r <= vm.R_R7; r++ {
+    fmt.Fprintf(d.out, "r%d   0x%04X %6d\n", r, m.Reg[r], int16(m.Reg[r]))
+  }
+
+  fmt.Fprintf(d.out, "pc   %s\n", d.describe(m.Reg[vm.R_PC]))
+  fmt.Fprintf(d.out, "cond 0x%04X %s\n", m.Reg[vm.R_COND], vm.FlagNames(m.Reg[vm.R_COND]))
+  fmt.Fprintf(d.out, "mar  0x%04X\n", m.Reg[vm.R_MAR])
+  fmt.Fprintf(d.out, "sp   0x%04X\n", m.Reg[vm.R_SP])
+}
+
+func (d *Debugger) memory(address uint16, count int) {
+  for i := 0; i < count; i++ {
+    a := address + uint16(i)
+    value := d.Machine.Memory[a]
+    fmt.Fprintf(d.out, "0x%04X  0x%04X %6d\n", a, value, int16(value))
+  }
+}
+
+// Disassembles the instructions around the given address
+func (d *Debugger) list(address uint16) {
+  start := int(address) - LIST_CONTEXT
+  if start < 0 {
+    start = 0
+  }
+
+  for a := start; a <= int(address) + LIST_CONTEXT && a < vm.MEMORY_MAX; a++ {
+    for _, label := range d.labels[uint16(a)] {
+      fmt.Fprintf(d.out, "%s:\n", label)
+    }
+    fmt.Fprintln(d.out, d.line(uint16(a)))
+  }
+}
+
+// Renders the instruction at the given address as a single line, marking the
+// program counter with an arrow and breakpoints with an asterisk
+func (d *Debugger) line(address uint16) string {
+  m := d.Machine
+  word := m.Memory[address]
+
+  marker := "  "
+  if address == m.Reg[vm.R_PC] {
+    marker = "=>"
+  }
+
+  bp := " "
+  if d.breakpoints[address] {
+    bp = "*"
+  }
+
+  // The start address and the constant pool hold numbers, not instructions
+  layout := m.Layout
+  is_data := layout.Constants.Contains(address) || (address == 0 && layout.Code.Size > 0)
+
+  text, ok := disassembler.Instruction(word)
+  if !ok || is_data {
+    text = fmt.Sprintf(".word 0x%04X", word)
+  } else if target, ok := disassembler.JumpTarget(address, word); ok {
+    text += fmt.Sprintf("    ; -> %s", d.describe(target))
+  }
+
+  return fmt.Sprintf("%s%s 0x%04X  %04X  %s", bp, marker, address, word, text)
+}
+
+// Formats an address together with the labels pointing at it
+func (d *Debugger) describe(address uint16) string {
+  if labels, ok := d.labels[address]; ok {
+    return fmt.Sprintf("0x%04X <%s>", address, strings.Join(labels, ", "))
+  }
+  return fmt.Sprintf("0x%04X", address)
+}
+
+/**
+ * ARGUMENTS
+ * =============================================================================
+ */
+
+// Resolves a label or number to an address, reporting invalid ones
+func (d *Debugger) address(arg string) (uint16, bool) {
+  if address, ok := d.symbols[arg]; ok {
+    return address, true
+  }
+
+  n, err := strconv.ParseUint(arg, 0, 16)
+  if err != nil {
+    fmt.Fprintf(d.out, "%q is neither an address nor a label\n", arg)
+    return 0, false
+  }
+
+  return uint16(n), true
+}
+
+func register(arg string) (int, bool) {
+  switch strings.ToLower(arg) {
+    case "pc":
+      return vm.R_PC, true
+    case "cond":
+      return vm.R_COND, true
+    case "mar":
+      return vm.R_MAR, true
+    case "sp":
+      return vm.R_SP, true
+  }
+
+  name := strings.TrimPrefix(strings.ToLower(arg), "r")
+  r, err := strconv.Atoi(name)
+  if err != nil || r < vm.R_R0 || r > vm.R_R7 || name == arg {
+    return 0, false
+  }
+  return r, true
+}
+
+func parse_number(arg string) (uint16, error) {
+  n, err := strconv.ParseInt(arg, 0, 32)
+  if err != nil || n < -0x8000 || n > 0xFFFF {
+    return 0, fmt.Errorf("%q is not a 16-bit value", arg)
+  }
+  return uint16(n), nil
+}
@@ -0,0 +1,59 @@
+package devices
+
+import (
+  "fmt"
+  "vm/vm"
+)
+
+/**
+ * CONSOLE
+ * =============================================================================
+ *
+ * Reading the data register returns the next character of the machine's input,
+ * 0xFFFF at the end of it. Writing it prints a character to the output.
+ *
+ * The status register has bit 0 set while there is input left and bit 1 set
+ * when a character can be written, which is always. Checking for input blocks
+ * until some arrives.
+ */
+const (
+  CONSOLE_DATA   = 0x0
+  CONSOLE_STATUS = 0x1
+  CONSOLE_SIZE   = 2
+)
+
+const (
+  CONSOLE_INPUT_READY  = 0x1
+  CONSOLE_OUTPUT_READY = 0x2
+)
+
+type Console struct {}
+
+func NewConsole() *Console {
+  return &Console{}
+}
+
+func (c *Console) Read(m *vm.Machine, offset uint16) uint16 {
+  switch offset {
+    case CONSOLE_DATA:
+      b, err := m.Input().ReadByte()
+      if err != nil {
+        return 0xFFFF
+      }
+      return uint16(b)
+
+    case CONSOLE_STATUS:
+      var status uint16 = CONSOLE_OUTPUT_READY
+      if _, err := m.Input().Peek(1); err == nil {
+        status |= CONSOLE_INPUT_READY
+      }
+      return status
+  }
+  return 0
+}
+
+func (c *Console) Write(m *vm.Machine, offset uint16, value uint16) {
+  if offset == CONSOLE_DATA {
+    fmt.Fprintf(m.Out, "%c", rune(value))
+  }
+}
@@ -0,0 +1,41 @@
+package devices
+
+import (
+  "vm/instructions"
+  "vm/vm"
+)
+
+/**
+ * DEVICES
+ * =============================================================================
+ *
+ * Peripherals for the device bus of the machine. The standard devices are
+ * mapped at the end of the read/write memory, so programs reach them with
+ * LOADM and STOREM:
+ *
+ *   0x1F0  console data     (read a character, write a character)
+ *   0x1F1  console status
+ *   0x1F2  timer, low word  (milliseconds since the device was created)
+ *   0x1F3  timer, high word
+ *   0x1F4  random number    (write to seed)
+ */
+const (
+  CONSOLE_OFFSET = instructions.DEVICE_OFFSET
+  TIMER_OFFSET   = instructions.DEVICE_OFFSET + 2
+  RANDOM_OFFSET  = instructions.DEVICE_OFFSET + 4
+)
+
+// Maps the console, timer and random number generator at their offsets into
+// the read/write memory. Call it after loading the program, as the read/write
+// memory starts at R_MAR.
+func MapStandard(m *vm.Machine) error {
+  base := m.Reg[vm.R_MAR]
+
+  if err := m.Map(base + CONSOLE_OFFSET, CONSOLE_SIZE, NewConsole()); err != nil {
+    return err
+  }
+  if err := m.Map(base + TIMER_OFFSET, TIMER_SIZE, NewTimer()); err != nil {
+    return err
+  }
+  return m.Map(base + RANDOM_OFFSET, RANDOM_SIZE, NewRandom())
+}
@@ -0,0 +1,75 @@
+package devices
+
+import (
+  "fmt"
+  "io"
+  "vm/instructions"
+  "vm/vm"
+)
+
+/**
+ * FRAMEBUFFER
+ * =============================================================================
+ *
+ * A grid of pixels, one word each, stored row by row. The framebuffer is not
+ * part of the standard devices as it takes a good part of the read/write
+ * memory. Hosts that want one map it with MapFramebuffer into the 128 words
+ * right below the standard devices, and read the pixels after or while the
+ * program runs. Programs draw with STOREM at FRAMEBUFFER_OFFSET + y * width + x
+ * and have to keep their own data below FRAMEBUFFER_OFFSET.
+ */
+const (
+  FRAMEBUFFER_SIZE   = 0x80
+  FRAMEBUFFER_OFFSET = instructions.DEVICE_OFFSET - FRAMEBUFFER_SIZE
+)
+
+type Framebuffer struct {
+  Width uint16
+  Height uint16
+  Pixels []uint16
+}
+
+func NewFramebuffer(width uint16, height uint16) *Framebuffer {
+  return &Framebuffer{Width: width, Height: height, Pixels: make([]uint16, int(width) * int(height))}
+}
+
+// Maps the framebuffer at FRAMEBUFFER_OFFSET into the read/write memory. Call
+// it after loading the program, like MapStandard.
+func MapFramebuffer(m *vm.Machine, f *Framebuffer) error {
+  if len(f.Pixels) > FRAMEBUFFER_SIZE {
+    return fmt.Errorf("framebuffer of %dx%d pixels does not fit into %d words", f.Width, f.Height, FRAMEBUFFER_SIZE)
+  }
+  return m.Map(m.Reg[vm.R_MAR] + FRAMEBUFFER_OFFSET, f.Size(), f)
+}
+
+// Number of addresses the framebuffer claims
+func (f *Framebuffer) Size() uint16 {
+  return uint16(len(f.Pixels))
+}
+
+func (f *Framebuffer) Read(m *vm.Machine, offset uint16) uint16 {
+  return f.Pixels[offset]
+}
+
+func (f *Framebuffer) Write(m *vm.Machine, offset uint16, value uint16) {
+  f.Pixels[offset] = value
+}
+
+// Draws the framebuffer as text, a # for every pixel that is set
+func (f *Framebuffer) Render(w io.Writer) error {
+  line := make([]byte, f.Width + 1)
+  line[f.Width] = '\n'
+
+  for y := 0; y < int(f.Height); y++ {
+    for x := 0; x < int(f.Width); x++ {
+      line[x] = ' '
+      if f.Pixels[y * int(f.Width) + x] != 0 {
+        line[x] = '#'
+      }
+    }
+    if _, err := w.Write(line); err != nil {
+      return err
+    }
+  }
+  return nil
+}
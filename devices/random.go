@@ -0,0 +1,32 @@
+package devices
+
+import (
+  "math/rand"
+  "time"
+  "vm/vm"
+)
+
+/**
+ * RANDOM NUMBER GENERATOR
+ * =============================================================================
+ *
+ * Every read returns a new pseudo random word. Writing a value seeds the
+ * generator, so runs can be repeated.
+ */
+const RANDOM_SIZE = 1
+
+type Random struct {
+  rng *rand.Rand
+}
+
+func NewRandom() *Random {
+  return &Random{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (r *Random) Read(m *vm.Machine, offset uint16) uint16 {
+  return uint16(r.rng.Intn(0x10000))
+}
+
+func (r *Random) Write(m *vm.Machine, offset uint16, value uint16) {
+  r.rng.Seed(int64(value))
+}
@@ -0,0 +1,54 @@
+package devices
+
+import (
+  "time"
+  "vm/vm"
+)
+
+/**
+ * TIMER
+ * =============================================================================
+ *
+ * Counts milliseconds since it was created or last reset. Reading the low word
+ * latches the high word, so reading low then high gives a consistent 32-bit
+ * value. Writing any value to the low word resets the timer.
+ */
+const (
+  TIMER_LOW  = 0x0
+  TIMER_HIGH = 0x1
+  TIMER_SIZE = 2
+)
+
+type Timer struct {
+  start time.Time
+  high uint16
+
+  // Returns the current time, replaceable for deterministic runs
+  Now func() time.Time
+}
+
+func NewTimer() *Timer {
+  t := &Timer{Now: time.Now}
+  t.start = t.Now()
+  return t
+}
+
+func (t *Timer) Read(m *vm.Machine, offset uint16) uint16 {
+  switch offset {
+    case TIMER_LOW:
+      elapsed := uint32(t.Now().Sub(t.start).Milliseconds())
+      t.high = uint16(elapsed >> 16)
+      return uint16(elapsed)
+
+    case TIMER_HIGH:
+      return t.high
+  }
+  return 0
+}
+
+func (t *Timer) Write(m *vm.Machine, offset uint16, value uint16) {
+  if offset == TIMER_LOW {
+    t.start = t.Now()
+    t.high = 0
+  }
+}
@@ -0,0 +1,226 @@
+package disassembler
+
+import (
+  "fmt"
+  "strings"
+  "vm/instructions"
+)
+
+/**
+ * DISASSEMBLER
+ * =============================================================================
+ *
+ * Turns program images back into source code the assembler understands. The
+ * constant pool is rendered as CONST lines followed by the START marker, the
+ * code as one instruction per line. Jumps and branches into the code get a
+ * label, so the output assembles back into an identical image.
+ *
+ * Words that do not decode to an instruction, or that have bits set the
+ * assembler never sets, are rendered as a raw .word.
+ */
+
+// Disassembles a program image as produced by the assembler
+func Disassemble(image []uint16) (string, error) {
+  if len(image) == 0 {
+    return "", fmt.Errorf("empty program image")
+  }
+
+  entry := int(image[0])
+  if entry < 1 || entry > len(image) {
+    return "", fmt.Errorf("program start 0x%04X is outside the image", entry)
+  }
+
+  var b strings.Builder
+
+  for _, value := range image[1:entry] {
+    fmt.Fprintf(&b, "CONST %d\n", value)
+  }
+  b.WriteString("START\n")
+
+  // Every jump into the code gets a label
+  labels := map[uint16]string{}
+  for address := entry; address < len(image); address++ {
+    target, ok := JumpTarget(uint16(address), image[address])
+    if ok && int(target) >= entry && int(target) < len(image) {
+      labels[target] = fmt.Sprintf("L%04X", target)
+    }
+  }
+
+  for address := entry; address < len(image); address++ {
+    word := image[address]
+
+    if label, ok := labels[uint16(address)]; ok {
+      fmt.Fprintf(&b, "%s:\n", label)
+    }
+
+    text, ok := Instruction(word)
+    if !ok {
+      fmt.Fprintf(&b, "  .word 0x%04X\n", word)
+      continue
+    }
+
+    if target, ok := JumpTarget(uint16(address), word); ok {
+      if label, ok := labels[target]; ok {
+        text = strings.Fields(text)[0] + " " + label
+      }
+    }
+
+    fmt.Fprintf(&b, "  %s\n", text)
+  }
+
+  return b.String(), nil
+}
+
+// Returns the address a JUMP, CALL or BR at the given address continues at
+// when it is taken. The second return value is false if the word is none of
+// them.
+func JumpTarget(address uint16, word uint16) (uint16, bool) {
+  if _, ok := Instruction(word); !ok || word == 0 {
+    return 0, false
+  }
+
+  if word >> 12 == instructions.OP_BR {
+    return address + 1 + uint16(sign_extend(word & 0x7F, 7)), true
+  }
+  if word >> 12 != instructions.OP_JUMP {
+    return 0, false
+  }
+
+  offset := word & 0x3FF
+  if (word >> 11) & 0x1 == 1 {
+    return address + 1 - offset, true
+  }
+  return address + 1 + offset, true
+}
+
+// Decodes a single instruction word. Jumps are rendered with their relative
+// offset. The second return value is false if the word is not an instruction
+// the assembler could have produced.
+func Instruction(word uint16) (string, bool) {
+  op := word >> 12
+  r1 := (word >> 9) & 0x7
+  imm_flag := (word >> 8) & 0x1
+
+  switch op {
+    case instructions.OP_BR:
+      cond := (word >> 7) & 0x1F
+      if cond == 0 {
+        return "HALT", word == 0
+      }
+      return fmt.Sprintf("%s #%d", branch_mnemonic(cond), sign_extend(word & 0x7F, 7)), true
+
+    case instructions.OP_LOADC:
+      return fmt.Sprintf("LOADC r%d %d", r1, word & 0x1FF), true
+
+    case instructions.OP_LOADM:
+      return fmt.Sprintf("LOADM r%d %d", r1, word & 0x1FF), true
+
+    case instructions.OP_STOREM:
+      return fmt.Sprintf("STOREM r%d %d", r1, word & 0x1FF), true
+
+    case instructions.OP_MOVE, instructions.OP_NOT:
+      r2 := (word >> 6) & 0x7
+      return fmt.Sprintf("%s r%d r%d", mnemonics[op], r1, r2), word & 0x3F == 0
+
+    case instructions.OP_JUMP:
+      si := (word >> 11) & 0x1
+      offset := int(word & 0x3FF)
+
+      // A negative zero cannot be written down
+      if si == 1 && offset == 0 {
+        return "", false
+      }
+      if si == 1 {
+        offset = -offset
+      }
+      if (word >> 10) & 0x1 == 1 {
+        return fmt.Sprintf("CALL #%d", offset), true
+      }
+      return fmt.Sprintf("JUMP #%d", offset), true
+
+    case instructions.OP_ADD, instructions.OP_SUB, instructions.OP_MUL, instructions.OP_DIV:
+      r2 := (word >> 5) & 0x7
+
+      if imm_flag == 1 {
+        return fmt.Sprintf("%s r%d r%d #%d", mnemonics[op], r1, r2, sign_extend(word & 0x1F, 5)), true
+      }
+      return fmt.Sprintf("%s r%d r%d r%d", mnemonics[op], r1, r2, word & 0x7), word & 0x18 == 0
+
+    case instructions.OP_EQ, instructions.OP_LT, instructions.OP_LE:
+      if imm_flag == 1 {
+        return fmt.Sprintf("%s r%d #%d", mnemonics[op], r1, sign_extend(word & 0xFF, 8)), true
+      }
+      return fmt.Sprintf("%s r%d r%d", mnemonics[op], r1, word & 0x7), word & 0xF8 == 0
+
+    case instructions.OP_EXT:
+      ext := (word >> 9) & 0x7
+      r := (word >> 6) & 0x7
+
+      switch ext {
+        case instructions.EXT_DBG:
+          return "DBG", word & 0x1FF == 0
+        case instructions.EXT_PUSH:
+          return fmt.Sprintf("PUSH r%d", r), word & 0x3F == 0
+        case instructions.EXT_POP:
+          return fmt.Sprintf("POP r%d", r), word & 0x3F == 0
+        case instructions.EXT_RET:
+          return "RET", word & 0x1FF == 0
+      }
+
+    case instructions.OP_TRAP:
+      vector := word & 0xFF
+      if name, ok := traps[vector]; ok {
+        return name, word & 0xF00 == 0
+      }
+      return fmt.Sprintf("TRAP 0x%02X", vector), word & 0xF00 == 0
+  }
+
+  return "", false
+}
+
+var mnemonics = map[uint16]string{
+  instructions.OP_MOVE: "MOVE",
+  instructions.OP_ADD: "ADD",
+  instructions.OP_SUB: "SUB",
+  instructions.OP_MUL: "MUL",
+  instructions.OP_DIV: "DIV",
+  instructions.OP_NOT: "NOT",
+  instructions.OP_EQ: "EQ",
+  instructions.OP_LT: "LT",
+  instructions.OP_LE: "LE",
+}
+
+var traps = map[uint16]string{
+  instructions.TRAP_GETC: "GETC",
+  instructions.TRAP_PUTC: "PUTC",
+  instructions.TRAP_PUTS: "PUTS",
+  instructions.TRAP_PUTI: "PUTI",
+  instructions.TRAP_PUTX: "PUTX",
+  instructions.TRAP_HALT: "EXIT",
+  instructions.TRAP_GETI: "GETI",
+}
+
+// Renders the conditions of a branch, e.g. BRnz
+func branch_mnemonic(cond uint16) string {
+  name := "BR"
+  for _, c := range []struct{ flag uint16; letter string }{
+    {instructions.BR_N, "n"},
+    {instructions.BR_Z, "z"},
+    {instructions.BR_P, "p"},
+    {instructions.BR_C, "c"},
+    {instructions.BR_V, "v"},
+  } {
+    if cond & c.flag != 0 {
+      name += c.letter
+    }
+  }
+  return name
+}
+
+// Sign extends a field of the given width into a signed integer
+func sign_extend(x uint16, bit_count int) int {
+  if (x >> (bit_count - 1)) & 1 == 1 {
+    return int(x) - (1 << bit_count)
+  }
+  return int(x)
+}
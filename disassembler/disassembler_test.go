@@ -0,0 +1,139 @@
+package disassembler
+
+import (
+  "os"
+  "testing"
+  "vm/assembler"
+)
+
+// Every word the disassembler accepts as an instruction has to assemble back
+// into the same word
+func TestInstructionRoundTrip(t *testing.T) {
+  valid := 0
+
+  for w := 0; w <= 0xFFFF; w++ {
+    word := uint16(w)
+
+    text, ok := Instruction(word)
+    if !ok {
+      continue
+    }
+    valid++
+
+    image, err := assembler.Assemble("START\n" + text)
+    if err != nil {
+      t.Errorf("0x%04X: %q does not assemble: %v", word, text, err)
+      continue
+    }
+    if len(image) != 2 || image[1] != word {
+      t.Errorf("0x%04X: %q assembles to %04X", word, text, image[1:])
+    }
+  }
+
+  if valid == 0 {
+    t.Fatalf("no word decoded to an instruction")
+  }
+}
+
+// Uses every instruction, jumps in both directions and a raw word
+const sample_program = `
+CONST 10
+CONST -1
+START
+  LOADC r0 0
+  LOADC r1 1
+loop:
+  ADD r2 r2 #1
+  SUB r0 r0 #1
+  EQ r0 #0
+  JUMP loop
+  BRnp loop
+  LT r2 #5
+  JUMP small
+  MUL r2 r2 r2
+  DIV r2 r2 #3
+  NOT r3 r2
+  MOVE r3 r4
+  LE r4 r1
+  EQ r4 #-2
+small:
+  STOREM r2 12
+  LOADM r5 12
+  JUMP #0
+  BRzpcv #0
+  .word 0xFFFF
+  TRAP x30
+  PUTI
+  CALL small
+  PUSH r2
+  POP r0
+  RET
+  DBG
+  HALT
+`
+
+// Assembling, disassembling and assembling again gives the same image
+func TestDisassembleRoundTrip(t *testing.T) {
+  example, err := os.ReadFile("../example.asm")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  programs := map[string]string{
+    "example.asm": string(example),
+    "sample": sample_program,
+  }
+
+  for name, source := range programs {
+    t.Run(name, func(t *testing.T) {
+      image, err := assembler.Assemble(source)
+      if err != nil {
+        t.Fatalf("assembling failed: %v", err)
+      }
+
+      text, err := Disassemble(image)
+      if err != nil {
+        t.Fatalf("disassembling failed: %v", err)
+      }
+
+      again, err := assembler.Assemble(text)
+      if err != nil {
+        t.Fatalf("the disassembly does not assemble: %v\n%s", err, text)
+      }
+      if len(again) != len(image) {
+        t.Fatalf("image of %d words became %d words", len(image), len(again))
+      }
+      for i := range image {
+        if again[i] != image[i] {
+          t.Errorf("word %d: 0x%04X became 0x%04X", i, image[i], again[i])
+        }
+      }
+    })
+  }
+}
+
+// Words that are not instructions survive as .word
+func TestDisassembleRawWords(t *testing.T) {
+  image := []uint16{1, 0xEE00, 0x0000}
+
+  text, err := Disassemble(image)
+  if err != nil {
+    t.Fatal(err)
+  }
+  again, err := assembler.Assemble(text)
+  if err != nil {
+    t.Fatalf("the disassembly does not assemble: %v\n%s", err, text)
+  }
+  if len(again) != 3 || again[1] != 0xEE00 {
+    t.Errorf("raw word became %04X", again)
+  }
+}
+
+func TestDisassembleRejectsBadImages(t *testing.T) {
+  if _, err := Disassemble(nil); err == nil {
+    t.Errorf("an empty image disassembled")
+  }
+  if _, err := Disassemble([]uint16{5, 0}); err == nil {
+    t.Errorf("an image starting outside itself disassembled")
+  }
+}
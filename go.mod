@@ -1 +1,3 @@
 module vm
+
+go 1.27.1
@@ -29,11 +29,19 @@ package instructions
 
  // 10. [x] NOT - Bitwise NOT
  // 11. [x] EQ  - Check if two registers are equal if: continue else: PC++
- // 12. [ ] LT  - Check if register A is less than register B if: continue else: PC++
- // 13. [ ] LE  - Check if register A is less than or equal to register B if: continue else: PC++
+ // 12. [x] LT  - Check if register A is less than register B if: continue else: PC++
+ // 13. [x] LE  - Check if register A is less than or equal to register B if: continue else: PC++
+
+ // 14. [x] BR - Branch if any of the selected condition flags is set. BR shares
+ //     its opcode with HALT, a BR without conditions halts the machine.
+ // 15. [x] TRAP - Call the host through the trap table
+
+ // 16. [x] CALL - A JUMP with the link bit set, pushes the return address
+ // 17. [x] EXT - Instructions sharing the last free opcode (DBG, PUSH, POP, RET)
 
 const (
     OP_HALT    = 0x0  /* Halt the program */
+    OP_BR      = 0x0  /* BR, a HALT with condition flags */
     OP_LOADC   = 0x1  /* LOADC */
     OP_MOVE    = 0x2  /* MOVE */
     OP_LOADM   = 0x3  /* LOADM */
@@ -47,6 +55,39 @@ const (
     OP_EQ      = 0xB  /* EQ */
     OP_LT      = 0xC  /* LT */
     OP_LE      = 0xD  /* LE */
-    OP_DBG     = 0xE  /* DBG */
+    OP_EXT     = 0xE  /* DBG, PUSH, POP, RET */
+    OP_TRAP    = 0xF  /* TRAP */
+)
+
+// Condition bits of the BR instruction. They match the condition flags the
+// machine keeps in its R_COND register.
+const (
+    BR_P = 1 << 0 /* Positive */
+    BR_Z = 1 << 1 /* Zero */
+    BR_N = 1 << 2 /* Negative */
+    BR_C = 1 << 3 /* Carry */
+    BR_V = 1 << 4 /* Overflow */
 )
 
+// Vectors of the standard traps
+const (
+    TRAP_GETC = 0x20 /* Read a character into R0 */
+    TRAP_PUTC = 0x21 /* Write the character in R0 */
+    TRAP_PUTS = 0x22 /* Write the zero terminated string at data offset R0 */
+    TRAP_PUTI = 0x23 /* Write R0 as a decimal number */
+    TRAP_PUTX = 0x24 /* Write R0 as a hexadecimal number */
+    TRAP_HALT = 0x25 /* Halt with the exit code in R0 */
+    TRAP_GETI = 0x26 /* Read a decimal number into R0 */
+)
+
+// Offset into the read/write memory where the standard devices are mapped, the
+// part of the memory before it is free for the program
+const DEVICE_OFFSET = 0x1F0
+
+// Instructions sharing the OP_EXT opcode, selected by bits 11-9
+const (
+    EXT_DBG    = 0x0  /* Print the registers */
+    EXT_PUSH   = 0x1  /* Push a register onto the stack */
+    EXT_POP    = 0x2  /* Pop the top of the stack into a register */
+    EXT_RET    = 0x3  /* Return from a subroutine */
+)
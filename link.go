@@ -0,0 +1,66 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "vm/linker"
+  "vm/rom"
+)
+
+/**
+ * LINK
+ * =============================================================================
+ *
+ * Links object files into a ROM. Modules given as assembly are assembled into
+ * objects first. The program starts at the code of the first module.
+ */
+func link_command(args []string) int {
+  flags := flag.NewFlagSet("link", flag.ExitOnError)
+  output := flags.String("o", "a.rom", "ROM file to write")
+  strip := flags.Bool("strip", false, "leave out the symbol table")
+  flags.Parse(args)
+
+  if flags.NArg() < 1 {
+    fmt.Println("vm link [-o prog.rom] [-strip] main.o|main.asm [module.o|module.asm ...]")
+    return EXIT_USAGE
+  }
+
+  modules := []linker.Module{}
+  for _, path := range flags.Args() {
+    obj, err := load_object(path)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      return EXIT_ERROR
+    }
+    modules = append(modules, linker.Module{Name: path, Object: obj})
+  }
+
+  img, err := linker.Link(modules)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  if *strip {
+    img.Symbols = nil
+  }
+
+  file, err := os.Create(*output)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  if err := rom.Write(file, img); err != nil {
+    file.Close()
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+  if err := file.Close(); err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  return 0
+}
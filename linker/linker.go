@@ -0,0 +1,187 @@
+package linker
+
+import (
+  "fmt"
+  "strings"
+  "vm/instructions"
+  "vm/object"
+  "vm/rom"
+)
+
+/**
+ * LINKER
+ * =============================================================================
+ *
+ * Merges separately assembled modules into a single program. The constant
+ * pools of all modules are placed one after the other, followed by their code
+ * in the same order:
+ *
+ *   0:  start of the program
+ *   1:  constant pool of module 1, then module 2, ...
+ *   n:  code of module 1, then module 2, ...
+ *
+ * The program starts at the code of the first module. LOADC instructions are
+ * moved along with the constant pool of their module, jumps and branches to
+ * imported labels get the distance to the module exporting the label.
+ *
+ * Every label must be exported by exactly one module. The linker reports all
+ * duplicate and unresolved labels it finds, not just the first.
+ */
+type Module struct {
+  // Used in error messages, usually the file the object was read from
+  Name string
+  Object *object.Object
+}
+
+// A problem found while linking, in the given module
+type Error struct {
+  Module string
+  Message string
+}
+
+func (e Error) Error() string {
+  return fmt.Sprintf("%s: %s", e.Module, e.Message)
+}
+
+type Errors []Error
+
+func (l Errors) Error() string {
+  lines := make([]string, len(l))
+  for i, e := range l {
+    lines[i] = e.Error()
+  }
+  return strings.Join(lines, "\n")
+}
+
+// Links the modules into a program image. The error is an Errors list if any
+// symbol could not be resolved or a relocation does not fit.
+func Link(modules []Module) (*rom.Image, error) {
+  if len(modules) == 0 {
+    return nil, fmt.Errorf("nothing to link")
+  }
+
+  var errs Errors
+  report := func(module string, format string, args ...interface{}) {
+    errs = append(errs, Error{module, fmt.Sprintf(format, args...)})
+  }
+
+  // Where the constant pool and code of every module end up
+  const_base := make([]int, len(modules))
+  code_base := make([]int, len(modules))
+
+  address := 1
+  for i, m := range modules {
+    const_base[i] = address - 1
+    address += len(m.Object.Constants)
+  }
+  for i, m := range modules {
+    code_base[i] = address
+    address += len(m.Object.Code)
+  }
+  if address > 0x10000 {
+    return nil, fmt.Errorf("program does not fit into memory (%d words)", address)
+  }
+
+  exported := map[string]int{}
+  exporter := map[string]string{}
+
+  for i, m := range modules {
+    for _, sym := range m.Object.Exports {
+      if other, ok := exporter[sym.Name]; ok {
+        report(m.Name, "%q is already exported by %s", sym.Name, other)
+        continue
+      }
+      exported[sym.Name] = code_base[i] + int(sym.Offset)
+      exporter[sym.Name] = m.Name
+    }
+  }
+
+  for _, m := range modules {
+    for _, name := range m.Object.Imports {
+      if _, ok := exported[name]; !ok {
+        report(m.Name, "undefined symbol %q, no module exports it", name)
+      }
+    }
+  }
+
+  img := &rom.Image{Entry: uint16(code_base[0])}
+  labels := map[string]uint16{}
+
+  for i, m := range modules {
+    img.Constants = append(img.Constants, m.Object.Constants...)
+
+    code := append([]uint16{}, m.Object.Code...)
+
+    for _, r := range m.Object.Relocations {
+      if int(r.Offset) >= len(code) {
+        report(m.Name, "relocation at offset %d is past the end of the code", r.Offset)
+        continue
+      }
+
+      word := code[r.Offset]
+      at := code_base[i] + int(r.Offset)
+
+      if r.Kind == object.RELOC_CONST {
+        index := int(word & 0x1FF) + const_base[i]
+        if index > 0x1FF {
+          report(m.Name, "constant %d at 0x%04X is past the 512 slots LOADC can reach", index, at)
+          continue
+        }
+        code[r.Offset] = word &^ 0x1FF | uint16(index)
+        continue
+      }
+
+      // Unresolved imports are reported above
+      target, ok := exported[r.Symbol]
+      if !ok {
+        continue
+      }
+
+      offset := target - (at + 1)
+
+      switch r.Kind {
+        case object.RELOC_JUMP:
+          if offset < -0x3FF || offset > 0x3FF {
+            report(m.Name, "%q is %d words away from the jump at 0x%04X, the limit is %d to %d", r.Symbol, offset, at, -0x3FF, 0x3FF)
+            continue
+          }
+          word &= instructions.OP_JUMP << 12 | 1 << 10
+          if offset < 0 {
+            word |= 1 << 11 | uint16(-offset)
+          } else {
+            word |= uint16(offset)
+          }
+
+        case object.RELOC_BRANCH:
+          if offset < -64 || offset > 63 {
+            report(m.Name, "%q is %d words away from the branch at 0x%04X, the limit is -64 to 63", r.Symbol, offset, at)
+            continue
+          }
+          word = word &^ 0x7F | uint16(offset) & 0x7F
+
+        default:
+          report(m.Name, "unknown relocation kind %d", r.Kind)
+          continue
+      }
+
+      code[r.Offset] = word
+    }
+
+    img.Code = append(img.Code, code...)
+
+    for _, sym := range m.Object.Labels {
+      labels[sym.Name] = uint16(code_base[i] + int(sym.Offset))
+    }
+  }
+
+  // Exported labels win over local labels of the same name
+  for name, address := range exported {
+    labels[name] = uint16(address)
+  }
+  img.Symbols = rom.SymbolTable(labels)
+
+  if len(errs) > 0 {
+    return nil, errs
+  }
+  return img, nil
+}
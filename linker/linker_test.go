@@ -0,0 +1,165 @@
+package linker
+
+import (
+  "context"
+  "errors"
+  "strings"
+  "testing"
+  "vm/assembler"
+  "vm/object"
+  "vm/vm"
+)
+
+// Assembles every source into a module named after its key
+func modules(t *testing.T, names []string, sources map[string]string) []Module {
+  t.Helper()
+
+  list := []Module{}
+  for _, name := range names {
+    obj, err := assembler.AssembleObject(name, sources[name])
+    if err != nil {
+      t.Fatalf("assembling %s failed:\n%v", name, err)
+    }
+    list = append(list, Module{Name: name, Object: obj})
+  }
+  return list
+}
+
+const main_module = `
+CONST 6
+.import square
+.import zero
+.export main
+START
+main:
+  LOADC r0 0
+  CALL square
+  MOVE r0 r1
+  SUB r0 r0 r0
+  BRz zero
+  HALT
+`
+
+const math_module = `
+CONST 100
+.export square
+.export zero
+START
+square:
+  MUL r0 r0 r0
+  RET
+zero:
+  LOADC r2 0
+  HALT
+`
+
+func TestLink(t *testing.T) {
+  img, err := Link(modules(t, []string{"main.asm", "math.asm"}, map[string]string{
+    "main.asm": main_module,
+    "math.asm": math_module,
+  }))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // Both constant pools come before the code of the first module
+  if img.Entry != 3 || len(img.Constants) != 2 || img.Constants[1] != 100 {
+    t.Errorf("entry %d with constants %d, want 3 with 6 and 100", img.Entry, img.Constants)
+  }
+
+  m := vm.New()
+  m.Load(img.Words())
+  m.MaxSteps = 1000
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  // The CALL and the BR reached the other module, its LOADC its own constant
+  if m.Reg[vm.R_R1] != 36 || m.Reg[vm.R_R2] != 100 {
+    t.Errorf("r1 = %d and r2 = %d, want 36 and 100", m.Reg[vm.R_R1], m.Reg[vm.R_R2])
+  }
+
+  symbols := map[string]uint16{}
+  for _, sym := range img.Symbols {
+    symbols[sym.Name] = sym.Address
+  }
+  if symbols["main"] != 3 || symbols["square"] != 9 || symbols["zero"] != 11 {
+    t.Errorf("got symbols %v", img.Symbols)
+  }
+}
+
+var link_error_tests = []struct {
+  name string
+  sources map[string]string
+  want []string
+}{
+  {
+    "duplicate export",
+    map[string]string{
+      "a.asm": ".export f\nSTART\nf: RET",
+      "b.asm": ".export f\nSTART\nf: HALT",
+    },
+    []string{`b.asm: "f" is already exported by a.asm`},
+  },
+  {
+    "unresolved imports are all reported",
+    map[string]string{
+      "a.asm": ".import f\n.import g\nSTART\nCALL f\nCALL g",
+      "b.asm": "START\nHALT",
+    },
+    []string{
+      `a.asm: undefined symbol "f", no module exports it`,
+      `a.asm: undefined symbol "g", no module exports it`,
+    },
+  },
+  {
+    "branch too far",
+    map[string]string{
+      "a.asm": ".import far\nSTART\nBR far",
+      "b.asm": ".export far\nSTART\n" + strings.Repeat("HALT\n", 64) + "far: HALT",
+    },
+    []string{`a.asm: "far" is 64 words away from the branch at 0x0001, the limit is -64 to 63`},
+  },
+  {
+    "constant out of reach",
+    map[string]string{
+      "a.asm": strings.Repeat("CONST 1\n", 300) + "START\nHALT",
+      "b.asm": strings.Repeat("CONST 2\n", 300) + "START\nLOADC r0 299",
+    },
+    []string{"b.asm: constant 599 at 0x025A is past the 512 slots LOADC can reach"},
+  },
+}
+
+func TestLinkErrors(t *testing.T) {
+  for _, test := range link_error_tests {
+    _, err := Link(modules(t, []string{"a.asm", "b.asm"}, test.sources))
+
+    var errs Errors
+    if !errors.As(err, &errs) {
+      t.Errorf("%s: got %v, want link errors", test.name, err)
+      continue
+    }
+
+    got := strings.Split(errs.Error(), "\n")
+    if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+      t.Errorf("%s: got\n%v\nwant\n%v", test.name, errs, strings.Join(test.want, "\n"))
+    }
+  }
+}
+
+func TestLinkNothing(t *testing.T) {
+  if _, err := Link(nil); err == nil {
+    t.Errorf("linking no modules succeeded")
+  }
+}
+
+func TestRelocationPastTheCode(t *testing.T) {
+  obj := &object.Object{
+    Code: []uint16{0x0000},
+    Relocations: []object.Relocation{{Kind: object.RELOC_CONST, Offset: 4}},
+  }
+
+  if _, err := Link([]Module{{"a.obj", obj}}); err == nil {
+    t.Errorf("relocation past the end of the code was applied")
+  }
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "os"
+  "vm/assembler"
+  "vm/compiler"
+)
+
+/**
+ * LISP
+ * =============================================================================
+ *
+ * Compiles a Lisp program and runs it right away. With -S the assembly is
+ * printed instead.
+ */
+func lisp_command(args []string) int {
+  flags := flag.NewFlagSet("lisp", flag.ExitOnError)
+  assembly := flags.Bool("S", false, "print the assembly instead of running the program")
+  max_steps := flags.Uint64("max-steps", 0, "stop after this many instructions, 0 for no limit")
+  optimize := flags.Bool("opt", false, "run the peephole optimizer over the generated assembly")
+  flags.Parse(args)
+
+  if flags.NArg() != 1 {
+    fmt.Println("vm lisp [-S] [--opt] [--max-steps=n] prog.lisp")
+    return EXIT_USAGE
+  }
+
+  source_file := flags.Arg(0)
+
+  source, err := os.ReadFile(source_file)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  code, err := compiler.CompileLisp(source_file, string(source))
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  if *assembly {
+    fmt.Print(code)
+    return 0
+  }
+
+  // Diagnostics of the generated assembly point into it, not into the source
+  asm_file := source_file + ".asm"
+
+  var program *assembler.Program
+  if *optimize {
+    program, _, err = assembler.AssembleOptimized(asm_file, code)
+  } else {
+    program, err = assembler.AssembleProgram(asm_file, code)
+  }
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    if program == nil {
+      return EXIT_ERROR
+    }
+  }
+
+  img := program_image(program)
+
+  machine, err := boot(img)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+  machine.MaxSteps = *max_steps
+
+  if err := machine.Run(context.Background()); err != nil {
+    crash_report(os.Stderr, err, img.Symbols)
+    return exit_code(err)
+  }
+
+  return program_exit_code(machine.ExitCode)
+}
@@ -1,518 +1,197 @@
 package main
 
 import (
+  "bufio"
+  "bytes"
   "fmt"
   "os"
-  "vm/instructions"
   "vm/assembler"
+  "vm/devices"
+  "vm/object"
+  "vm/rom"
+  "vm/vm"
 )
 
-const MEMORY_MAX = (1 << 16)
-const INSTRUCTION_SIZE = 16
-const OPCODE_SIZE = 4
-const PARAMETER_SIZE = 12
-const CONSTANT_POOL_OFFSET = 1
-
 /**
- * MEMORY
+ * MAIN
  * =============================================================================
  *
- * The virutal machine has 65536 (2^16) memory locations, each of which can
- * hold a 16-bit value.
+ * The command line interface is a thin wrapper around the vm package. Every
+ * subcommand lives in its own file and returns the exit code of the process,
+ * so deferred cleanup runs before exiting.
  *
- * This means we have a total memory of 128kB
+ *   vm asm [-o prog.rom] prog.asm   Assembles a program into a ROM
+ *   vm asm -c module.asm            Assembles a module into an object file
+ *   vm link -o prog.rom a.o b.o     Links object files into a ROM
+ *   vm compile prog.vl              Compiles the expression language to assembly
+ *   vm lisp prog.lisp               Compiles and runs a Lisp program
+ *   vm run prog.rom                 Runs a ROM or an assembly program
+ *   vm debug prog.asm               Runs a program in the debugger
+ *   vm trace-diff a.jsonl b.jsonl   Finds where two execution traces diverge
+ *   vm prog.asm                     Same as vm run
  */
-var memory [MEMORY_MAX]uint16
-
-// Writes to the literal memory at the given address
-func lit_mem_write(address uint16, value uint16) {
-    memory[address] = value
-}
+const USAGE = `usage:
+  vm asm [-o prog.rom] [--opt] [--opt-report] prog.asm
+  vm asm -c [-o module.o] module.asm
+  vm link [-o prog.rom] main.o [module.o ...]
+  vm compile [-o prog.asm] prog.vl
+  vm lisp [-S] [--opt] [--max-steps=n] prog.lisp
+  vm run [--opt] [--opt-report] [--trace=file.jsonl] [--max-steps=n] [--timeout=d] [--snapshot-on-halt=file] prog.rom|prog.asm
+  vm run --resume=file [prog.rom|prog.asm]
+  vm debug prog.rom|prog.asm
+  vm trace-diff a.jsonl b.jsonl
+  vm prog.rom|prog.asm`
 
-// Reads the literal memory at the given address
-func lit_mem_read(address uint16) uint16 {
-  return memory[address]
-}
+func main() {
 
-func map_mem_write(address uint16, value uint16) {
-  memory[reg[R_MAR]] = value
-}
+  if len(os.Args) < 2 {
+    fmt.Println(USAGE)
+    os.Exit(EXIT_USAGE)
+  }
 
-func map_mem_read(address uint16) uint16 {
-  return memory[reg[R_MAR] + address]
+  switch os.Args[1] {
+    case "asm":
+      os.Exit(asm_command(os.Args[2:]))
+    case "link":
+      os.Exit(link_command(os.Args[2:]))
+    case "compile":
+      os.Exit(compile_command(os.Args[2:]))
+    case "lisp":
+      os.Exit(lisp_command(os.Args[2:]))
+    case "run":
+      os.Exit(run_command(os.Args[2:]))
+    case "debug":
+      os.Exit(debug_command(os.Args[2:]))
+    case "trace-diff":
+      os.Exit(trace_diff_command(os.Args[2:]))
+    case "help", "-h", "--help":
+      fmt.Println(USAGE)
+    default:
+      os.Exit(run_command(os.Args[1:]))
+  }
 }
 
+// How programs are assembled when they are loaded from source
+type asm_options struct {
+  optimize bool
 
-/**
- * MEMORY LAYOUT
- * =============================================================================
- *
- * The first block is reversed to hold the memory adress where the program
- * starts.
- *
- * The blocks between the first block and the program start are the constant
- * pool. Any constant values used by the program can be stored here. The
- * constant pool is readonly. Constant slots are limited to 512.
- *
- * The rest of the memory is used for the program itself.
-
- * The memory block after the program's instructions can be used to as a read
- * and write memory. They are mapped by an internal helper so they can be
- * accessed starting at adress 0. The size of the mapped memory is limited to
- * 512 slots.
- *
- * 0: 0x0006 - The program starts at memory adress 6
- * 1: 0x0001 - Setting constant zero to 1
- * 2: 0x0002 - Setting constant one to 2
- * 3: 0x0003 - Setting constant two to 3
- * 4: 0x0004 - Setting constant three to 4
- * 5: 0x0005 - Setting constant four to 5
- * 6: 0x1000 - Program starts here, Loading constant zero into R0
- * 7: 0x0000 - Program ends here, HALT instruction
- * 8: 0x0000 - Read/Write memory starts here
- * ...
- */
-
-/**
- * CONSTANT POOL
- * =============================================================================
- * 
- * The constant pool is the area of memory before the program that holds
- * constants that can be loaded using the LOADC instruction.
- *
- */
-func const_read(adress uint16) uint16 {
-  return memory[adress + CONSTANT_POOL_OFFSET]
+  // Print the optimizations applied to stderr
+  report bool
 }
 
-/**
- * REGISTERS
- * =============================================================================
- *
- * The virtual machine has 10 total registers. 
- * 8 of them are general purpose registers (R0-R7)
- *
- * Each register is 16 bits wide.
- */
-const (
-  R_R0 = 0x00
-  R_R1 = 0x01
-  R_R2 = 0x02
-  R_R3 = 0x03
-  R_R4 = 0x04
-  R_R5 = 0x05
-  R_R6 = 0x06
-  R_R7 = 0x07
-  R_PC = 0x08   /* program counter */
-  R_COND = 0x09 /* condition flags */
-  R_MAR = 0x0A  /* memory address register */
-  R_COUNT = 0x0B
-)
+// Loads a program from a ROM or, if the file is not a ROM, by assembling it.
+// Assembler diagnostics are printed to stderr.
+func load_image(prog_file string, options asm_options) (*rom.Image, error) {
+  data, err := os.ReadFile(prog_file)
+  if err != nil {
+    return nil, err
+  }
 
-var reg [R_COUNT]uint16
+  if rom.IsROM(data) {
+    return rom.Read(bytes.NewReader(data))
+  }
 
-/**
- * CONDITION FLAGS
- * =============================================================================
- *
- * The R_COND register stores condition flags. These hold information about the
- * most recent calculation. This allows programs to check for logical
- * conditions.
- */
-const (
-    FL_POS = 1 << 0 /* Positive */
-    FL_ZRO = 1 << 1 /* Zero */
-    FL_NEG = 1 << 2 /* Negative */
-)
+  var program *assembler.Program
+  var report []assembler.Optimization
 
-/**
- * UTILITY FUNCTIONS
- * =============================================================================
- */
-func sign_extend(x uint16, bit_count int) uint16 {
-  if (x >> (bit_count - 1)) & 1 == 1 {
-    x |= (0xFFFF << bit_count)
+  if options.optimize || options.report {
+    program, report, err = assembler.AssembleOptimized(prog_file, string(data))
+  } else {
+    program, err = assembler.AssembleProgram(prog_file, string(data))
   }
-  return x
-}
 
-func update_flags(r uint16) {
-  if (reg[r] == 0) {
-    reg[R_COND] = FL_ZRO
-  } else if (reg[r] >> 15) == 1 {
-    reg[R_COND] = FL_NEG
-  } else {
-    reg[R_COND] = FL_POS
+  if diags, ok := err.(assembler.Diagnostics); ok {
+    fmt.Fprintln(os.Stderr, diags)
+    if diags.HasErrors() {
+      return nil, fmt.Errorf("%s failed to assemble", prog_file)
+    }
+  }
+
+  if options.report {
+    for _, o := range report {
+      fmt.Fprintln(os.Stderr, o)
+    }
+    fmt.Fprintf(os.Stderr, "%d optimizations applied\n", len(report))
   }
+
+  return program_image(program), nil
 }
 
-func load_into_memory(program []uint16) {
-  // Load the program into memory
-  for i, instruction := range program {
-    memory[uint16(i)] = instruction
+// Turns an assembled program into a ROM image with its symbols
+func program_image(program *assembler.Program) *rom.Image {
+  return &rom.Image{
+    Entry: program.Entry,
+    Constants: program.Constants,
+    Code: program.Code,
+    Data: program.Data,
+    Symbols: rom.SymbolTable(program.Symbols),
   }
 }
 
-/**
- * MAIN LOOP
- * =============================================================================
- */
-func main() {
+// Creates a machine with the standard devices and loads the image into it
+func boot(img *rom.Image) (*vm.Machine, error) {
+  machine := vm.New()
+  machine.LoadData(img.Words(), img.Data)
 
-  if len(os.Args) < 2 {
-    fmt.Println("vm [program file]")
-    os.Exit(2)
+  if err := devices.MapStandard(machine); err != nil {
+    return nil, err
   }
+  return machine, nil
+}
 
-  prog_file := os.Args[1]
-  fmt.Println("Loading program from", prog_file)
-
-  data, err := os.ReadFile(prog_file)
+// Creates a machine with the standard devices in the state of a snapshot
+func resume(snapshot_file string) (*vm.Machine, error) {
+  file, err := os.Open(snapshot_file)
   if err != nil {
-    fmt.Println("Error reading file", err)
-    os.Exit(1)
+    return nil, err
   }
+  defer file.Close()
 
-  load_into_memory(assembler.Assemble(string(data)))
-
-  reg[R_COND] = FL_ZRO
-  reg[R_PC] = memory[0x0000]
-  reg[R_MAR] = 0x1007 // TODO: This should be set by the VM after loading a ROM
-
-  var running bool = true
-
-  for running {
-    var instr uint16 = lit_mem_read(reg[R_PC])
-
-    var op uint16 = instr >> PARAMETER_SIZE
-    reg[R_PC]++
-
-    switch op {
-      case instructions.OP_HALT:
-        running = false
-        break;
-
-      case instructions.OP_LOADC:
-
-        // PUSH INSTRUCTION
-        // 
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |     OP_LOADC      |     REG     |               CONST9              |
-        // -----------------------------------------------------------------------
-
-        r1 := (instr >> 9) & 0x7
-        c_offset := sign_extend(instr & 0x1FF, 9)
-
-        reg[r1] = const_read(c_offset)
-        break
-
-      case instructions.OP_MOVE:
-
-        // MOVE INSTRUCTION
-        //
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |     OP_MOVE       |     REG     |    REG    |                       |
-        // -----------------------------------------------------------------------
-
-        r1 := (instr >> 9) & 0x7
-        r2 := (instr >> 6) & 0x7
-
-        reg[r2] = reg[r1]
-        break
-
-      case instructions.OP_LOADM:
-
-        // LOADM INSTRUCTION
-        // 
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |     OP_LOADC      |     REG     |               CONST9              |
-        // -----------------------------------------------------------------------
-
-        r1 := (instr >> 9) & 0x7
-        m_offset := sign_extend(instr & 0x1FF, 9)
-
-        reg[r1] = map_mem_read(m_offset)
-        break
-
-      case instructions.OP_STOREM:
-
-        // STOREM INSTRUCTION
-        // 
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |     OP_LOADC      |     REG     |               CONST9              |
-        // -----------------------------------------------------------------------
-
-
-        r1 := (instr >> 9) & 0x7
-        m_offset := sign_extend(instr & 0x1FF, 9)
-
-        map_mem_write(m_offset, reg[r1])
-        break
-
-      case instructions.OP_JUMP:
-
-        // JUMP INSTRUCTION
-        //
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |     OP_JUMP       | si |                   OFFSET                   |
-        // -----------------------------------------------------------------------
-
-        si := (instr >> 11) & 0x1
-        offset := instr & 0x3FF
-
-        if si == 0 {
-          reg[R_PC] = reg[R_PC] + offset
-        } else {
-          reg[R_PC] = reg[R_PC] - offset
-        }
-
-        break
-
-      case instructions.OP_ADD:
-
-        // ADD INSTRUCTION
-        //
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 0 |    REG    |       |    REG    |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 1 |    REG    |        IMM5       |
-        // -----------------------------------------------------------------------
-
-        dr := (instr >> 9) & 0x7
-        r1 := (instr >> 5) & 0x7
-        imm_flag := (instr >> 8) & 0x1
-
-        if imm_flag == 1 {
-          imm5 := sign_extend(instr & 0x1F, 5)
-          reg[dr] = reg[r1] + imm5
-        } else {
-          r2 := instr & 0x7
-          reg[dr] = reg[r1] + reg[r2]
-        }
-        break
-
-      case instructions.OP_SUB:
-
-        // SUB INSTRUCTION
-        //
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 0 |    REG    |       |    REG    |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 1 |    REG    |        IMM5       |
-        // -----------------------------------------------------------------------
-
-        dr := (instr >> 9) & 0x7
-        r1 := (instr >> 5) & 0x7
-        imm_flag := (instr >> 8) & 0x1
-
-        if imm_flag == 1 {
-          imm5 := sign_extend(instr & 0x1F, 5)
-          reg[dr] = reg[r1] - imm5
-        } else {
-          r2 := instr & 0x7
-          reg[dr] = reg[r1] - reg[r2]
-        }
-
-        break
-
-      case instructions.OP_MUL:
-
-        // MUL INSTRUCTION
-        //
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 0 |    REG    |       |    REG    |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 1 |    REG    |        IMM5       |
-        // -----------------------------------------------------------------------
-
-        dr := (instr >> 9) & 0x7
-        r1 := (instr >> 5) & 0x7
-        imm_flag := (instr >> 8) & 0x1
-
-        if imm_flag == 1 {
-          imm5 := sign_extend(instr & 0x1F, 5)
-          reg[dr] = reg[r1] * imm5
-        } else {
-          r2 := instr & 0x7
-          reg[dr] = reg[r1] * reg[r2]
-        }
-        break
-
-      case instructions.OP_DIV:
-
-        // DIV INSTRUCTION
-        //
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 0 |    REG    |       |    REG    |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 1 |    REG    |        IMM5       |
-        // -----------------------------------------------------------------------
-
-        dr := (instr >> 9) & 0x7
-        r1 := (instr >> 5) & 0x7
-        imm_flag := (instr >> 8) & 0x1
-
-        if imm_flag == 1 {
-          imm5 := sign_extend(instr & 0x1F, 5)
-          reg[dr] = reg[r1] / imm5
-        } else {
-          r2 := instr & 0x7
-          reg[dr] = reg[r1] / reg[r2]
-        }
-        break
-
-      case instructions.OP_NOT:
-
-        // NOT INSTRUCTION
-        //
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |      OP_NOT       |     REG     |    REG    |                       |
-        // -----------------------------------------------------------------------
-
-        dr := (instr >> 9) & 0x7
-        sr := (instr >> 6) & 0x7
-
-        reg[dr] = ^reg[sr]
-
-        break
-
-      case instructions.OP_EQ:
-
-        // EQ INSTRUCTION
-        //
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 0 |                   |    REG    |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 1 |             IMM8              |
-        // -----------------------------------------------------------------------
-
-        r1 := (instr >> 9) & 0x7
-        imm_flag := (instr >> 8) & 0x1
-
-        var is_eq bool
-
-        if imm_flag == 1 {
-          imm8 := sign_extend(instr & 0xFF, 8)
-          is_eq = reg[r1] == imm8
-        } else {
-          r2 := instr & 0x7
-          is_eq = reg[r1] == reg[r2]
-        }
-
-        if !is_eq {
-          reg[R_PC]++
-        }
-
-        break
-
-      case instructions.OP_LT:
-
-        // LT INSTRUCTION
-        //
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 0 |                   |    REG    |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 1 |             IMM8              |
-        // -----------------------------------------------------------------------
-
-        r1 := (instr >> 9) & 0x7
-        imm_flag := (instr >> 8) & 0x1
-
-        var is_eq bool
-
-        if imm_flag == 1 {
-          imm8 := sign_extend(instr & 0xFF, 8)
-          is_eq = reg[r1] < imm8
-        } else {
-          r2 := instr & 0x7
-          is_eq = reg[r1] < reg[r2]
-        }
-
-        if !is_eq {
-          reg[R_PC]++
-        }
-
-        break
-
-      case instructions.OP_LE:
-
-        // LE INSTRUCTION
-        //
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 0 |                   |    REG    |
-        // -----------------------------------------------------------------------
-        // |      OP_ADD       |     REG     | 1 |             IMM8              |
-        // -----------------------------------------------------------------------
-
-        r1 := (instr >> 9) & 0x7
-        imm_flag := (instr >> 8) & 0x1
-
-        var is_eq bool
+  snapshot, err := vm.ReadSnapshot(bufio.NewReader(file))
+  if err != nil {
+    return nil, err
+  }
 
-        if imm_flag == 1 {
-          imm8 := sign_extend(instr & 0xFF, 8)
-          is_eq = reg[r1] < imm8
-        } else {
-          r2 := instr & 0x7
-          is_eq = reg[r1] < reg[r2]
-        }
+  machine := vm.New()
+  machine.Restore(snapshot)
 
-        if !is_eq {
-          reg[R_PC]++
-        }
+  if err := devices.MapStandard(machine); err != nil {
+    return nil, err
+  }
+  return machine, nil
+}
 
-        break
+func write_snapshot(snapshot_file string, machine *vm.Machine) error {
+  file, err := os.Create(snapshot_file)
+  if err != nil {
+    return err
+  }
 
-      case instructions.OP_DBG:
+  if err := vm.WriteSnapshot(file, machine.Snapshot()); err != nil {
+    file.Close()
+    return err
+  }
+  return file.Close()
+}
 
-        // DBG INSTRUCTION
-        // 
-        // Prints the current value of general purpose registers to stdout
-        //
-        // -----------------------------------------------------------------------
-        // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
-        // -----------------------------------------------------------------------
-        // |      OP_DBG       |                                                 |
-        // -----------------------------------------------------------------------
+// Loads a module from an object file or, if the file is not one, by
+// assembling it. Assembler diagnostics are printed to stderr.
+func load_object(module_file string) (*object.Object, error) {
+  data, err := os.ReadFile(module_file)
+  if err != nil {
+    return nil, err
+  }
 
-        fmt.Printf("PC\tR0\tR1\tR2\tR3\tR4\tR5\tR6\tR7\n")
-        fmt.Println("--------------------------------------------------------------------")
-        fmt.Printf("%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", reg[R_PC], reg[0], reg[1], reg[2], reg[3], reg[4], reg[5], reg[6], reg[7])
-        fmt.Println("--------------------------------------------------------------------")
-        fmt.Println("")
-        break;
+  if object.IsObject(data) {
+    return object.Read(bytes.NewReader(data))
+  }
 
-      default:
-        fmt.Printf("Unknown instruction: %x\n", op)
-        running = false
-        os.Exit(1)
-        break
+  obj, err := assembler.AssembleObject(module_file, string(data))
+  if diags, ok := err.(assembler.Diagnostics); ok {
+    fmt.Fprintln(os.Stderr, diags)
+    if diags.HasErrors() {
+      return nil, fmt.Errorf("%s failed to assemble", module_file)
     }
   }
+  return obj, nil
 }
@@ -0,0 +1,277 @@
+package object
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "hash/crc32"
+  "io"
+)
+
+/**
+ * OBJECT FILES
+ * =============================================================================
+ *
+ * An object file is a separately assembled module waiting to be linked. Its
+ * constant pool and code are not at their final place yet, so:
+ *
+ *  - LOADC instructions refer to the module's own constant pool and get the
+ *    position of that pool added when linking
+ *  - jumps and branches to labels of other modules are left at offset 0 and
+ *    get the distance to the label filled in
+ *
+ * Every such place is recorded as a relocation. Code labels are kept relative
+ * to the start of the module's code.
+ *
+ * All numbers are stored big-endian, strings as their length in a single byte
+ * followed by the bytes.
+ *
+ * ---------------------------------------------------------------------------
+ * | magic "SVMO" | version | consts | code | exports | imports | relocs     |
+ * | labels                                                                  |
+ * ---------------------------------------------------------------------------
+ * | constant pool (consts words)                                            |
+ * | code (code words)                                                       |
+ * | exports: name, offset                                                   |
+ * | imports: name                                                           |
+ * | relocations: kind (byte), offset, import index                          |
+ * | labels: name, offset                                                    |
+ * | CRC-32 of everything above                                              |
+ * ---------------------------------------------------------------------------
+ */
+const MAGIC = "SVMO"
+const VERSION = 1
+
+type RelocationKind uint8
+
+const (
+  RELOC_CONST RelocationKind = iota /* LOADC constant index, 9 bits */
+  RELOC_JUMP                        /* JUMP or CALL offset, sign and 10 bits */
+  RELOC_BRANCH                      /* BR offset, 7 bits two's complement */
+)
+
+type Symbol struct {
+  Name string
+
+  // Relative to the start of the module's code
+  Offset uint16
+}
+
+type Relocation struct {
+  Kind RelocationKind
+
+  // Position of the word in the module's code
+  Offset uint16
+
+  // Imported symbol a jump or branch refers to, empty for RELOC_CONST
+  Symbol string
+}
+
+type Object struct {
+  Constants []uint16
+  Code []uint16
+
+  // Labels other modules can refer to
+  Exports []Symbol
+
+  // Labels of other modules this module refers to
+  Imports []string
+
+  Relocations []Relocation
+
+  // Every code label of the module, for the symbol table of the program
+  Labels []Symbol
+}
+
+// Reports whether the data starts like an object file
+func IsObject(data []byte) bool {
+  return bytes.HasPrefix(data, []byte(MAGIC))
+}
+
+// Writes the object in the object file format
+func Write(w io.Writer, obj *Object) error {
+  var buf bytes.Buffer
+  buf.WriteString(MAGIC)
+
+  header := []uint16{
+    VERSION,
+    uint16(len(obj.Constants)),
+    uint16(len(obj.Code)),
+    uint16(len(obj.Exports)),
+    uint16(len(obj.Imports)),
+    uint16(len(obj.Relocations)),
+    uint16(len(obj.Labels)),
+  }
+
+  binary.Write(&buf, binary.BigEndian, header)
+  binary.Write(&buf, binary.BigEndian, obj.Constants)
+  binary.Write(&buf, binary.BigEndian, obj.Code)
+
+  imports := map[string]uint16{}
+
+  err := write_symbols(&buf, obj.Exports)
+  for i, name := range obj.Imports {
+    imports[name] = uint16(i)
+    if err == nil {
+      err = write_string(&buf, name)
+    }
+  }
+  if err != nil {
+    return err
+  }
+
+  for _, r := range obj.Relocations {
+    index, ok := imports[r.Symbol]
+    if r.Kind != RELOC_CONST && !ok {
+      return fmt.Errorf("object: relocation refers to %q, which is not imported", r.Symbol)
+    }
+    buf.WriteByte(byte(r.Kind))
+    binary.Write(&buf, binary.BigEndian, []uint16{r.Offset, index})
+  }
+
+  if err := write_symbols(&buf, obj.Labels); err != nil {
+    return err
+  }
+
+  binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+  _, err = w.Write(buf.Bytes())
+  return err
+}
+
+func write_string(buf *bytes.Buffer, s string) error {
+  if len(s) == 0 || len(s) > 0xFF {
+    return fmt.Errorf("object: symbol name %q must be 1 to 255 bytes long", s)
+  }
+  buf.WriteByte(byte(len(s)))
+  buf.WriteString(s)
+  return nil
+}
+
+func write_symbols(buf *bytes.Buffer, symbols []Symbol) error {
+  for _, sym := range symbols {
+    if err := write_string(buf, sym.Name); err != nil {
+      return err
+    }
+    binary.Write(buf, binary.BigEndian, sym.Offset)
+  }
+  return nil
+}
+
+var ErrChecksum = errors.New("object: checksum mismatch")
+
+// Reads an object in the object file format
+func Read(r io.Reader) (*Object, error) {
+  data, err := io.ReadAll(r)
+  if err != nil {
+    return nil, err
+  }
+
+  if !IsObject(data) {
+    return nil, fmt.Errorf("object: not an object file")
+  }
+  if len(data) < len(MAGIC) + 14 + 4 {
+    return nil, io.ErrUnexpectedEOF
+  }
+
+  body, checksum := data[:len(data) - 4], data[len(data) - 4:]
+  if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(checksum) {
+    return nil, ErrChecksum
+  }
+
+  buf := bytes.NewReader(body[len(MAGIC):])
+
+  var header [7]uint16
+  if err := binary.Read(buf, binary.BigEndian, &header); err != nil {
+    return nil, err
+  }
+  if header[0] != VERSION {
+    return nil, fmt.Errorf("object: unsupported version %d", header[0])
+  }
+
+  obj := &Object{
+    Constants: make([]uint16, header[1]),
+    Code: make([]uint16, header[2]),
+  }
+
+  if err := binary.Read(buf, binary.BigEndian, obj.Constants); err != nil {
+    return nil, err
+  }
+  if err := binary.Read(buf, binary.BigEndian, obj.Code); err != nil {
+    return nil, err
+  }
+
+  if obj.Exports, err = read_symbols(buf, int(header[3])); err != nil {
+    return nil, err
+  }
+
+  for i := 0; i < int(header[4]); i++ {
+    name, err := read_string(buf)
+    if err != nil {
+      return nil, err
+    }
+    obj.Imports = append(obj.Imports, name)
+  }
+
+  for i := 0; i < int(header[5]); i++ {
+    kind, err := buf.ReadByte()
+    if err != nil {
+      return nil, io.ErrUnexpectedEOF
+    }
+
+    var fields [2]uint16
+    if err := binary.Read(buf, binary.BigEndian, &fields); err != nil {
+      return nil, err
+    }
+
+    r := Relocation{Kind: RelocationKind(kind), Offset: fields[0]}
+    if r.Kind != RELOC_CONST {
+      if int(fields[1]) >= len(obj.Imports) {
+        return nil, fmt.Errorf("object: relocation refers to import %d of %d", fields[1], len(obj.Imports))
+      }
+      r.Symbol = obj.Imports[fields[1]]
+    }
+    obj.Relocations = append(obj.Relocations, r)
+  }
+
+  if obj.Labels, err = read_symbols(buf, int(header[6])); err != nil {
+    return nil, err
+  }
+
+  if buf.Len() != 0 {
+    return nil, fmt.Errorf("object: %d unexpected bytes after the labels", buf.Len())
+  }
+
+  return obj, nil
+}
+
+func read_string(buf *bytes.Reader) (string, error) {
+  length, err := buf.ReadByte()
+  if err != nil {
+    return "", io.ErrUnexpectedEOF
+  }
+
+  name := make([]byte, length)
+  if _, err := io.ReadFull(buf, name); err != nil {
+    return "", io.ErrUnexpectedEOF
+  }
+  return string(name), nil
+}
+
+func read_symbols(buf *bytes.Reader, count int) ([]Symbol, error) {
+  symbols := []Symbol{}
+  for i := 0; i < count; i++ {
+    name, err := read_string(buf)
+    if err != nil {
+      return nil, err
+    }
+
+    var offset uint16
+    if err := binary.Read(buf, binary.BigEndian, &offset); err != nil {
+      return nil, err
+    }
+    symbols = append(symbols, Symbol{Name: name, Offset: offset})
+  }
+  return symbols, nil
+}
@@ -0,0 +1,134 @@
+package object
+
+import (
+  "bytes"
+  "encoding/binary"
+  "hash/crc32"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+var sample_object = &Object{
+  Constants: []uint16{5, 6},
+  Code: []uint16{0x1000, 0x5400, 0x0100, 0x0000},
+  Exports: []Symbol{{"main", 0}},
+  Imports: []string{"print", "zero"},
+  Relocations: []Relocation{
+    {Kind: RELOC_CONST, Offset: 0},
+    {Kind: RELOC_JUMP, Offset: 1, Symbol: "print"},
+    {Kind: RELOC_BRANCH, Offset: 2, Symbol: "zero"},
+  },
+  Labels: []Symbol{{"main", 0}, {"done", 3}},
+}
+
+func write(t *testing.T, obj *Object) []byte {
+  t.Helper()
+
+  var buf bytes.Buffer
+  if err := Write(&buf, obj); err != nil {
+    t.Fatal(err)
+  }
+  return buf.Bytes()
+}
+
+// Replaces the checksum at the end of a changed object, so Read gets past it
+func reseal(data []byte) []byte {
+  body := data[:len(data) - 4]
+  return binary.BigEndian.AppendUint32(append([]byte{}, body...), crc32.ChecksumIEEE(body))
+}
+
+func TestRoundTrip(t *testing.T) {
+  objects := map[string]*Object{
+    "sample": sample_object,
+    "empty": {Constants: []uint16{}, Code: []uint16{}, Exports: []Symbol{}, Labels: []Symbol{}},
+  }
+
+  for name, obj := range objects {
+    got, err := Read(bytes.NewReader(write(t, obj)))
+    if err != nil {
+      t.Errorf("%s: %v", name, err)
+      continue
+    }
+    if !reflect.DeepEqual(got, obj) {
+      t.Errorf("%s: got %+v, want %+v", name, got, obj)
+    }
+  }
+}
+
+func TestChecksumMismatch(t *testing.T) {
+  data := write(t, sample_object)
+
+  // Flip a bit in the first code word
+  data[len(MAGIC) + 14 + 4] ^= 0x01
+
+  if _, err := Read(bytes.NewReader(data)); err != ErrChecksum {
+    t.Errorf("got %v, want %v", err, ErrChecksum)
+  }
+}
+
+var read_error_tests = []struct {
+  name string
+  change func(data []byte) []byte
+  want string
+}{
+  {
+    "not an object",
+    func(data []byte) []byte { return []byte("SVMR") },
+    "object: not an object file",
+  },
+  {
+    "unknown version",
+    func(data []byte) []byte {
+      data[len(MAGIC) + 1] = 2
+      return reseal(data)
+    },
+    "object: unsupported version 2",
+  },
+  {
+    "trailing bytes",
+    func(data []byte) []byte {
+      body := append(append([]byte{}, data[:len(data) - 4]...), 0xAB)
+      return reseal(append(body, 0, 0, 0, 0))
+    },
+    "object: 1 unexpected bytes after the labels",
+  },
+  {
+    "relocation of an unknown import",
+    func(data []byte) []byte {
+      // The import index of the last relocation, right before the labels
+      labels := 1 + 4 + 2 + 1 + 4 + 2
+      binary.BigEndian.PutUint16(data[len(data) - 4 - labels - 2:], 7)
+      return reseal(data)
+    },
+    "object: relocation refers to import 7 of 2",
+  },
+  {
+    "truncated",
+    func(data []byte) []byte { return reseal(append(data[:len(data) - 10], 0, 0, 0, 0)) },
+    "unexpected EOF",
+  },
+}
+
+func TestReadErrors(t *testing.T) {
+  for _, test := range read_error_tests {
+    data := test.change(write(t, sample_object))
+
+    _, err := Read(bytes.NewReader(data))
+    if err == nil || !strings.Contains(err.Error(), test.want) {
+      t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+    }
+  }
+}
+
+func TestWriteRejectsRelocationsOfUnknownImports(t *testing.T) {
+  obj := &Object{
+    Code: []uint16{0x5000},
+    Relocations: []Relocation{{Kind: RELOC_JUMP, Offset: 0, Symbol: "print"}},
+  }
+
+  var buf bytes.Buffer
+  if err := Write(&buf, obj); err == nil {
+    t.Errorf("relocation of a symbol that is not imported was written")
+  }
+}
@@ -0,0 +1,220 @@
+package rom
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "hash/crc32"
+  "io"
+  "sort"
+)
+
+/**
+ * ROM IMAGES
+ * =============================================================================
+ *
+ * A ROM is a prebuilt program that can be loaded without assembling it again.
+ * All numbers are stored big-endian.
+ *
+ * ---------------------------------------------------------------------------
+ * | magic "SVMR" | version | flags | entry | consts | code | data | symbols |
+ * ---------------------------------------------------------------------------
+ * | constant pool (consts words)                                            |
+ * | code (code words)                                                       |
+ * | data segment (data words)                                               |
+ * | symbol table (symbols entries, only present if flags has FLAG_SYMBOLS)  |
+ * | CRC-32 of everything above                                              |
+ * ---------------------------------------------------------------------------
+ *
+ * Every header field after the magic is a 16-bit word. A symbol table entry is
+ * the length of the name as a single byte, the name and the 16-bit address.
+ *
+ * Version 1 ROMs only recorded the size of the data segment, not its contents.
+ * They are still read, with an empty data segment.
+ */
+const MAGIC = "SVMR"
+const VERSION = 2
+
+const (
+  FLAG_SYMBOLS = 1 << 0 /* The ROM carries a symbol table */
+)
+
+type Symbol struct {
+  Name string
+  Address uint16
+}
+
+type Image struct {
+  Entry uint16
+  Constants []uint16
+  Code []uint16
+
+  // Initial contents of the read/write memory after the code
+  Data []uint16
+
+  // Optional, sorted by address
+  Symbols []Symbol
+}
+
+// Returns the memory image of the ROM: the start address, the constant pool
+// and the code
+func (img *Image) Words() []uint16 {
+  words := []uint16{img.Entry}
+  words = append(words, img.Constants...)
+  return append(words, img.Code...)
+}
+
+// Builds the sorted symbol table from a map of names to addresses
+func SymbolTable(symbols map[string]uint16) []Symbol {
+  table := make([]Symbol, 0, len(symbols))
+  for name, address := range symbols {
+    table = append(table, Symbol{Name: name, Address: address})
+  }
+
+  sort.Slice(table, func(i, j int) bool {
+    if table[i].Address != table[j].Address {
+      return table[i].Address < table[j].Address
+    }
+    return table[i].Name < table[j].Name
+  })
+
+  return table
+}
+
+// Reports whether the data starts like a ROM
+func IsROM(data []byte) bool {
+  return bytes.HasPrefix(data, []byte(MAGIC))
+}
+
+// Writes the image in the ROM format
+func Write(w io.Writer, img *Image) error {
+  if 1 + len(img.Constants) + len(img.Code) + len(img.Data) > 0x10000 {
+    return fmt.Errorf("program does not fit into memory")
+  }
+
+  var buf bytes.Buffer
+  buf.WriteString(MAGIC)
+
+  var flags uint16 = 0
+  if len(img.Symbols) > 0 {
+    flags |= FLAG_SYMBOLS
+  }
+
+  header := []uint16{
+    VERSION,
+    flags,
+    img.Entry,
+    uint16(len(img.Constants)),
+    uint16(len(img.Code)),
+    uint16(len(img.Data)),
+    uint16(len(img.Symbols)),
+  }
+
+  binary.Write(&buf, binary.BigEndian, header)
+  binary.Write(&buf, binary.BigEndian, img.Constants)
+  binary.Write(&buf, binary.BigEndian, img.Code)
+  binary.Write(&buf, binary.BigEndian, img.Data)
+
+  for _, sym := range img.Symbols {
+    if len(sym.Name) == 0 || len(sym.Name) > 0xFF {
+      return fmt.Errorf("symbol name %q must be 1 to 255 bytes long", sym.Name)
+    }
+    buf.WriteByte(byte(len(sym.Name)))
+    buf.WriteString(sym.Name)
+    binary.Write(&buf, binary.BigEndian, sym.Address)
+  }
+
+  binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+  _, err := w.Write(buf.Bytes())
+  return err
+}
+
+var ErrChecksum = errors.New("rom: checksum mismatch")
+
+// Reads an image in the ROM format
+func Read(r io.Reader) (*Image, error) {
+  data, err := io.ReadAll(r)
+  if err != nil {
+    return nil, err
+  }
+
+  if !IsROM(data) {
+    return nil, fmt.Errorf("rom: not a ROM image")
+  }
+  if len(data) < len(MAGIC) + 14 + 4 {
+    return nil, io.ErrUnexpectedEOF
+  }
+
+  body, checksum := data[:len(data) - 4], data[len(data) - 4:]
+  if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(checksum) {
+    return nil, ErrChecksum
+  }
+
+  buf := bytes.NewReader(body[len(MAGIC):])
+
+  var header [7]uint16
+  if err := binary.Read(buf, binary.BigEndian, &header); err != nil {
+    return nil, err
+  }
+
+  version, flags := header[0], header[1]
+  if version != 1 && version != VERSION {
+    return nil, fmt.Errorf("rom: unsupported version %d", version)
+  }
+
+  img := &Image{
+    Entry: header[2],
+    Constants: make([]uint16, header[3]),
+    Code: make([]uint16, header[4]),
+  }
+  if version > 1 {
+    img.Data = make([]uint16, header[5])
+  }
+
+  if err := binary.Read(buf, binary.BigEndian, img.Constants); err != nil {
+    return nil, err
+  }
+  if err := binary.Read(buf, binary.BigEndian, img.Code); err != nil {
+    return nil, err
+  }
+  if err := binary.Read(buf, binary.BigEndian, img.Data); err != nil {
+    return nil, err
+  }
+
+  if flags & FLAG_SYMBOLS != 0 {
+    for i := 0; i < int(header[6]); i++ {
+      length, err := buf.ReadByte()
+      if err != nil {
+        return nil, io.ErrUnexpectedEOF
+      }
+
+      name := make([]byte, length)
+      if _, err := io.ReadFull(buf, name); err != nil {
+        return nil, io.ErrUnexpectedEOF
+      }
+
+      var address uint16
+      if err := binary.Read(buf, binary.BigEndian, &address); err != nil {
+        return nil, err
+      }
+
+      img.Symbols = append(img.Symbols, Symbol{Name: string(name), Address: address})
+    }
+  }
+
+  if buf.Len() != 0 {
+    return nil, fmt.Errorf("rom: %d unexpected bytes after the symbol table", buf.Len())
+  }
+
+  end := 1 + len(img.Constants) + len(img.Code)
+  if int(img.Entry) < 1 || int(img.Entry) > end || end > 0x10000 {
+    return nil, fmt.Errorf("rom: entry point 0x%04X is outside the program", img.Entry)
+  }
+  if end + len(img.Data) > 0x10000 {
+    return nil, fmt.Errorf("rom: data segment does not fit into memory")
+  }
+
+  return img, nil
+}
@@ -0,0 +1,158 @@
+package rom
+
+import (
+  "bytes"
+  "encoding/binary"
+  "hash/crc32"
+  "io"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+var sample_image = &Image{
+  Entry: 3,
+  Constants: []uint16{5, 0xFFFF},
+  Code: []uint16{0x1000, 0x1201, 0x5801, 0x0000},
+  Data: []uint16{7, 0, 0x41},
+  Symbols: []Symbol{{"start", 3}, {"loop", 5}},
+}
+
+func write(t *testing.T, img *Image) []byte {
+  t.Helper()
+
+  var buf bytes.Buffer
+  if err := Write(&buf, img); err != nil {
+    t.Fatal(err)
+  }
+  return buf.Bytes()
+}
+
+// Replaces the checksum at the end of a changed ROM, so Read gets past it
+func reseal(data []byte) []byte {
+  body := data[:len(data) - 4]
+  return binary.BigEndian.AppendUint32(append([]byte{}, body...), crc32.ChecksumIEEE(body))
+}
+
+func TestRoundTrip(t *testing.T) {
+  images := map[string]*Image{
+    "with symbols": sample_image,
+    "without symbols": {Entry: 1, Constants: []uint16{}, Code: []uint16{0x0000}, Data: []uint16{}},
+  }
+
+  for name, img := range images {
+    got, err := Read(bytes.NewReader(write(t, img)))
+    if err != nil {
+      t.Errorf("%s: %v", name, err)
+      continue
+    }
+    if !reflect.DeepEqual(got, img) {
+      t.Errorf("%s: got %+v, want %+v", name, got, img)
+    }
+  }
+}
+
+func TestWords(t *testing.T) {
+  want := []uint16{3, 5, 0xFFFF, 0x1000, 0x1201, 0x5801, 0x0000}
+
+  if got := sample_image.Words(); !reflect.DeepEqual(got, want) {
+    t.Errorf("got %04X, want %04X", got, want)
+  }
+}
+
+func TestSymbolTable(t *testing.T) {
+  got := SymbolTable(map[string]uint16{"b": 4, "a": 4, "start": 1})
+  want := []Symbol{{"start", 1}, {"a", 4}, {"b", 4}}
+
+  if !reflect.DeepEqual(got, want) {
+    t.Errorf("got %v, want %v", got, want)
+  }
+}
+
+func TestReadVersion1(t *testing.T) {
+  img := &Image{Entry: 3, Constants: []uint16{5, 0xFFFF}, Code: []uint16{0x1000, 0x0000}}
+  data := write(t, img)
+
+  // Version 1 has the size of the data segment in its header but no contents
+  binary.BigEndian.PutUint16(data[len(MAGIC):], 1)
+  binary.BigEndian.PutUint16(data[len(MAGIC) + 10:], 12)
+
+  got, err := Read(bytes.NewReader(reseal(data)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !reflect.DeepEqual(got, img) {
+    t.Errorf("got %+v, want %+v", got, img)
+  }
+}
+
+func TestChecksumMismatch(t *testing.T) {
+  data := write(t, sample_image)
+
+  // Flip a bit in the first constant
+  data[len(MAGIC) + 14] ^= 0x01
+
+  if _, err := Read(bytes.NewReader(data)); err != ErrChecksum {
+    t.Errorf("got %v, want %v", err, ErrChecksum)
+  }
+}
+
+var read_error_tests = []struct {
+  name string
+  change func(data []byte) []byte
+  want string
+}{
+  {
+    "not a ROM",
+    func(data []byte) []byte { return []byte("CONST 5\nSTART\nHALT\n") },
+    "rom: not a ROM image",
+  },
+  {
+    "truncated header",
+    func(data []byte) []byte { return data[:len(MAGIC) + 6] },
+    io.ErrUnexpectedEOF.Error(),
+  },
+  {
+    "unknown version",
+    func(data []byte) []byte {
+      data[len(MAGIC) + 1] = 9
+      return reseal(data)
+    },
+    "rom: unsupported version 9",
+  },
+  {
+    "trailing bytes",
+    func(data []byte) []byte {
+      body := append(append([]byte{}, data[:len(data) - 4]...), 0xAB, 0xCD)
+      return reseal(append(body, 0, 0, 0, 0))
+    },
+    "rom: 2 unexpected bytes after the symbol table",
+  },
+  {
+    "entry outside the program",
+    func(data []byte) []byte {
+      binary.BigEndian.PutUint16(data[len(MAGIC) + 4:], 0x40)
+      return reseal(data)
+    },
+    "rom: entry point 0x0040 is outside the program",
+  },
+}
+
+func TestReadErrors(t *testing.T) {
+  for _, test := range read_error_tests {
+    data := test.change(write(t, sample_image))
+
+    _, err := Read(bytes.NewReader(data))
+    if err == nil || !strings.Contains(err.Error(), test.want) {
+      t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+    }
+  }
+}
+
+func TestWriteRejectsLongSymbolNames(t *testing.T) {
+  img := &Image{Entry: 1, Code: []uint16{0}, Symbols: []Symbol{{strings.Repeat("x", 256), 1}}}
+
+  if err := Write(io.Discard, img); err == nil {
+    t.Errorf("a symbol name of 256 bytes was written")
+  }
+}
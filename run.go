@@ -0,0 +1,149 @@
+package main
+
+import (
+  "bufio"
+  "context"
+  "flag"
+  "fmt"
+  "os"
+  "vm/devices"
+  "vm/rom"
+  "vm/trace"
+  "vm/vm"
+)
+
+/**
+ * RUN
+ * =============================================================================
+ *
+ * Loads a ROM or assembly program into a fresh machine and runs it until it
+ * halts. With --resume the machine continues from a snapshot instead, the
+ * program is then only needed for its symbols.
+ */
+func run_command(args []string) int {
+  flags := flag.NewFlagSet("run", flag.ExitOnError)
+  trace_file := flags.String("trace", "", "write a trace of every executed instruction to this file")
+  trace_format := flags.String("trace-format", "jsonl", "format of the trace, jsonl or text")
+  max_steps := flags.Uint64("max-steps", 0, "stop after this many instructions, 0 for no limit")
+  timeout := flags.Duration("timeout", 0, "stop after this much time, e.g. 2s, 0 for no limit")
+  snapshot_file := flags.String("snapshot-on-halt", "", "write the machine state to this file when the program stops")
+  resume_file := flags.String("resume", "", "continue from a snapshot written by --snapshot-on-halt")
+  optimize := flags.Bool("opt", false, "run the peephole optimizer over assembly programs")
+  report := flags.Bool("opt-report", false, "run the peephole optimizer and print what it did")
+  framebuffer := flags.String("framebuffer", "", "map a framebuffer of WIDTHxHEIGHT pixels and draw it when the program stops")
+  flags.Parse(args)
+
+  if flags.NArg() > 1 || (flags.NArg() == 0 && *resume_file == "") {
+    fmt.Println("vm run [--opt] [--opt-report] [--trace=file.jsonl [--trace-format=jsonl|text]] [--max-steps=n] [--timeout=d] [--snapshot-on-halt=file] [--framebuffer=WxH] prog.rom|prog.asm")
+    fmt.Println("vm run --resume=file [options] [prog.rom|prog.asm]")
+    return EXIT_USAGE
+  }
+
+  format, err := trace.ParseFormat(*trace_format)
+  if err != nil {
+    fmt.Println(err)
+    return EXIT_USAGE
+  }
+
+  var fb *devices.Framebuffer
+  if *framebuffer != "" {
+    var width, height uint16
+    if _, err := fmt.Sscanf(*framebuffer, "%dx%d", &width, &height); err != nil || width == 0 || height == 0 {
+      fmt.Printf("invalid framebuffer size %q, expected WIDTHxHEIGHT like 16x8\n", *framebuffer)
+      return EXIT_USAGE
+    }
+    fb = devices.NewFramebuffer(width, height)
+  }
+
+  img := &rom.Image{}
+
+  if prog_file := flags.Arg(0); prog_file != "" {
+    fmt.Println("Loading program from", prog_file)
+
+    img, err = load_image(prog_file, asm_options{*optimize, *report})
+    if err != nil {
+      fmt.Println("Error loading program:", err)
+      return EXIT_ERROR
+    }
+  }
+
+  var machine *vm.Machine
+  if *resume_file != "" {
+    fmt.Println("Resuming from", *resume_file)
+    machine, err = resume(*resume_file)
+  } else {
+    machine, err = boot(img)
+  }
+  if err != nil {
+    fmt.Println(err)
+    return EXIT_ERROR
+  }
+
+  if fb != nil {
+    if err := devices.MapFramebuffer(machine, fb); err != nil {
+      fmt.Println(err)
+      return EXIT_ERROR
+    }
+  }
+
+  var recorder *trace.Recorder
+  var trace_out *bufio.Writer
+
+  if *trace_file != "" {
+    file, err := os.Create(*trace_file)
+    if err != nil {
+      fmt.Println(err)
+      return EXIT_ERROR
+    }
+    defer file.Close()
+
+    trace_out = bufio.NewWriter(file)
+    recorder = trace.NewRecorder(trace_out, format)
+    machine.Attach(recorder)
+  }
+
+  // The budget counts from where this run starts, also when resuming
+  if *max_steps > 0 {
+    machine.MaxSteps = machine.Cycles + *max_steps
+  }
+
+  if machine.Halted {
+    fmt.Println("The program has already halted")
+  }
+
+  ctx := context.Background()
+  if *timeout > 0 {
+    var cancel context.CancelFunc
+    ctx, cancel = context.WithTimeout(ctx, *timeout)
+    defer cancel()
+  }
+
+  err = machine.Run(ctx)
+
+  if fb != nil {
+    fb.Render(os.Stdout)
+  }
+
+  if *snapshot_file != "" {
+    if err := write_snapshot(*snapshot_file, machine); err != nil {
+      fmt.Println("Error writing snapshot:", err)
+    }
+  }
+
+  // The last entries are still in the buffer, writing them can fail as well
+  if recorder != nil {
+    flush_err := trace_out.Flush()
+    if recorder.Err() != nil {
+      fmt.Println("Error writing trace:", recorder.Err())
+    } else if flush_err != nil {
+      fmt.Println("Error writing trace:", flush_err)
+    }
+  }
+
+  if err != nil {
+    crash_report(os.Stderr, err, img.Symbols)
+    return exit_code(err)
+  }
+
+  return program_exit_code(machine.ExitCode)
+}
@@ -0,0 +1,93 @@
+package trace
+
+import (
+  "bufio"
+  "encoding/json"
+  "fmt"
+  "io"
+  "reflect"
+)
+
+/**
+ * TRACE DIFF
+ * =============================================================================
+ *
+ * Compares two JSON line traces entry by entry and finds the first step at
+ * which the two runs went different ways.
+ */
+type Divergence struct {
+  Step uint64
+
+  // nil if the trace ended before the step
+  A *Entry
+  B *Entry
+}
+
+func (d *Divergence) String() string {
+  return fmt.Sprintf("traces diverge at step %d\n  a: %s\n  b: %s", d.Step, describe(d.A), describe(d.B))
+}
+
+func describe(e *Entry) string {
+  if e == nil {
+    return "<end of trace>"
+  }
+  return FormatText(*e)
+}
+
+// Returns the first diverging step of two traces, or nil if they are equal.
+// The second return value is the number of steps compared.
+func Diff(a io.Reader, b io.Reader) (*Divergence, uint64, error) {
+  ra, rb := newReader(a), newReader(b)
+
+  var steps uint64 = 0
+
+  for {
+    ea, err := ra.next()
+    if err != nil {
+      return nil, steps, fmt.Errorf("first trace: %v", err)
+    }
+    eb, err := rb.next()
+    if err != nil {
+      return nil, steps, fmt.Errorf("second trace: %v", err)
+    }
+
+    if ea == nil && eb == nil {
+      return nil, steps, nil
+    }
+
+    steps++
+
+    if ea == nil || eb == nil || !reflect.DeepEqual(ea, eb) {
+      return &Divergence{Step: steps, A: ea, B: eb}, steps, nil
+    }
+  }
+}
+
+type reader struct {
+  scanner *bufio.Scanner
+  line int
+}
+
+func newReader(r io.Reader) *reader {
+  return &reader{scanner: bufio.NewScanner(r)}
+}
+
+// Returns the next entry, or nil at the end of the trace
+func (r *reader) next() (*Entry, error) {
+  for r.scanner.Scan() {
+    r.line++
+
+    text := r.scanner.Bytes()
+    if len(text) == 0 {
+      continue
+    }
+
+    var e Entry
+    if err := json.Unmarshal(text, &e); err != nil {
+      return nil, fmt.Errorf("line %d: %v", r.line, err)
+    }
+    return &e, nil
+  }
+
+  return nil, r.scanner.Err()
+}
@@ -0,0 +1,148 @@
+package trace
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "strings"
+  "vm/disassembler"
+  "vm/vm"
+)
+
+/**
+ * EXECUTION TRACES
+ * =============================================================================
+ *
+ * A Recorder observes a machine and writes one entry per executed
+ * instruction: the step number, PC, raw instruction word, the decoded
+ * instruction, the registers it changed, the memory it wrote and the
+ * condition flags afterwards. Steps are numbered by the machine's cycle count,
+ * so the trace of a resumed run carries on where the snapshot left off.
+ *
+ * Traces are written either as JSON lines, one object per instruction, or as
+ * compact text meant for reading.
+ *
+ *   {"step":3,"pc":5,"word":24577,"op":"ADD r0 r0 r1","regs":{"r0":4},"flags":"Z"}
+ *   000003 0x0005 6001 ADD r0 r0 r1          r0=0x0004 [Z]
+ */
+type Format int
+
+const (
+  FORMAT_JSONL Format = iota
+  FORMAT_TEXT
+)
+
+func ParseFormat(name string) (Format, error) {
+  switch name {
+    case "jsonl", "json":
+      return FORMAT_JSONL, nil
+    case "text", "txt":
+      return FORMAT_TEXT, nil
+  }
+  return 0, fmt.Errorf("unknown trace format %q (jsonl or text)", name)
+}
+
+type Write struct {
+  Address uint16 `json:"addr"`
+  Value uint16 `json:"value"`
+}
+
+type Entry struct {
+  Step uint64 `json:"step"`
+  PC uint16 `json:"pc"`
+  Word uint16 `json:"word"`
+  Op string `json:"op"`
+
+  // Registers the instruction changed, the program counter is left out
+  Regs map[string]uint16 `json:"regs,omitempty"`
+  Mem []Write `json:"mem,omitempty"`
+
+  Flags string `json:"flags"`
+}
+
+type Recorder struct {
+  w io.Writer
+  format Format
+
+  entry Entry
+  before [vm.R_COUNT]uint16
+
+  err error
+}
+
+// Creates a recorder writing to w. Attach it to a machine to start tracing.
+func NewRecorder(w io.Writer, format Format) *Recorder {
+  return &Recorder{w: w, format: format}
+}
+
+// Returns the first error that occurred while writing the trace
+func (r *Recorder) Err() error {
+  return r.err
+}
+
+func (r *Recorder) BeforeStep(m *vm.Machine) {
+  pc := m.Reg[vm.R_PC]
+  word := m.Memory[pc]
+
+  r.before = m.Reg
+  r.entry = Entry{Step: m.Cycles, PC: pc, Word: word, Op: decode(word)}
+}
+
+func (r *Recorder) AfterStep(m *vm.Machine, err error) {
+  for i, value := range m.Reg {
+    if i != vm.R_PC && value != r.before[i] {
+      if r.entry.Regs == nil {
+        r.entry.Regs = map[string]uint16{}
+      }
+      r.entry.Regs[vm.RegisterName(i)] = value
+    }
+  }
+  r.entry.Flags = vm.FlagNames(m.Reg[vm.R_COND])
+
+  if r.err == nil {
+    r.err = r.write(r.entry)
+  }
+}
+
+func (r *Recorder) MemoryWrite(m *vm.Machine, address uint16, old uint16, value uint16) {
+  r.entry.Mem = append(r.entry.Mem, Write{Address: address, Value: value})
+}
+
+func (r *Recorder) write(e Entry) error {
+  if r.format == FORMAT_JSONL {
+    line, err := json.Marshal(e)
+    if err != nil {
+      return err
+    }
+    _, err = fmt.Fprintf(r.w, "%s\n", line)
+    return err
+  }
+
+  _, err := fmt.Fprintln(r.w, FormatText(e))
+  return err
+}
+
+// Formats an entry as a single line of compact text
+func FormatText(e Entry) string {
+  var b strings.Builder
+  fmt.Fprintf(&b, "%06d 0x%04X %04X %-20s", e.Step, e.PC, e.Word, e.Op)
+
+  for i := 0; i < vm.R_COUNT; i++ {
+    if value, ok := e.Regs[vm.RegisterName(i)]; ok {
+      fmt.Fprintf(&b, " %s=0x%04X", vm.RegisterName(i), value)
+    }
+  }
+  for _, w := range e.Mem {
+    fmt.Fprintf(&b, " [0x%04X]=0x%04X", w.Address, w.Value)
+  }
+
+  fmt.Fprintf(&b, " [%s]", e.Flags)
+  return b.String()
+}
+
+func decode(word uint16) string {
+  if text, ok := disassembler.Instruction(word); ok {
+    return text
+  }
+  return fmt.Sprintf(".word 0x%04X", word)
+}
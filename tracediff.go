@@ -0,0 +1,59 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "vm/trace"
+)
+
+/**
+ * TRACE DIFF
+ * =============================================================================
+ *
+ * Reports the first step at which two JSON line traces diverge. Exits with 1
+ * if they do, so it can be used in regression scripts. Like cmp, a trace that
+ * cannot be read is told apart from a difference by exiting with 2.
+ */
+const (
+  EXIT_TRACES_DIVERGE = 1
+  EXIT_TRACE_ERROR = 2
+)
+
+func trace_diff_command(args []string) int {
+  flags := flag.NewFlagSet("trace-diff", flag.ExitOnError)
+  flags.Parse(args)
+
+  if flags.NArg() != 2 {
+    fmt.Println("vm trace-diff a.jsonl b.jsonl")
+    return EXIT_USAGE
+  }
+
+  a, err := os.Open(flags.Arg(0))
+  if err != nil {
+    fmt.Println(err)
+    return EXIT_TRACE_ERROR
+  }
+  defer a.Close()
+
+  b, err := os.Open(flags.Arg(1))
+  if err != nil {
+    fmt.Println(err)
+    return EXIT_TRACE_ERROR
+  }
+  defer b.Close()
+
+  divergence, steps, err := trace.Diff(a, b)
+  if err != nil {
+    fmt.Println(err)
+    return EXIT_TRACE_ERROR
+  }
+
+  if divergence != nil {
+    fmt.Println(divergence)
+    return EXIT_TRACES_DIVERGE
+  }
+
+  fmt.Printf("traces are identical (%d steps)\n", steps)
+  return 0
+}
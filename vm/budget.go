@@ -0,0 +1,32 @@
+package vm
+
+import (
+  "fmt"
+)
+
+/**
+ * BUDGETS
+ * =============================================================================
+ *
+ * Programs that cannot be trusted to halt are run with a budget: a maximum
+ * number of instructions in MaxSteps and a deadline on the context passed to
+ * Run. Running out of either stops Run with a BudgetExhausted error. The
+ * machine is not halted, so it can be inspected or given more budget and run
+ * again.
+ */
+type BudgetExhausted struct {
+  // What ran out, the instruction limit or the deadline
+  Reason string
+
+  // Address of the next instruction and the instructions executed so far
+  PC uint16
+  Cycles uint64
+}
+
+func (b *BudgetExhausted) Error() string {
+  return fmt.Sprintf("budget exhausted: %s reached at pc 0x%04X after %d cycles", b.Reason, b.PC, b.Cycles)
+}
+
+func (m *Machine) budget_exhausted(reason string) error {
+  return &BudgetExhausted{Reason: reason, PC: m.Reg[R_PC], Cycles: m.Cycles}
+}
@@ -0,0 +1,57 @@
+package vm
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+)
+
+func TestStepBudget(t *testing.T) {
+  m := load(t, "START\nloop:\nADD r0 r0 #1\nJUMP loop")
+  m.MaxSteps = 10
+
+  err := m.Run(context.Background())
+
+  var budget *BudgetExhausted
+  if !errors.As(err, &budget) {
+    t.Fatalf("got %v, want an exhausted budget", err)
+  }
+  if budget.Cycles != 10 || m.Cycles != 10 {
+    t.Errorf("stopped after %d cycles, want 10", budget.Cycles)
+  }
+  if m.Halted {
+    t.Errorf("machine halted, it should be able to carry on")
+  }
+
+  // More budget continues where the program stopped
+  m.MaxSteps = 20
+  m.Run(context.Background())
+  if m.Reg[R_R0] != 10 {
+    t.Errorf("r0 = %d after 20 steps, want 10", m.Reg[R_R0])
+  }
+}
+
+func TestBudgetLargeEnough(t *testing.T) {
+  m := load(t, "START\nADD r0 r0 #1\nHALT")
+  m.MaxSteps = 2
+
+  if err := m.Run(context.Background()); err != nil || !m.Halted {
+    t.Errorf("got %v, want the program to halt within its budget", err)
+  }
+}
+
+func TestDeadline(t *testing.T) {
+  m := load(t, "START\nloop:\nJUMP loop")
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+  defer cancel()
+
+  var budget *BudgetExhausted
+  if err := m.Run(ctx); !errors.As(err, &budget) {
+    t.Fatalf("got %v, want an exhausted budget", err)
+  }
+  if budget.Reason != "deadline" {
+    t.Errorf("reason %q, want deadline", budget.Reason)
+  }
+}
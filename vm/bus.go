@@ -0,0 +1,70 @@
+package vm
+
+import (
+  "fmt"
+)
+
+/**
+ * DEVICE BUS
+ * =============================================================================
+ *
+ * Address ranges can be claimed by devices. Reads and writes of the running
+ * program within a claimed range go to the device instead of the memory, so
+ * LOADM and STOREM talk to peripherals like a console or a timer.
+ *
+ * Devices see the offset into their range, not the absolute address. Loading a
+ * program unmaps every device, the read/write memory devices live in moves
+ * with the end of the program, so hosts map them again after loading.
+ */
+type Device interface {
+  // Returns the value at the given offset
+  Read(m *Machine, offset uint16) uint16
+
+  // Stores a value at the given offset
+  Write(m *Machine, offset uint16, value uint16)
+}
+
+type mapping struct {
+  base uint16
+  size uint16
+  device Device
+}
+
+// Claims size addresses starting at base for a device
+func (m *Machine) Map(base uint16, size uint16, device Device) error {
+  if size == 0 {
+    return fmt.Errorf("device at %x has no addresses", base)
+  }
+  if int(base) + int(size) > MEMORY_MAX {
+    return fmt.Errorf("device at %x does not fit into memory", base)
+  }
+
+  for _, other := range m.devices {
+    if int(base) < int(other.base) + int(other.size) && int(other.base) < int(base) + int(size) {
+      return fmt.Errorf("device at %x overlaps device at %x", base, other.base)
+    }
+  }
+
+  m.devices = append(m.devices, mapping{base, size, device})
+  return nil
+}
+
+// Releases the range of the device mapped at base
+func (m *Machine) Unmap(base uint16) {
+  for i, d := range m.devices {
+    if d.base == base {
+      m.devices = append(m.devices[:i], m.devices[i + 1:]...)
+      return
+    }
+  }
+}
+
+// Returns the device claiming an address and the offset into its range
+func (m *Machine) device(address uint16) (Device, uint16, bool) {
+  for _, d := range m.devices {
+    if address >= d.base && address - d.base < d.size {
+      return d.device, address - d.base, true
+    }
+  }
+  return nil, 0, false
+}
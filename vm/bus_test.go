@@ -0,0 +1,112 @@
+package vm
+
+import (
+  "context"
+  "testing"
+)
+
+// A device remembering the last write, reading back the offset plus the value
+type test_device struct {
+  offset uint16
+  value uint16
+}
+
+func (d *test_device) Read(m *Machine, offset uint16) uint16 {
+  return offset + d.value
+}
+
+func (d *test_device) Write(m *Machine, offset uint16, value uint16) {
+  d.offset, d.value = offset, value
+}
+
+func TestDeviceAccess(t *testing.T) {
+  m := load(t, "CONST 40\nSTART\nLOADC r0 0\nSTOREM r0 11\nLOADM r1 12\nHALT")
+  device := &test_device{}
+  if err := m.Map(m.Reg[R_MAR] + 10, 4, device); err != nil {
+    t.Fatal(err)
+  }
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if device.offset != 1 || device.value != 40 {
+    t.Errorf("device got %d at offset %d, want 40 at offset 1", device.value, device.offset)
+  }
+  if m.Reg[R_R1] != 42 {
+    t.Errorf("r1 = %d, want 42 read from the device", m.Reg[R_R1])
+  }
+  if m.Memory[m.Reg[R_MAR] + 11] != 0 {
+    t.Errorf("the write reached the memory behind the device")
+  }
+}
+
+var map_tests = []struct {
+  name string
+  base uint16
+  size uint16
+  ok bool
+}{
+  {"next to it", 0x1010, 0x10, true},
+  {"right before it", 0x0FF0, 0x10, true},
+  {"overlapping the start", 0x0FF8, 0x10, false},
+  {"overlapping the end", 0x100F, 1, false},
+  {"inside", 0x1004, 2, false},
+  {"empty", 0x2000, 0, false},
+  {"past the end of memory", 0xFFFF, 2, false},
+}
+
+func TestMap(t *testing.T) {
+  for _, test := range map_tests {
+    t.Run(test.name, func(t *testing.T) {
+      m := New()
+      if err := m.Map(0x1000, 0x10, &test_device{}); err != nil {
+        t.Fatal(err)
+      }
+
+      err := m.Map(test.base, test.size, &test_device{})
+      if test.ok && err != nil {
+        t.Errorf("mapping failed: %v", err)
+      } else if !test.ok && err == nil {
+        t.Errorf("mapping 0x%04X+%d succeeded", test.base, test.size)
+      }
+    })
+  }
+}
+
+// Ranges that end with the memory still overlap
+func TestMapAtTheEndOfMemory(t *testing.T) {
+  m := New()
+  if err := m.Map(0xFFF0, 0x10, &test_device{}); err != nil {
+    t.Fatal(err)
+  }
+  if err := m.Map(0xFFFF, 1, &test_device{}); err == nil {
+    t.Errorf("mapping the last word twice succeeded")
+  }
+}
+
+func TestUnmap(t *testing.T) {
+  m := load(t, "CONST 40\nSTART\nLOADC r0 0\nSTOREM r0 0\nHALT")
+  device := &test_device{}
+  m.Map(m.Reg[R_MAR], 1, device)
+  m.Unmap(m.Reg[R_MAR])
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if device.value != 0 || m.Memory[m.Reg[R_MAR]] != 40 {
+    t.Errorf("the write went to the unmapped device")
+  }
+}
+
+func TestLoadUnmapsDevices(t *testing.T) {
+  m := New()
+  m.Map(0x2000, 1, &test_device{})
+
+  m.Load([]uint16{1, 0})
+  if _, _, ok := m.device(0x2000); ok {
+    t.Errorf("the device is still mapped after loading a program")
+  }
+  if err := m.Map(0x2000, 1, &test_device{}); err != nil {
+    t.Errorf("mapping the range again failed: %v", err)
+  }
+}
@@ -0,0 +1,111 @@
+package vm
+
+import (
+  "fmt"
+)
+
+/**
+ * FAULTS
+ * =============================================================================
+ *
+ * When the program does something the machine cannot carry out it stops with
+ * a Fault. The fault tells what went wrong, the address and word of the
+ * faulting instruction and holds a copy of the registers at that point, so
+ * hosts can report the crash or inspect it.
+ */
+type FaultKind int
+
+const (
+  FAULT_ILLEGAL_INSTRUCTION FaultKind = iota
+  FAULT_DIVIDE_BY_ZERO
+  FAULT_MEMORY
+  FAULT_STACK_OVERFLOW
+  FAULT_STACK_UNDERFLOW
+  FAULT_PC_OVERFLOW
+)
+
+func (k FaultKind) String() string {
+  switch k {
+    case FAULT_ILLEGAL_INSTRUCTION:
+      return "illegal instruction"
+    case FAULT_DIVIDE_BY_ZERO:
+      return "divide by zero"
+    case FAULT_MEMORY:
+      return "memory violation"
+    case FAULT_STACK_OVERFLOW:
+      return "stack overflow"
+    case FAULT_STACK_UNDERFLOW:
+      return "stack underflow"
+    case FAULT_PC_OVERFLOW:
+      return "pc ran off the end of memory"
+  }
+  return "unknown fault"
+}
+
+// Kind of memory access that caused a memory violation
+type Access int
+
+const (
+  ACCESS_READ Access = iota
+  ACCESS_WRITE
+  ACCESS_EXECUTE
+)
+
+func (a Access) String() string {
+  switch a {
+    case ACCESS_READ:
+      return "read"
+    case ACCESS_WRITE:
+      return "write"
+    case ACCESS_EXECUTE:
+      return "execute"
+  }
+  return "unknown"
+}
+
+type Fault struct {
+  Kind FaultKind
+
+  // Address and word of the faulting instruction
+  PC uint16
+  Word uint16
+
+  // Registers when the fault occurred
+  Regs [R_COUNT]uint16
+
+  // The access and address of a memory violation
+  Access Access
+  Address uint16
+
+  Reason string
+}
+
+func (f *Fault) Error() string {
+  if f.Kind == FAULT_MEMORY {
+    return fmt.Sprintf("%s fault at 0x%04X (pc 0x%04X): %s", f.Access, f.Address, f.PC, f.Reason)
+  }
+  if f.Reason == "" {
+    return fmt.Sprintf("%s (pc 0x%04X)", f.Kind, f.PC)
+  }
+  return fmt.Sprintf("%s (pc 0x%04X): %s", f.Kind, f.PC, f.Reason)
+}
+
+// Returns a fault for the instruction being executed. PC already points at
+// the next instruction once one is decoded, so the address of the faulting
+// one is remembered by execute.
+func (m *Machine) fault(kind FaultKind, reason string) *Fault {
+  return &Fault{
+    Kind: kind,
+    PC: m.instr_pc,
+    Word: m.Memory[m.instr_pc],
+    Regs: m.Reg,
+    Reason: reason,
+  }
+}
+
+func (m *Machine) memory_fault(access Access, address uint16, reason string) *Fault {
+  f := m.fault(FAULT_MEMORY, reason)
+  f.Access = access
+  f.Address = address
+  return f
+}
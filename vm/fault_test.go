@@ -0,0 +1,76 @@
+package vm
+
+import (
+  "context"
+  "errors"
+  "testing"
+)
+
+/**
+ * FAULTS
+ * =============================================================================
+ *
+ * Every case runs a program into a fault and checks its kind and the address
+ * of the faulting instruction. setup can change the machine after loading.
+ */
+var fault_tests = []struct {
+  name string
+  source string
+  setup func(m *Machine)
+  kind FaultKind
+  pc uint16
+}{
+  {"divide by zero", "CONST 1\nSTART\nLOADC r1 0\nDIV r0 r1 #0", nil, FAULT_DIVIDE_BY_ZERO, 3},
+  {"divide by zero register", "START\nDIV r0 r1 r2", nil, FAULT_DIVIDE_BY_ZERO, 1},
+  {"illegal instruction", "START\n.word 0xEE00", nil, FAULT_ILLEGAL_INSTRUCTION, 1},
+  {"unknown trap", "START\nTRAP x30", nil, FAULT_ILLEGAL_INSTRUCTION, 1},
+  {"stack overflow", "START\nloop:\nPUSH r0\nJUMP loop", nil, FAULT_STACK_OVERFLOW, 1},
+  {"stack underflow", "START\nPOP r0", nil, FAULT_STACK_UNDERFLOW, 1},
+  {"return with an empty stack", "START\nRET", nil, FAULT_STACK_UNDERFLOW, 1},
+  {"execute outside the code", "START\nJUMP out\nHALT\nout:", nil, FAULT_MEMORY, 3},
+  {"write to the constant pool", "CONST 1\nSTART\nSTOREM r0 1\nHALT", func(m *Machine) { m.Reg[R_MAR] = 0 }, FAULT_MEMORY, 2},
+  {"read past the data segment", "START\nLOADM r0 8\nHALT", func(m *Machine) { m.Layout.Data.Size = 8 }, FAULT_MEMORY, 1},
+  {"pc off the end of memory", "START\nHALT", func(m *Machine) { m.Layout = Layout{}; m.Reg[R_PC] = 0xFFFF }, FAULT_PC_OVERFLOW, 0xFFFF},
+}
+
+func TestFaults(t *testing.T) {
+  for _, test := range fault_tests {
+    t.Run(test.name, func(t *testing.T) {
+      m := load(t, test.source)
+      if test.setup != nil {
+        test.setup(m)
+      }
+
+      err := m.Run(context.Background())
+
+      var fault *Fault
+      if !errors.As(err, &fault) {
+        t.Fatalf("got %v, want a fault", err)
+      }
+      if fault.Kind != test.kind {
+        t.Errorf("fault %q, want %q", fault.Kind, test.kind)
+      }
+      if fault.PC != test.pc {
+        t.Errorf("fault at pc 0x%04X, want 0x%04X", fault.PC, test.pc)
+      }
+      if !m.Halted {
+        t.Errorf("machine did not halt on the fault")
+      }
+    })
+  }
+}
+
+func TestFaultRecordsTheMachine(t *testing.T) {
+  m := load(t, "CONST 7\nSTART\nLOADC r3 0\nDIV r0 r3 #0\nHALT")
+
+  var fault *Fault
+  if err := m.Run(context.Background()); !errors.As(err, &fault) {
+    t.Fatalf("got %v, want a fault", err)
+  }
+  if fault.Word != m.Memory[3] {
+    t.Errorf("word 0x%04X, want the DIV 0x%04X", fault.Word, m.Memory[3])
+  }
+  if fault.Regs[R_R3] != 7 {
+    t.Errorf("r3 = %d in the fault, want 7", fault.Regs[R_R3])
+  }
+}
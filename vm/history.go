@@ -0,0 +1,120 @@
+package vm
+
+/**
+ * HISTORY
+ * =============================================================================
+ *
+ * A History is an observer keeping an undo log: the registers before and after
+ * every step and the memory it wrote, with the old values. Undo takes back the
+ * last step, so a debugger can run the program backwards.
+ *
+ * Only the machine itself is rolled back. Output already written, input
+ * already read and the state of devices stay as they are. Writes to a device
+ * are recorded, but undoing them restores the memory behind the device.
+ */
+type MemoryChange struct {
+  Address uint16
+  Old uint16
+  New uint16
+}
+
+type Record struct {
+  // Number of the instruction since the program was loaded, counting from 1
+  Cycle uint64
+
+  PC uint16
+  Word uint16
+
+  Before [R_COUNT]uint16
+  After [R_COUNT]uint16
+  Writes []MemoryChange
+
+  // Exit code before the step
+  ExitCode uint16
+}
+
+// Reports whether the step changed the register
+func (r *Record) Wrote(reg int) bool {
+  return r.Before[reg] != r.After[reg]
+}
+
+// Reports whether the step wrote to the address
+func (r *Record) WroteMemory(address uint16) bool {
+  for _, w := range r.Writes {
+    if w.Address == address {
+      return true
+    }
+  }
+  return false
+}
+
+type History struct {
+  // Maximum number of steps kept, the oldest are dropped first. 0 means no
+  // limit.
+  Limit int
+
+  records []Record
+}
+
+func NewHistory(limit int) *History {
+  return &History{Limit: limit}
+}
+
+// Returns the recorded steps, oldest first
+func (h *History) Records() []Record {
+  return h.records
+}
+
+func (h *History) Len() int {
+  return len(h.records)
+}
+
+// Forgets all recorded steps
+func (h *History) Clear() {
+  h.records = nil
+}
+
+// Takes back the last recorded step. Returns false if there is none.
+func (h *History) Undo(m *Machine) (Record, bool) {
+  if len(h.records) == 0 {
+    return Record{}, false
+  }
+
+  r := h.records[len(h.records) - 1]
+  h.records = h.records[:len(h.records) - 1]
+
+  for i := len(r.Writes) - 1; i >= 0; i-- {
+    m.Memory[r.Writes[i].Address] = r.Writes[i].Old
+  }
+
+  m.Reg = r.Before
+  m.Halted = false
+  m.ExitCode = r.ExitCode
+  m.Cycles = r.Cycle - 1
+
+  return r, true
+}
+
+func (h *History) BeforeStep(m *Machine) {
+  if h.Limit > 0 && len(h.records) >= h.Limit {
+    h.records = h.records[1:]
+  }
+
+  pc := m.Reg[R_PC]
+  h.records = append(h.records, Record{
+    Cycle: m.Cycles,
+    PC: pc,
+    Word: m.Memory[pc],
+    Before: m.Reg,
+    ExitCode: m.ExitCode,
+  })
+}
+
+func (h *History) AfterStep(m *Machine, err error) {
+  h.records[len(h.records) - 1].After = m.Reg
+}
+
+func (h *History) MemoryWrite(m *Machine, address uint16, old uint16, value uint16) {
+  r := &h.records[len(h.records) - 1]
+  r.Writes = append(r.Writes, MemoryChange{address, old, value})
+}
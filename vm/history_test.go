@@ -0,0 +1,73 @@
+package vm
+
+import (
+  "context"
+  "testing"
+)
+
+func TestUndo(t *testing.T) {
+  m := load(t, snapshot_program)
+  start := m.Snapshot()
+
+  history := NewHistory(0)
+  m.Attach(history)
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  steps := history.Len()
+  if uint64(steps) != m.Cycles {
+    t.Fatalf("recorded %d steps of %d", steps, m.Cycles)
+  }
+
+  for i := 0; i < steps; i++ {
+    if _, ok := history.Undo(m); !ok {
+      t.Fatalf("undo %d failed", i)
+    }
+  }
+  if _, ok := history.Undo(m); ok {
+    t.Errorf("undo past the first step succeeded")
+  }
+
+  if m.Reg != start.Reg || m.Memory != start.Memory || m.Cycles != 0 || m.Halted {
+    t.Errorf("undoing every step did not restore the loaded program")
+  }
+}
+
+func TestUndoReturnsTheStep(t *testing.T) {
+  m := load(t, "CONST 7\nSTART\nLOADC r0 0\nSTOREM r0 2\nHALT")
+
+  history := NewHistory(0)
+  m.Attach(history)
+  m.Step()
+  m.Step()
+
+  record, ok := history.Undo(m)
+  if !ok {
+    t.Fatal("undo failed")
+  }
+  if record.PC != 3 || !record.WroteMemory(m.Reg[R_MAR] + 2) || record.Wrote(R_R0) {
+    t.Errorf("undid the step at pc 0x%04X, want the STOREM at 0x0003", record.PC)
+  }
+  if m.Memory[m.Reg[R_MAR] + 2] != 0 || m.Reg[R_PC] != 3 {
+    t.Errorf("the STOREM was not undone")
+  }
+}
+
+func TestHistoryLimit(t *testing.T) {
+  m := load(t, snapshot_program)
+
+  history := NewHistory(3)
+  m.Attach(history)
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  records := history.Records()
+  if len(records) != 3 || records[2].Cycle != m.Cycles {
+    t.Errorf("kept %d records, want the last 3", len(records))
+  }
+  if !records[2].Wrote(R_PC) {
+    t.Errorf("the HALT step is not recorded as moving pc")
+  }
+}
@@ -0,0 +1,98 @@
+package vm
+
+import (
+  "fmt"
+)
+
+/**
+ * SEGMENTS
+ * =============================================================================
+ *
+ * Loading a program records where its segments are: the constant pool and the
+ * code are read-only, the data segment right after the code is the read/write
+ * memory mapped at R_MAR.
+ *
+ * The machine faults on writes to a read-only segment, on data accesses past
+ * the 512 slots of the data segment and when the program counter leaves the
+ * code. A machine that never loaded a program has an empty layout and does not
+ * check anything.
+ */
+
+// Size of the read/write memory mapped at R_MAR
+const DATA_SIZE = 512
+
+type Segment struct {
+  Start uint16
+  Size uint16
+}
+
+// Reports whether the address lies within the segment
+func (s Segment) Contains(address uint16) bool {
+  return address >= s.Start && address - s.Start < s.Size
+}
+
+type Layout struct {
+  Constants Segment
+  Code Segment
+  Data Segment
+}
+
+// Derives the layout of a program image: the entry word, the constant pool up
+// to the program start, the code up to the end of the image and the data
+// segment after it
+func image_layout(program []uint16) Layout {
+  if len(program) == 0 {
+    return Layout{}
+  }
+
+  end := uint16(len(program))
+  entry := program[0]
+  if entry < 1 || entry > end {
+    entry = end
+  }
+
+  return Layout{
+    Constants: Segment{CONSTANT_POOL_OFFSET, entry - CONSTANT_POOL_OFFSET},
+    Code: Segment{entry, end - entry},
+    Data: Segment{end, DATA_SIZE},
+  }
+}
+
+func (m *Machine) protected() bool {
+  return m.Layout != Layout{}
+}
+
+// Checks that the program may write to an absolute address
+func (m *Machine) check_write(address uint16) error {
+  if !m.protected() {
+    return nil
+  }
+
+  if address == 0 {
+    return m.memory_fault(ACCESS_WRITE, address, "the program start is read-only")
+  }
+  if m.Layout.Constants.Contains(address) {
+    return m.memory_fault(ACCESS_WRITE, address, "the constant pool is read-only")
+  }
+  if m.Layout.Code.Contains(address) {
+    return m.memory_fault(ACCESS_WRITE, address, "the code segment is read-only")
+  }
+  return nil
+}
+
+// Checks that an offset lies within the data segment
+func (m *Machine) check_data(access Access, offset uint16) error {
+  if !m.protected() || offset < m.Layout.Data.Size {
+    return nil
+  }
+  return m.memory_fault(access, m.Reg[R_MAR] + offset, fmt.Sprintf("offset %d is past the %d slots of the data segment", offset, m.Layout.Data.Size))
+}
+
+// Checks that the instruction at PC may be executed
+func (m *Machine) check_execute() error {
+  pc := m.Reg[R_PC]
+  if !m.protected() || m.Layout.Code.Contains(pc) {
+    return nil
+  }
+  return m.memory_fault(ACCESS_EXECUTE, pc, "outside of the code segment")
+}
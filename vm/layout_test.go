@@ -0,0 +1,140 @@
+package vm
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "vm/assembler"
+)
+
+func TestImageLayout(t *testing.T) {
+  got := image_layout([]uint16{3, 5, 6, 0x1000, 0x0000})
+  want := Layout{
+    Constants: Segment{1, 2},
+    Code: Segment{3, 2},
+    Data: Segment{5, DATA_SIZE},
+  }
+
+  if got != want {
+    t.Errorf("got %+v, want %+v", got, want)
+  }
+}
+
+func TestLoadMapsTheDataSegmentAfterTheCode(t *testing.T) {
+  m := load(t, "CONST 1\nSTART\nHALT")
+
+  if m.Reg[R_MAR] != 3 || m.Layout.Data.Start != 3 {
+    t.Errorf("mar = 0x%04X, want the end of the program 0x0003", m.Reg[R_MAR])
+  }
+}
+
+func TestLoadData(t *testing.T) {
+  program, err := assembler.AssembleProgram("prog.asm", ".data\na: .word 7\nb: .word 9\n.code\nSTART\nLOADM r0 b\nHALT")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  m := New()
+  m.LoadData(program.Image(), program.Data)
+  if m.Reg[R_MAR] != uint16(len(program.Image())) {
+    t.Errorf("mar = 0x%04X, want the end of the program 0x%04X", m.Reg[R_MAR], len(program.Image()))
+  }
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if m.Reg[R_R0] != 9 {
+    t.Errorf("r0 = %d, want the second data word 9", m.Reg[R_R0])
+  }
+}
+
+func TestSegmentContains(t *testing.T) {
+  s := Segment{0xFFF0, 0x10}
+
+  if !s.Contains(0xFFF0) || !s.Contains(0xFFFF) || s.Contains(0xFFEF) {
+    t.Errorf("segment at the end of memory has the wrong bounds")
+  }
+  if (Segment{5, 0}).Contains(5) {
+    t.Errorf("empty segment contains its start")
+  }
+}
+
+/**
+ * PROTECTION
+ * =============================================================================
+ *
+ * Every case runs a program into a protection fault and checks the access, the
+ * address and the faulting instruction. setup can change the machine after
+ * loading.
+ */
+var protection_tests = []struct {
+  name string
+  source string
+  setup func(m *Machine)
+  access Access
+  address uint16
+  pc uint16
+}{
+  {"write to the program start", "START\nSTOREM r0 0\nHALT", func(m *Machine) { m.Reg[R_MAR] = 0 }, ACCESS_WRITE, 0, 1},
+  {"write to the constant pool", "CONST 1\nSTART\nSTOREM r0 1\nHALT", func(m *Machine) { m.Reg[R_MAR] = 0 }, ACCESS_WRITE, 1, 2},
+  {"write to the code", "START\nSTOREM r0 1\nHALT", func(m *Machine) { m.Reg[R_MAR] = 0 }, ACCESS_WRITE, 1, 1},
+  {"read past the data segment", "START\nLOADM r0 8\nHALT", func(m *Machine) { m.Layout.Data.Size = 8 }, ACCESS_READ, 11, 1},
+  {"write past the data segment", "START\nSTOREM r0 8\nHALT", func(m *Machine) { m.Layout.Data.Size = 8 }, ACCESS_WRITE, 11, 1},
+  {"execute outside the code", "START\nJUMP out\nHALT\nout:", nil, ACCESS_EXECUTE, 3, 3},
+  {"start outside the code", "START\nHALT", func(m *Machine) { m.Reg[R_PC] = 0 }, ACCESS_EXECUTE, 0, 0},
+}
+
+func TestProtection(t *testing.T) {
+  for _, test := range protection_tests {
+    t.Run(test.name, func(t *testing.T) {
+      m := load(t, test.source)
+      if test.setup != nil {
+        test.setup(m)
+      }
+
+      err := m.Run(context.Background())
+
+      var fault *Fault
+      if !errors.As(err, &fault) {
+        t.Fatalf("got %v, want a fault", err)
+      }
+      if fault.Access != test.access || fault.Address != test.address || fault.PC != test.pc {
+        t.Errorf("%s fault at 0x%04X (pc 0x%04X), want %s at 0x%04X (pc 0x%04X)", fault.Access, fault.Address, fault.PC, test.access, test.address, test.pc)
+      }
+      if !m.Halted {
+        t.Errorf("machine did not halt on the fault")
+      }
+    })
+  }
+}
+
+func TestLastDataSlot(t *testing.T) {
+  m := load(t, "CONST 9\nSTART\nLOADC r0 0\nSTOREM r0 511\nLOADM r1 511\nHALT")
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if m.Reg[R_R1] != 9 {
+    t.Errorf("r1 = %d, want 9 from the last slot", m.Reg[R_R1])
+  }
+}
+
+func TestStackStaysOutOfTheDataSegment(t *testing.T) {
+  m := load(t, "START\nPUSH r0\nHALT")
+  m.Reg[R_SP] = m.Reg[R_MAR] + DATA_SIZE - 1
+
+  if err := m.Run(context.Background()); err == nil {
+    t.Errorf("pushed into the data segment")
+  }
+}
+
+// A machine without a program does not check its accesses
+func TestUnloadedMachineIsUnprotected(t *testing.T) {
+  m := New()
+  m.Memory[0] = 0x4000 // STOREM r0 0
+  m.Memory[1] = 0x0000 // HALT
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Errorf("got %v", err)
+  }
+}
@@ -0,0 +1,35 @@
+package vm
+
+/**
+ * OBSERVERS
+ * =============================================================================
+ *
+ * Observers are notified around every instruction the machine executes and
+ * about every memory write. They are used by tools like the execution tracer
+ * that need to see what an instruction did without changing the decode loop.
+ */
+type Observer interface {
+  // Called before the instruction at PC is executed
+  BeforeStep(m *Machine)
+
+  // Called after the instruction was executed, err is what Step returns
+  AfterStep(m *Machine, err error)
+
+  // Called for every write to memory, before the value is written
+  MemoryWrite(m *Machine, address uint16, old uint16, value uint16)
+}
+
+// Registers an observer with the machine
+func (m *Machine) Attach(o Observer) {
+  m.observers = append(m.observers, o)
+}
+
+// Removes an observer from the machine
+func (m *Machine) Detach(o Observer) {
+  for i, other := range m.observers {
+    if other == o {
+      m.observers = append(m.observers[:i], m.observers[i + 1:]...)
+      return
+    }
+  }
+}
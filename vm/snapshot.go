@@ -0,0 +1,150 @@
+package vm
+
+import (
+  "bytes"
+  "compress/gzip"
+  "encoding/binary"
+  "fmt"
+  "io"
+)
+
+/**
+ * SNAPSHOTS
+ * =============================================================================
+ *
+ * A snapshot holds the complete state of a machine: memory, registers, the
+ * halted flag, exit code, cycle count and the segments of the loaded program.
+ * Restoring it continues the program exactly where the snapshot was taken.
+ *
+ * Traps, devices, observers and the budget belong to the host and are not part
+ * of a snapshot. A restored machine keeps its own.
+ *
+ * Snapshot files start with the magic "SVMS", the rest is gzip compressed, so
+ * the mostly empty memory takes little space. All numbers are big-endian.
+ *
+ * --------------------------------------------------------------------------
+ * | magic "SVMS" | gzip stream                                             |
+ * --------------------------------------------------------------------------
+ * | version | register count | registers | flags | exit code | cycles      |
+ * | constants start, size | code start, size | data start, size | memory   |
+ * --------------------------------------------------------------------------
+ *
+ * Cycles is a 64-bit number, every other field is a 16-bit word.
+ */
+const SNAPSHOT_MAGIC = "SVMS"
+const SNAPSHOT_VERSION = 1
+
+const (
+  SNAPSHOT_HALTED = 1 << 0 /* The machine was halted */
+)
+
+type Snapshot struct {
+  Memory [MEMORY_MAX]uint16
+  Reg [R_COUNT]uint16
+  Halted bool
+  ExitCode uint16
+  Cycles uint64
+  Layout Layout
+}
+
+// Captures the current state of the machine
+func (m *Machine) Snapshot() *Snapshot {
+  return &Snapshot{
+    Memory: m.Memory,
+    Reg: m.Reg,
+    Halted: m.Halted,
+    ExitCode: m.ExitCode,
+    Cycles: m.Cycles,
+    Layout: m.Layout,
+  }
+}
+
+// Puts the machine back into the state of a snapshot
+func (m *Machine) Restore(s *Snapshot) {
+  m.Memory = s.Memory
+  m.Reg = s.Reg
+  m.Halted = s.Halted
+  m.ExitCode = s.ExitCode
+  m.Cycles = s.Cycles
+  m.Layout = s.Layout
+}
+
+// Reports whether the data starts like a snapshot
+func IsSnapshot(data []byte) bool {
+  return bytes.HasPrefix(data, []byte(SNAPSHOT_MAGIC))
+}
+
+// Writes a snapshot in the snapshot file format
+func WriteSnapshot(w io.Writer, s *Snapshot) error {
+  if _, err := io.WriteString(w, SNAPSHOT_MAGIC); err != nil {
+    return err
+  }
+
+  var flags uint16 = 0
+  if s.Halted {
+    flags |= SNAPSHOT_HALTED
+  }
+
+  z := gzip.NewWriter(w)
+
+  for _, field := range []any{
+    uint16(SNAPSHOT_VERSION),
+    uint16(R_COUNT),
+    s.Reg,
+    flags,
+    s.ExitCode,
+    s.Cycles,
+    s.Layout,
+    s.Memory,
+  } {
+    if err := binary.Write(z, binary.BigEndian, field); err != nil {
+      return err
+    }
+  }
+
+  return z.Close()
+}
+
+// Reads a snapshot written by WriteSnapshot
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+  magic := make([]byte, len(SNAPSHOT_MAGIC))
+  if _, err := io.ReadFull(r, magic); err != nil || !IsSnapshot(magic) {
+    return nil, fmt.Errorf("snapshot: not a snapshot file")
+  }
+
+  z, err := gzip.NewReader(r)
+  if err != nil {
+    return nil, fmt.Errorf("snapshot: %v", err)
+  }
+  defer z.Close()
+
+  var header [2]uint16
+  if err := binary.Read(z, binary.BigEndian, &header); err != nil {
+    return nil, fmt.Errorf("snapshot: %v", err)
+  }
+  if header[0] != SNAPSHOT_VERSION {
+    return nil, fmt.Errorf("snapshot: unsupported version %d", header[0])
+  }
+  if header[1] != R_COUNT {
+    return nil, fmt.Errorf("snapshot: has %d registers, the machine %d", header[1], R_COUNT)
+  }
+
+  s := &Snapshot{}
+  var flags uint16
+
+  for _, field := range []any{&s.Reg, &flags, &s.ExitCode, &s.Cycles, &s.Layout, &s.Memory} {
+    if err := binary.Read(z, binary.BigEndian, field); err != nil {
+      return nil, fmt.Errorf("snapshot: %v", err)
+    }
+  }
+  s.Halted = flags & SNAPSHOT_HALTED != 0
+
+  // Reading to the end makes gzip verify its checksum
+  if n, err := io.Copy(io.Discard, z); err != nil {
+    return nil, fmt.Errorf("snapshot: %v", err)
+  } else if n != 0 {
+    return nil, fmt.Errorf("snapshot: %d unexpected bytes at the end", n)
+  }
+
+  return s, nil
+}
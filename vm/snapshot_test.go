@@ -0,0 +1,110 @@
+package vm
+
+import (
+  "bytes"
+  "compress/gzip"
+  "context"
+  "encoding/binary"
+  "testing"
+)
+
+const snapshot_program = `
+CONST 5
+START
+  LOADC r0 0
+loop:
+  PUSH r0
+  STOREM r0 4
+  SUB r0 r0 #1
+  EQ r0 #0
+  HALT
+  JUMP loop
+`
+
+func TestSnapshotResumes(t *testing.T) {
+  whole := load(t, snapshot_program)
+  if err := whole.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  first := load(t, snapshot_program)
+  for i := 0; i < 7; i++ {
+    first.Step()
+  }
+
+  var buf bytes.Buffer
+  if err := WriteSnapshot(&buf, first.Snapshot()); err != nil {
+    t.Fatal(err)
+  }
+  if !IsSnapshot(buf.Bytes()) {
+    t.Fatalf("written snapshot is not recognized")
+  }
+  snapshot, err := ReadSnapshot(&buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  resumed := New()
+  resumed.Restore(snapshot)
+  if err := resumed.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  if resumed.Reg != whole.Reg || resumed.Memory != whole.Memory || resumed.Cycles != whole.Cycles {
+    t.Errorf("resumed machine ended in a different state than the one run at once")
+  }
+  if resumed.Layout != whole.Layout {
+    t.Errorf("layout %+v, want %+v", resumed.Layout, whole.Layout)
+  }
+}
+
+func TestSnapshotOfAHaltedMachine(t *testing.T) {
+  m := load(t, "CONST 3\nSTART\nLOADC r0 0\nEXIT")
+  m.Run(context.Background())
+
+  var buf bytes.Buffer
+  if err := WriteSnapshot(&buf, m.Snapshot()); err != nil {
+    t.Fatal(err)
+  }
+  snapshot, err := ReadSnapshot(&buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if !snapshot.Halted || snapshot.ExitCode != 3 {
+    t.Errorf("halted %v with exit code %d, want halted with 3", snapshot.Halted, snapshot.ExitCode)
+  }
+}
+
+// Writes the magic and a gzip stream holding the given fields
+func raw_snapshot(fields ...any) []byte {
+  var buf bytes.Buffer
+  buf.WriteString(SNAPSHOT_MAGIC)
+
+  z := gzip.NewWriter(&buf)
+  for _, field := range fields {
+    binary.Write(z, binary.BigEndian, field)
+  }
+  z.Close()
+
+  return buf.Bytes()
+}
+
+var snapshot_error_tests = []struct {
+  name string
+  data []byte
+}{
+  {"not a snapshot", []byte("SVMR")},
+  {"not gzip", []byte("SVMSnot gzip")},
+  {"unknown version", raw_snapshot(uint16(9), uint16(R_COUNT))},
+  {"other register count", raw_snapshot(uint16(SNAPSHOT_VERSION), uint16(R_COUNT + 1))},
+  {"truncated", raw_snapshot(uint16(SNAPSHOT_VERSION), uint16(R_COUNT), [R_COUNT]uint16{})},
+}
+
+func TestReadSnapshotErrors(t *testing.T) {
+  for _, test := range snapshot_error_tests {
+    if _, err := ReadSnapshot(bytes.NewReader(test.data)); err == nil {
+      t.Errorf("%s: snapshot was read", test.name)
+    }
+  }
+}
@@ -0,0 +1,40 @@
+package vm
+
+import (
+  "fmt"
+)
+
+/**
+ * STACK
+ * =============================================================================
+ *
+ * The stack starts at the top of memory and grows down towards the read/write
+ * memory. R_SP points at the next free slot, so an empty stack has R_SP set to
+ * STACK_TOP.
+ *
+ * The stack must not grow into the read/write memory, pushing a value when R_SP
+ * reached the end of it is a stack overflow. Popping from an empty stack is a
+ * stack underflow.
+ */
+const STACK_TOP = 0xFFFF
+
+func (m *Machine) push(value uint16) error {
+  if m.Reg[R_SP] < m.Reg[R_MAR] + DATA_SIZE {
+    return m.fault(FAULT_STACK_OVERFLOW, fmt.Sprintf("sp 0x%04X reached the read/write memory", m.Reg[R_SP]))
+  }
+
+  if err := m.mem_write(m.Reg[R_SP], value); err != nil {
+    return err
+  }
+  m.Reg[R_SP]--
+  return nil
+}
+
+func (m *Machine) pop() (uint16, error) {
+  if m.Reg[R_SP] == STACK_TOP {
+    return 0, m.fault(FAULT_STACK_UNDERFLOW, "the stack is empty")
+  }
+
+  m.Reg[R_SP]++
+  return m.lit_mem_read(m.Reg[R_SP]), nil
+}
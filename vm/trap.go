@@ -0,0 +1,130 @@
+package vm
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "strconv"
+  "strings"
+  "vm/instructions"
+)
+
+/**
+ * TRAPS
+ * =============================================================================
+ *
+ * The TRAP instruction calls into the host through a table of 256 handlers,
+ * indexed by the 8-bit vector in the instruction. Machines created with New
+ * come with the standard handlers below, hosts embedding the machine can
+ * replace them or register their own with SetTrap.
+ *
+ * Characters are read from In and written to Out. Strings are stored one
+ * character per word in the read/write memory and end with a zero word. GETC
+ * returns 0xFFFF at the end of the input.
+ *
+ * The vectors of the standard traps are defined in the instructions package.
+ */
+// A trap handler runs on behalf of the program. Returning an error stops the
+// machine.
+type TrapHandler func(m *Machine) error
+
+// Registers the handler for a trap vector, nil removes it
+func (m *Machine) SetTrap(vector uint8, handler TrapHandler) {
+  m.traps[vector] = handler
+}
+
+func (m *Machine) default_traps() {
+  m.SetTrap(instructions.TRAP_GETC, trap_getc)
+  m.SetTrap(instructions.TRAP_PUTC, trap_putc)
+  m.SetTrap(instructions.TRAP_PUTS, trap_puts)
+  m.SetTrap(instructions.TRAP_PUTI, trap_puti)
+  m.SetTrap(instructions.TRAP_PUTX, trap_putx)
+  m.SetTrap(instructions.TRAP_HALT, trap_halt)
+  m.SetTrap(instructions.TRAP_GETI, trap_geti)
+}
+
+func (m *Machine) trap(vector uint8) error {
+  handler := m.traps[vector]
+  if handler == nil {
+    return m.fault(FAULT_ILLEGAL_INSTRUCTION, fmt.Sprintf("no handler for trap vector 0x%02X", vector))
+  }
+  return handler(m)
+}
+
+// Returns a buffered reader for In, so characters and lines can be read by
+// traps and devices without losing input in between
+func (m *Machine) Input() *bufio.Reader {
+  if m.in_source != m.In || m.in == nil {
+    m.in_source = m.In
+    m.in = bufio.NewReader(m.In)
+  }
+  return m.in
+}
+
+func trap_getc(m *Machine) error {
+  c, err := m.Input().ReadByte()
+  if err == io.EOF {
+    m.Reg[R_R0] = 0xFFFF
+  } else if err != nil {
+    return err
+  } else {
+    m.Reg[R_R0] = uint16(c)
+  }
+  m.update_flags(R_R0)
+  return nil
+}
+
+func trap_putc(m *Machine) error {
+  _, err := fmt.Fprintf(m.Out, "%c", rune(m.Reg[R_R0]))
+  return err
+}
+
+func trap_puts(m *Machine) error {
+  var b strings.Builder
+
+  for offset := m.Reg[R_R0]; ; offset++ {
+    c, err := m.map_mem_read(offset)
+    if err != nil {
+      return err
+    }
+    if c == 0 {
+      break
+    }
+    b.WriteRune(rune(c))
+  }
+
+  _, err := io.WriteString(m.Out, b.String())
+  return err
+}
+
+func trap_puti(m *Machine) error {
+  _, err := fmt.Fprintf(m.Out, "%d", int16(m.Reg[R_R0]))
+  return err
+}
+
+func trap_putx(m *Machine) error {
+  _, err := fmt.Fprintf(m.Out, "0x%04X", m.Reg[R_R0])
+  return err
+}
+
+func trap_halt(m *Machine) error {
+  m.ExitCode = m.Reg[R_R0]
+  m.Halted = true
+  return nil
+}
+
+func trap_geti(m *Machine) error {
+  line, err := m.Input().ReadString('\n')
+  if err != nil && (err != io.EOF || line == "") {
+    return err
+  }
+
+  n, err := strconv.ParseInt(strings.TrimSpace(line), 10, 32)
+  if err != nil || n < -0x8000 || n > 0xFFFF {
+    return fmt.Errorf("TRAP GETI: %q is not a 16-bit number", strings.TrimSpace(line))
+  }
+
+  m.Reg[R_R0] = uint16(n)
+  m.update_flags(R_R0)
+  return nil
+}
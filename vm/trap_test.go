@@ -0,0 +1,94 @@
+package vm
+
+import (
+  "bytes"
+  "context"
+  "strings"
+  "testing"
+)
+
+var trap_tests = []struct {
+  name string
+  source string
+  input string
+  output string
+  r0 uint16
+}{
+  {"PUTC", "CONST 65\nSTART\nLOADC r0 0\nPUTC\nHALT", "", "A", 'A'},
+  {"PUTS", "CONST 72\nCONST 105\nCONST 2\nSTART\nLOADC r0 0\nSTOREM r0 2\nLOADC r0 1\nSTOREM r0 3\nLOADC r0 2\nPUTS\nHALT", "", "Hi", 2},
+  {"PUTI", "CONST -42\nSTART\nLOADC r0 0\nPUTI\nHALT", "", "-42", 0xFFD6},
+  {"PUTX", "CONST 0xBEEF\nSTART\nLOADC r0 0\nPUTX\nHALT", "", "0xBEEF", 0xBEEF},
+  {"GETC", "START\nGETC\nHALT", "x", "", 'x'},
+  {"GETC at the end of input", "START\nGETC\nHALT", "", "", 0xFFFF},
+  {"GETI", "START\nGETI\nHALT", "-7\n", "", 0xFFF9},
+  {"GETI without a newline", "START\nGETI\nHALT", "12", "", 12},
+  {"GETC and GETI share the input", "START\nGETC\nGETI\nHALT", "a5\n", "", 5},
+}
+
+func TestTraps(t *testing.T) {
+  for _, test := range trap_tests {
+    t.Run(test.name, func(t *testing.T) {
+      out := &bytes.Buffer{}
+      m := load(t, test.source)
+      m.In = strings.NewReader(test.input)
+      m.Out = out
+
+      if err := m.Run(context.Background()); err != nil {
+        t.Fatalf("run failed: %v", err)
+      }
+      if out.String() != test.output {
+        t.Errorf("output %q, want %q", out.String(), test.output)
+      }
+      if m.Reg[R_R0] != test.r0 {
+        t.Errorf("r0 = 0x%04X, want 0x%04X", m.Reg[R_R0], test.r0)
+      }
+    })
+  }
+}
+
+func TestGetiRejectsGarbage(t *testing.T) {
+  m := load(t, "START\nGETI\nHALT")
+  m.In = strings.NewReader("seven\n")
+
+  if err := m.Run(context.Background()); err == nil || !m.Halted {
+    t.Errorf("got %v, want the machine to stop with an error", err)
+  }
+}
+
+func TestExit(t *testing.T) {
+  m := load(t, "CONST 3\nCONST 4\nSTART\nLOADC r0 0\nEXIT\nLOADC r0 1\nHALT")
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if !m.Halted || m.ExitCode != 3 || m.Reg[R_R0] != 3 {
+    t.Errorf("halted %v with exit code %d and r0 %d, want exit code 3 right at EXIT", m.Halted, m.ExitCode, m.Reg[R_R0])
+  }
+}
+
+func TestSetTrap(t *testing.T) {
+  m := load(t, "START\nTRAP x30\nTRAP x21\nHALT")
+  m.SetTrap(0x30, func(m *Machine) error {
+    m.Reg[R_R0] = 'Z'
+    return nil
+  })
+  m.SetTrap(0x21, func(m *Machine) error {
+    m.Reg[R_R1] = m.Reg[R_R0]
+    return nil
+  })
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if m.Reg[R_R1] != 'Z' {
+    t.Errorf("r1 = %d, the replaced handler did not run", m.Reg[R_R1])
+  }
+}
+
+func TestUnknownTrap(t *testing.T) {
+  m := load(t, "START\nTRAP x30\nHALT")
+
+  if err := m.Run(context.Background()); err == nil || !m.Halted {
+    t.Errorf("got %v, want the machine to stop with an error", err)
+  }
+}
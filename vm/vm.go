@@ -0,0 +1,860 @@
+package vm
+
+import (
+  "bufio"
+  "context"
+  "fmt"
+  "io"
+  "os"
+  "vm/instructions"
+)
+
+const MEMORY_MAX = (1 << 16)
+const INSTRUCTION_SIZE = 16
+const OPCODE_SIZE = 4
+const PARAMETER_SIZE = 12
+const CONSTANT_POOL_OFFSET = 1
+
+/**
+ * MACHINE
+ * =============================================================================
+ *
+ * A Machine owns its memory and registers, so any number of them can run side
+ * by side. Programs are loaded with Load and executed either one instruction
+ * at a time with Step or until they halt with Run.
+ */
+type Machine struct {
+  Memory [MEMORY_MAX]uint16
+  Reg [R_COUNT]uint16
+
+  // Halted is set once the program executed a HALT instruction
+  Halted bool
+
+  // Set by the HALT trap
+  ExitCode uint16
+
+  // Instructions executed since the program was loaded
+  Cycles uint64
+
+  // Run stops once Cycles reaches MaxSteps, 0 means no limit
+  MaxSteps uint64
+
+  // Traps read their input from In and write their output, like the DBG
+  // instruction, to Out
+  In io.Reader
+  Out io.Writer
+
+  traps [256]TrapHandler
+  in_source io.Reader
+  in *bufio.Reader
+
+  // Segments of the loaded program
+  Layout Layout
+
+  observers []Observer
+  devices []mapping
+
+  // Address of the instruction being executed
+  instr_pc uint16
+}
+
+// Creates a new machine with the standard traps, reading its input from stdin
+// and writing its output to stdout
+func New() *Machine {
+  m := &Machine{In: os.Stdin, Out: os.Stdout}
+  m.default_traps()
+  return m
+}
+
+/**
+ * MEMORY
+ * =============================================================================
+ *
+ * The virutal machine has 65536 (2^16) memory locations, each of which can
+ * hold a 16-bit value.
+ *
+ * This means we have a total memory of 128kB
+ */
+
+// Writes to the literal memory at the given address, or the device mapped
+// there
+func (m *Machine) lit_mem_write(address uint16, value uint16) {
+  if device, offset, ok := m.device(address); ok {
+    device.Write(m, offset, value)
+    return
+  }
+  m.Memory[address] = value
+}
+
+// Writes to memory on behalf of the running program, telling the observers.
+// Writes to read-only segments fault.
+func (m *Machine) mem_write(address uint16, value uint16) error {
+  if err := m.check_write(address); err != nil {
+    return err
+  }
+
+  for _, o := range m.observers {
+    o.MemoryWrite(m, address, m.Memory[address], value)
+  }
+  m.lit_mem_write(address, value)
+  return nil
+}
+
+// Reads the literal memory at the given address, or the device mapped there
+func (m *Machine) lit_mem_read(address uint16) uint16 {
+  if device, offset, ok := m.device(address); ok {
+    return device.Read(m, offset)
+  }
+  return m.Memory[address]
+}
+
+func (m *Machine) map_mem_write(address uint16, value uint16) error {
+  if err := m.check_data(ACCESS_WRITE, address); err != nil {
+    return err
+  }
+  return m.mem_write(m.Reg[R_MAR] + address, value)
+}
+
+func (m *Machine) map_mem_read(address uint16) (uint16, error) {
+  if err := m.check_data(ACCESS_READ, address); err != nil {
+    return 0, err
+  }
+  return m.lit_mem_read(m.Reg[R_MAR] + address), nil
+}
+
+
+/**
+ * MEMORY LAYOUT
+ * =============================================================================
+ *
+ * The first block is reversed to hold the memory adress where the program
+ * starts.
+ *
+ * The blocks between the first block and the program start are the constant
+ * pool. Any constant values used by the program can be stored here. The
+ * constant pool is readonly. Constant slots are limited to 512.
+ *
+ * The rest of the memory is used for the program itself.
+ *
+ * The memory block after the program's instructions can be used to as a read
+ * and write memory. They are mapped by an internal helper so they can be
+ * accessed starting at adress 0. The size of the mapped memory is limited to
+ * 512 slots.
+ *
+ * 0: 0x0006 - The program starts at memory adress 6
+ * 1: 0x0001 - Setting constant zero to 1
+ * 2: 0x0002 - Setting constant one to 2
+ * 3: 0x0003 - Setting constant two to 3
+ * 4: 0x0004 - Setting constant three to 4
+ * 5: 0x0005 - Setting constant four to 5
+ * 6: 0x1000 - Program starts here, Loading constant zero into R0
+ * 7: 0x0000 - Program ends here, HALT instruction
+ * 8: 0x0000 - Read/Write memory starts here
+ * ...
+ */
+
+/**
+ * CONSTANT POOL
+ * =============================================================================
+ *
+ * The constant pool is the area of memory before the program that holds
+ * constants that can be loaded using the LOADC instruction.
+ *
+ */
+func (m *Machine) const_read(adress uint16) uint16 {
+  return m.Memory[adress + CONSTANT_POOL_OFFSET]
+}
+
+/**
+ * REGISTERS
+ * =============================================================================
+ *
+ * The virtual machine has 12 total registers.
+ * 8 of them are general purpose registers (R0-R7)
+ *
+ * Each register is 16 bits wide.
+ */
+const (
+  R_R0 = 0x00
+  R_R1 = 0x01
+  R_R2 = 0x02
+  R_R3 = 0x03
+  R_R4 = 0x04
+  R_R5 = 0x05
+  R_R6 = 0x06
+  R_R7 = 0x07
+  R_PC = 0x08   /* program counter */
+  R_COND = 0x09 /* condition flags */
+  R_MAR = 0x0A  /* memory address register */
+  R_SP = 0x0B   /* stack pointer */
+  R_COUNT = 0x0C
+)
+
+// Returns the name tools use for a register, e.g. "r0" or "pc"
+func RegisterName(r int) string {
+  switch r {
+    case R_PC:
+      return "pc"
+    case R_COND:
+      return "cond"
+    case R_MAR:
+      return "mar"
+    case R_SP:
+      return "sp"
+  }
+  return fmt.Sprintf("r%d", r)
+}
+
+/**
+ * CONDITION FLAGS
+ * =============================================================================
+ *
+ * The R_COND register stores condition flags. These hold information about the
+ * most recent calculation. This allows programs to check for logical
+ * conditions.
+ *
+ * Like on the LC-3 every instruction writing a register (LOADC, MOVE, LOADM,
+ * ADD, SUB, MUL, DIV and NOT) sets exactly one of N, Z and P according to the
+ * value written. ADD, SUB and MUL additionally set C when the unsigned result
+ * does not fit into 16 bits (for SUB: when it borrowed) and V when the signed
+ * result does not. All other register writes clear C and V.
+ *
+ * The BR instruction tests the flags.
+ */
+const (
+    FL_POS = 1 << 0 /* Positive */
+    FL_ZRO = 1 << 1 /* Zero */
+    FL_NEG = 1 << 2 /* Negative */
+    FL_CRY = 1 << 3 /* Carry */
+    FL_OVF = 1 << 4 /* Overflow */
+)
+
+// Formats the condition flags as letters, e.g. "N" or "Z"
+func FlagNames(cond uint16) string {
+  names := ""
+  if cond & FL_NEG != 0 {
+    names += "N"
+  }
+  if cond & FL_ZRO != 0 {
+    names += "Z"
+  }
+  if cond & FL_POS != 0 {
+    names += "P"
+  }
+  if cond & FL_CRY != 0 {
+    names += "C"
+  }
+  if cond & FL_OVF != 0 {
+    names += "V"
+  }
+  return names
+}
+
+/**
+ * UTILITY FUNCTIONS
+ * =============================================================================
+ */
+func sign_extend(x uint16, bit_count int) uint16 {
+  if (x >> (bit_count - 1)) & 1 == 1 {
+    x |= (0xFFFF << bit_count)
+  }
+  return x
+}
+
+func (m *Machine) update_flags(r uint16) {
+  if (m.Reg[r] == 0) {
+    m.Reg[R_COND] = FL_ZRO
+  } else if (m.Reg[r] >> 15) == 1 {
+    m.Reg[R_COND] = FL_NEG
+  } else {
+    m.Reg[R_COND] = FL_POS
+  }
+}
+
+func (m *Machine) update_arith_flags(r uint16, carry bool, overflow bool) {
+  m.update_flags(r)
+
+  if carry {
+    m.Reg[R_COND] |= FL_CRY
+  }
+  if overflow {
+    m.Reg[R_COND] |= FL_OVF
+  }
+}
+
+// Loads a program image into memory, records its segments and resets the
+// registers so the next Step executes the first instruction of the program.
+// Devices mapped for the previous program are unmapped.
+func (m *Machine) Load(program []uint16) {
+  for i, instruction := range program {
+    m.Memory[uint16(i)] = instruction
+  }
+
+  m.devices = nil
+
+  m.Reg = [R_COUNT]uint16{}
+  m.Reg[R_COND] = FL_ZRO
+  m.Reg[R_PC] = m.Memory[0x0000]
+  m.Layout = image_layout(program)
+  m.Reg[R_MAR] = m.Layout.Data.Start
+  m.Reg[R_SP] = STACK_TOP
+  m.Halted = false
+  m.ExitCode = 0
+  m.Cycles = 0
+}
+
+// Same as Load, then fills the data segment behind the program with the given
+// words
+func (m *Machine) LoadData(program []uint16, data []uint16) {
+  m.Load(program)
+
+  for i, word := range data {
+    m.Memory[m.Layout.Data.Start + uint16(i)] = word
+  }
+}
+
+/**
+ * MAIN LOOP
+ * =============================================================================
+ */
+
+// Runs the program until it halts, fails, exhausts its budget or the context
+// is cancelled
+func (m *Machine) Run(ctx context.Context) error {
+  for !m.Halted {
+    select {
+      case <-ctx.Done():
+        if ctx.Err() == context.DeadlineExceeded {
+          return m.budget_exhausted("deadline")
+        }
+        return ctx.Err()
+      default:
+    }
+
+    if m.MaxSteps > 0 && m.Cycles >= m.MaxSteps {
+      return m.budget_exhausted(fmt.Sprintf("limit of %d instructions", m.MaxSteps))
+    }
+
+    if err := m.Step(); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// Fetches, decodes and executes a single instruction
+func (m *Machine) Step() error {
+  if m.Halted {
+    return nil
+  }
+
+  m.Cycles++
+
+  if len(m.observers) == 0 {
+    return m.execute()
+  }
+
+  for _, o := range m.observers {
+    o.BeforeStep(m)
+  }
+
+  err := m.execute()
+
+  for _, o := range m.observers {
+    o.AfterStep(m, err)
+  }
+
+  return err
+}
+
+func (m *Machine) execute() error {
+  m.instr_pc = m.Reg[R_PC]
+
+  // The instruction in the last word would leave PC wrapped around to 0
+  if m.instr_pc == MEMORY_MAX - 1 {
+    m.Halted = true
+    return m.fault(FAULT_PC_OVERFLOW, "")
+  }
+
+  if err := m.check_execute(); err != nil {
+    m.Halted = true
+    return err
+  }
+
+  var instr uint16 = m.lit_mem_read(m.Reg[R_PC])
+
+  var op uint16 = instr >> PARAMETER_SIZE
+  m.Reg[R_PC]++
+
+  switch op {
+    case instructions.OP_BR:
+
+      // BR INSTRUCTION
+      //
+      // Branches if any of the selected condition flags is set. A BR without
+      // any condition never branches, it halts the machine instead. That way
+      // 0x0000 stays the HALT instruction.
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |      OP_BR        | v  | c  | n | z | p |         PCOFFSET7         |
+      // -----------------------------------------------------------------------
+
+      cond := (instr >> 7) & 0x1F
+      offset := sign_extend(instr & 0x7F, 7)
+
+      if cond == 0 {
+        m.Halted = true
+      } else if m.Reg[R_COND] & cond != 0 {
+        m.Reg[R_PC] += offset
+      }
+      break;
+
+    case instructions.OP_LOADC:
+
+      // LOADC INSTRUCTION
+      //
+      // CONST9 is the unsigned index of the constant in the constant pool.
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |     OP_LOADC      |     REG     |               CONST9              |
+      // -----------------------------------------------------------------------
+
+      r1 := (instr >> 9) & 0x7
+      c_offset := instr & 0x1FF
+
+      m.Reg[r1] = m.const_read(c_offset)
+      m.update_flags(r1)
+      break
+
+    case instructions.OP_MOVE:
+
+      // MOVE INSTRUCTION
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |     OP_MOVE       |     REG     |    REG    |                       |
+      // -----------------------------------------------------------------------
+
+      r1 := (instr >> 9) & 0x7
+      r2 := (instr >> 6) & 0x7
+
+      m.Reg[r2] = m.Reg[r1]
+      m.update_flags(r2)
+      break
+
+    case instructions.OP_LOADM:
+
+      // LOADM INSTRUCTION
+      //
+      // ADDR9 is the unsigned offset into the mapped read/write memory.
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |     OP_LOADM      |     REG     |               ADDR9               |
+      // -----------------------------------------------------------------------
+
+      r1 := (instr >> 9) & 0x7
+      m_offset := instr & 0x1FF
+
+      value, err := m.map_mem_read(m_offset)
+      if err != nil {
+        m.Halted = true
+        return err
+      }
+
+      m.Reg[r1] = value
+      m.update_flags(r1)
+      break
+
+    case instructions.OP_STOREM:
+
+      // STOREM INSTRUCTION
+      //
+      // ADDR9 is the unsigned offset into the mapped read/write memory.
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |     OP_STOREM     |     REG     |               ADDR9               |
+      // -----------------------------------------------------------------------
+
+      r1 := (instr >> 9) & 0x7
+      m_offset := instr & 0x1FF
+
+      if err := m.map_mem_write(m_offset, m.Reg[r1]); err != nil {
+        m.Halted = true
+        return err
+      }
+      break
+
+    case instructions.OP_JUMP:
+
+      // JUMP INSTRUCTION
+      //
+      // With the link bit set the JUMP is a CALL: the return address is pushed
+      // onto the stack before jumping.
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |     OP_JUMP       | si | l  |                OFFSET                 |
+      // -----------------------------------------------------------------------
+
+      si := (instr >> 11) & 0x1
+      link := (instr >> 10) & 0x1
+      offset := instr & 0x3FF
+
+      if link == 1 {
+        if err := m.push(m.Reg[R_PC]); err != nil {
+          m.Halted = true
+          return err
+        }
+      }
+
+      if si == 0 {
+        m.Reg[R_PC] = m.Reg[R_PC] + offset
+      } else {
+        m.Reg[R_PC] = m.Reg[R_PC] - offset
+      }
+
+      break
+
+    case instructions.OP_ADD:
+
+      // ADD INSTRUCTION
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 0 |    REG    |       |    REG    |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 1 |    REG    |        IMM5       |
+      // -----------------------------------------------------------------------
+
+      dr := (instr >> 9) & 0x7
+      r1 := (instr >> 5) & 0x7
+      imm_flag := (instr >> 8) & 0x1
+
+      a := m.Reg[r1]
+      var b uint16
+
+      if imm_flag == 1 {
+        b = sign_extend(instr & 0x1F, 5)
+      } else {
+        r2 := instr & 0x7
+        b = m.Reg[r2]
+      }
+
+      result := a + b
+      m.Reg[dr] = result
+
+      carry := uint32(a) + uint32(b) > 0xFFFF
+      overflow := (a ^ result) & (b ^ result) & 0x8000 != 0
+      m.update_arith_flags(dr, carry, overflow)
+      break
+
+    case instructions.OP_SUB:
+
+      // SUB INSTRUCTION
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 0 |    REG    |       |    REG    |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 1 |    REG    |        IMM5       |
+      // -----------------------------------------------------------------------
+
+      dr := (instr >> 9) & 0x7
+      r1 := (instr >> 5) & 0x7
+      imm_flag := (instr >> 8) & 0x1
+
+      a := m.Reg[r1]
+      var b uint16
+
+      if imm_flag == 1 {
+        b = sign_extend(instr & 0x1F, 5)
+      } else {
+        r2 := instr & 0x7
+        b = m.Reg[r2]
+      }
+
+      result := a - b
+      m.Reg[dr] = result
+
+      // The carry flag holds the borrow
+      carry := a < b
+      overflow := (a ^ b) & (a ^ result) & 0x8000 != 0
+      m.update_arith_flags(dr, carry, overflow)
+      break
+
+    case instructions.OP_MUL:
+
+      // MUL INSTRUCTION
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 0 |    REG    |       |    REG    |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 1 |    REG    |        IMM5       |
+      // -----------------------------------------------------------------------
+
+      dr := (instr >> 9) & 0x7
+      r1 := (instr >> 5) & 0x7
+      imm_flag := (instr >> 8) & 0x1
+
+      a := m.Reg[r1]
+      var b uint16
+
+      if imm_flag == 1 {
+        b = sign_extend(instr & 0x1F, 5)
+      } else {
+        r2 := instr & 0x7
+        b = m.Reg[r2]
+      }
+
+      m.Reg[dr] = a * b
+
+      carry := uint32(a) * uint32(b) > 0xFFFF
+      product := int32(int16(a)) * int32(int16(b))
+      overflow := product < -0x8000 || product > 0x7FFF
+      m.update_arith_flags(dr, carry, overflow)
+      break
+
+    case instructions.OP_DIV:
+
+      // DIV INSTRUCTION
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 0 |    REG    |       |    REG    |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 1 |    REG    |        IMM5       |
+      // -----------------------------------------------------------------------
+
+      dr := (instr >> 9) & 0x7
+      r1 := (instr >> 5) & 0x7
+      imm_flag := (instr >> 8) & 0x1
+
+      var divisor uint16
+      if imm_flag == 1 {
+        divisor = sign_extend(instr & 0x1F, 5)
+      } else {
+        divisor = m.Reg[instr & 0x7]
+      }
+
+      if divisor == 0 {
+        m.Halted = true
+        return m.fault(FAULT_DIVIDE_BY_ZERO, "")
+      }
+
+      m.Reg[dr] = m.Reg[r1] / divisor
+      m.update_flags(dr)
+      break
+
+    case instructions.OP_NOT:
+
+      // NOT INSTRUCTION
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |      OP_NOT       |     REG     |    REG    |                       |
+      // -----------------------------------------------------------------------
+
+      dr := (instr >> 9) & 0x7
+      sr := (instr >> 6) & 0x7
+
+      m.Reg[dr] = ^m.Reg[sr]
+      m.update_flags(dr)
+
+      break
+
+    case instructions.OP_EQ:
+
+      // EQ INSTRUCTION
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 0 |                   |    REG    |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 1 |             IMM8              |
+      // -----------------------------------------------------------------------
+
+      r1 := (instr >> 9) & 0x7
+      imm_flag := (instr >> 8) & 0x1
+
+      var is_eq bool
+
+      if imm_flag == 1 {
+        imm8 := sign_extend(instr & 0xFF, 8)
+        is_eq = m.Reg[r1] == imm8
+      } else {
+        r2 := instr & 0x7
+        is_eq = m.Reg[r1] == m.Reg[r2]
+      }
+
+      if !is_eq {
+        m.Reg[R_PC]++
+      }
+
+      break
+
+    case instructions.OP_LT:
+
+      // LT INSTRUCTION
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 0 |                   |    REG    |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 1 |             IMM8              |
+      // -----------------------------------------------------------------------
+
+      r1 := (instr >> 9) & 0x7
+      imm_flag := (instr >> 8) & 0x1
+
+      var is_eq bool
+
+      if imm_flag == 1 {
+        imm8 := sign_extend(instr & 0xFF, 8)
+        is_eq = m.Reg[r1] < imm8
+      } else {
+        r2 := instr & 0x7
+        is_eq = m.Reg[r1] < m.Reg[r2]
+      }
+
+      if !is_eq {
+        m.Reg[R_PC]++
+      }
+
+      break
+
+    case instructions.OP_LE:
+
+      // LE INSTRUCTION
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 0 |                   |    REG    |
+      // -----------------------------------------------------------------------
+      // |      OP_ADD       |     REG     | 1 |             IMM8              |
+      // -----------------------------------------------------------------------
+
+      r1 := (instr >> 9) & 0x7
+      imm_flag := (instr >> 8) & 0x1
+
+      var is_eq bool
+
+      if imm_flag == 1 {
+        imm8 := sign_extend(instr & 0xFF, 8)
+        is_eq = m.Reg[r1] <= imm8
+      } else {
+        r2 := instr & 0x7
+        is_eq = m.Reg[r1] <= m.Reg[r2]
+      }
+
+      if !is_eq {
+        m.Reg[R_PC]++
+      }
+
+      break
+
+    case instructions.OP_EXT:
+
+      // EXTENDED INSTRUCTIONS
+      //
+      // The remaining instructions share an opcode and are told apart by the
+      // three bits following it.
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |      OP_EXT       |    EXT_OP   |    REG    |                       |
+      // -----------------------------------------------------------------------
+
+      ext := (instr >> 9) & 0x7
+      r1 := (instr >> 6) & 0x7
+
+      switch ext {
+        case instructions.EXT_DBG:
+
+          // Prints the current value of general purpose registers to stdout
+
+          fmt.Fprintf(m.Out, "PC\tR0\tR1\tR2\tR3\tR4\tR5\tR6\tR7\n")
+          fmt.Fprintln(m.Out, "--------------------------------------------------------------------")
+          fmt.Fprintf(m.Out, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", m.Reg[R_PC], m.Reg[0], m.Reg[1], m.Reg[2], m.Reg[3], m.Reg[4], m.Reg[5], m.Reg[6], m.Reg[7])
+          fmt.Fprintln(m.Out, "--------------------------------------------------------------------")
+          fmt.Fprintln(m.Out, "")
+          break;
+
+        case instructions.EXT_PUSH:
+          if err := m.push(m.Reg[r1]); err != nil {
+            m.Halted = true
+            return err
+          }
+          break
+
+        case instructions.EXT_POP:
+          value, err := m.pop()
+          if err != nil {
+            m.Halted = true
+            return err
+          }
+          m.Reg[r1] = value
+          m.update_flags(r1)
+          break
+
+        case instructions.EXT_RET:
+          address, err := m.pop()
+          if err != nil {
+            m.Halted = true
+            return err
+          }
+          m.Reg[R_PC] = address
+          break
+
+        default:
+          m.Halted = true
+          return m.fault(FAULT_ILLEGAL_INSTRUCTION, fmt.Sprintf("unknown instruction 0x%04X", instr))
+      }
+
+      break
+
+    case instructions.OP_TRAP:
+
+      // TRAP INSTRUCTION
+      //
+      // Calls the trap handler registered for the vector.
+      //
+      // -----------------------------------------------------------------------
+      // | 15 | 14 | 13 | 12 | 11 | 10 | 9 | 8 | 7 | 6 | 5 | 4 | 3 | 2 | 1 | 0 |
+      // -----------------------------------------------------------------------
+      // |      OP_TRAP      |                 |           TRAPVECT8           |
+      // -----------------------------------------------------------------------
+
+      if err := m.trap(uint8(instr & 0xFF)); err != nil {
+        m.Halted = true
+        return err
+      }
+      break
+
+    default:
+      m.Halted = true
+      return m.fault(FAULT_ILLEGAL_INSTRUCTION, fmt.Sprintf("unknown instruction 0x%04X", instr))
+  }
+
+  return nil
+}
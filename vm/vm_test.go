@@ -0,0 +1,326 @@
+package vm
+
+import (
+  "context"
+  "strings"
+  "testing"
+  "vm/assembler"
+  "vm/instructions"
+)
+
+// Encodes an instruction from its opcode and parameter bits
+func instruction_word(op uint16, params uint16) uint16 {
+  return op << PARAMETER_SIZE | params
+}
+
+// Assembles a program and loads it into a machine
+func load(t *testing.T, source string) *Machine {
+  t.Helper()
+
+  program, err := assembler.Assemble(source)
+  if err != nil {
+    t.Fatalf("assembling failed:\n%v", err)
+  }
+
+  m := New()
+  m.Load(program)
+  return m
+}
+
+// Adds the constants 5 and 7 into r2: the start address, the constant pool
+// and the code
+var add_program = []uint16{
+  3,
+  5,
+  7,
+  instruction_word(instructions.OP_LOADC, 0 << 9 | 0),
+  instruction_word(instructions.OP_LOADC, 1 << 9 | 1),
+  instruction_word(instructions.OP_ADD, 2 << 9 | 0 << 5 | 1),
+  instruction_word(instructions.OP_HALT, 0),
+}
+
+func TestRun(t *testing.T) {
+  m := New()
+  m.Load(add_program)
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if !m.Halted {
+    t.Errorf("machine did not halt")
+  }
+  if m.Reg[R_R2] != 12 {
+    t.Errorf("r2 = %d, want 12", m.Reg[R_R2])
+  }
+}
+
+func TestStep(t *testing.T) {
+  m := New()
+  m.Load(add_program)
+
+  if m.Reg[R_PC] != 3 {
+    t.Fatalf("pc = %d after loading, want the start address 3", m.Reg[R_PC])
+  }
+
+  m.Step()
+  if m.Reg[R_R0] != 5 || m.Reg[R_PC] != 4 {
+    t.Errorf("after one step r0 = %d and pc = %d, want 5 and 4", m.Reg[R_R0], m.Reg[R_PC])
+  }
+
+  for i := 0; i < 3; i++ {
+    m.Step()
+  }
+  if !m.Halted || m.Reg[R_PC] != 7 {
+    t.Fatalf("halted %v at pc %d, want halted at pc 7", m.Halted, m.Reg[R_PC])
+  }
+
+  // A halted machine stays where it is
+  m.Step()
+  if m.Reg[R_PC] != 7 {
+    t.Errorf("step after HALT moved pc to %d", m.Reg[R_PC])
+  }
+}
+
+func TestMachinesAreIndependent(t *testing.T) {
+  a, b := New(), New()
+  a.Load(add_program)
+  b.Load([]uint16{2, 9, instruction_word(instructions.OP_LOADC, 2 << 9 | 0), instruction_word(instructions.OP_HALT, 0)})
+
+  a.Run(context.Background())
+  b.Run(context.Background())
+
+  if a.Reg[R_R2] != 12 || b.Reg[R_R2] != 9 {
+    t.Errorf("r2 = %d and %d, want 12 and 9", a.Reg[R_R2], b.Reg[R_R2])
+  }
+}
+
+func TestLoadResets(t *testing.T) {
+  m := New()
+  m.Load(add_program)
+  m.Run(context.Background())
+
+  m.Load(add_program)
+  if m.Halted || m.Reg[R_R2] != 0 || m.Reg[R_PC] != 3 {
+    t.Errorf("loading again left halted %v, r2 %d and pc %d", m.Halted, m.Reg[R_R2], m.Reg[R_PC])
+  }
+}
+
+func TestRunCancelled(t *testing.T) {
+  m := New()
+
+  // A JUMP back onto itself never halts
+  m.Load([]uint16{1, instruction_word(instructions.OP_JUMP, 1 << 11 | 1)})
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+
+  if err := m.Run(ctx); err != context.Canceled {
+    t.Errorf("got %v, want context.Canceled", err)
+  }
+}
+
+/**
+ * INSTRUCTIONS
+ * =============================================================================
+ *
+ * Every case runs a program to its HALT and checks the registers it lists and,
+ * unless flags is 0, the condition flags left by the last instruction that set
+ * them.
+ */
+var instruction_tests = []struct {
+  name string
+  source string
+  reg map[int]uint16
+  flags uint16
+}{
+  {"LOADC", "CONST 5\nSTART\nLOADC r0 0\nHALT", map[int]uint16{R_R0: 5}, FL_POS},
+  {"LOADC zero", "CONST 0\nSTART\nLOADC r0 0\nHALT", map[int]uint16{R_R0: 0}, FL_ZRO},
+  {"MOVE", "CONST 0x8000\nSTART\nLOADC r1 0\nMOVE r1 r2\nHALT", map[int]uint16{R_R2: 0x8000}, FL_NEG},
+  {"STOREM and LOADM", "CONST 42\nCONST 0\nSTART\nLOADC r0 0\nSTOREM r0 7\nLOADC r0 1\nLOADM r1 7\nHALT", map[int]uint16{R_R1: 42}, FL_POS},
+  {"STOREM keeps the flags", "CONST 0\nCONST 5\nSTART\nLOADC r0 0\nLOADC r1 1\nSTOREM r0 3\nHALT", nil, FL_POS},
+
+  {"ADD", "CONST 2\nCONST 3\nSTART\nLOADC r1 0\nLOADC r2 1\nADD r0 r1 r2\nHALT", map[int]uint16{R_R0: 5}, FL_POS},
+  {"ADD negative immediate", "CONST 2\nSTART\nLOADC r1 0\nADD r0 r1 #-3\nHALT", map[int]uint16{R_R0: 0xFFFF}, FL_NEG},
+  {"ADD carry", "CONST 0xFFFF\nSTART\nLOADC r1 0\nADD r0 r1 #1\nHALT", map[int]uint16{R_R0: 0}, FL_ZRO | FL_CRY},
+  {"ADD overflow", "CONST 0x7FFF\nSTART\nLOADC r1 0\nADD r0 r1 #1\nHALT", map[int]uint16{R_R0: 0x8000}, FL_NEG | FL_OVF},
+
+  {"SUB", "CONST 5\nSTART\nLOADC r1 0\nSUB r0 r1 #3\nHALT", map[int]uint16{R_R0: 2}, FL_POS},
+  {"SUB borrow", "CONST 0\nSTART\nLOADC r1 0\nSUB r0 r1 #1\nHALT", map[int]uint16{R_R0: 0xFFFF}, FL_NEG | FL_CRY},
+  {"SUB overflow", "CONST 0x8000\nSTART\nLOADC r1 0\nSUB r0 r1 #1\nHALT", map[int]uint16{R_R0: 0x7FFF}, FL_POS | FL_OVF},
+
+  {"MUL", "CONST 3\nSTART\nLOADC r1 0\nMUL r0 r1 #4\nHALT", map[int]uint16{R_R0: 12}, FL_POS},
+  {"MUL carry and overflow", "CONST 0x100\nSTART\nLOADC r1 0\nMUL r0 r1 r1\nHALT", map[int]uint16{R_R0: 0}, FL_ZRO | FL_CRY | FL_OVF},
+  {"MUL overflow", "CONST 0x4000\nSTART\nLOADC r1 0\nMUL r0 r1 #2\nHALT", map[int]uint16{R_R0: 0x8000}, FL_NEG | FL_OVF},
+  {"MUL negative", "CONST -3\nSTART\nLOADC r1 0\nMUL r0 r1 #2\nHALT", map[int]uint16{R_R0: 0xFFFA}, FL_NEG | FL_CRY},
+
+  {"DIV", "CONST 7\nSTART\nLOADC r1 0\nDIV r0 r1 #2\nHALT", map[int]uint16{R_R0: 3}, FL_POS},
+  {"DIV is unsigned", "CONST 0xFFFF\nCONST 2\nSTART\nLOADC r1 0\nLOADC r2 1\nDIV r0 r1 r2\nHALT", map[int]uint16{R_R0: 0x7FFF}, FL_POS},
+  {"NOT", "CONST 0\nSTART\nLOADC r1 0\nNOT r0 r1\nHALT", map[int]uint16{R_R0: 0xFFFF}, FL_NEG},
+  {"writes clear C and V", "CONST 0xFFFF\nSTART\nLOADC r1 0\nADD r0 r1 #1\nMOVE r1 r2\nHALT", map[int]uint16{R_R2: 0xFFFF}, FL_NEG},
+
+  {"EQ equal", "CONST 3\nCONST 1\nSTART\nLOADC r0 0\nEQ r0 #3\nLOADC r1 1\nHALT", map[int]uint16{R_R1: 1}, 0},
+  {"EQ not equal", "CONST 3\nCONST 1\nSTART\nLOADC r0 0\nEQ r0 #4\nLOADC r1 1\nHALT", map[int]uint16{R_R1: 0}, 0},
+  {"EQ registers", "CONST 3\nCONST 1\nSTART\nLOADC r0 0\nLOADC r2 0\nEQ r0 r2\nLOADC r1 1\nHALT", map[int]uint16{R_R1: 1}, 0},
+  {"LT less", "CONST 2\nCONST 1\nSTART\nLOADC r0 0\nLT r0 #3\nLOADC r1 1\nHALT", map[int]uint16{R_R1: 1}, 0},
+  {"LT equal", "CONST 3\nCONST 1\nSTART\nLOADC r0 0\nLT r0 #3\nLOADC r1 1\nHALT", map[int]uint16{R_R1: 0}, 0},
+  {"LT is unsigned", "CONST 0xFFFF\nCONST 1\nSTART\nLOADC r0 0\nLT r0 #1\nLOADC r1 1\nHALT", map[int]uint16{R_R1: 0}, 0},
+
+  {"JUMP forward", "CONST 1\nSTART\nJUMP skip\nLOADC r0 0\nskip:\nHALT", map[int]uint16{R_R0: 0}, 0},
+  {"JUMP back", "CONST 3\nSTART\nLOADC r0 0\nloop:\nSUB r0 r0 #1\nEQ r0 #0\nHALT\nJUMP loop", map[int]uint16{R_R0: 0}, FL_ZRO},
+  {"BR taken", "CONST 0\nCONST 1\nSTART\nLOADC r0 0\nBRz skip\nLOADC r1 1\nskip:\nHALT", map[int]uint16{R_R1: 0}, 0},
+  {"BR not taken", "CONST 5\nCONST 1\nSTART\nLOADC r0 0\nBRz skip\nLOADC r1 1\nskip:\nHALT", map[int]uint16{R_R1: 1}, 0},
+  {"BR on any of its flags", "CONST 5\nCONST 1\nSTART\nLOADC r0 0\nBRnp skip\nLOADC r1 1\nskip:\nHALT", map[int]uint16{R_R1: 0}, 0},
+  {"BR always", "CONST 1\nSTART\nBR skip\nLOADC r1 0\nskip:\nHALT", map[int]uint16{R_R1: 0}, 0},
+  {"BR back", "CONST 3\nSTART\nLOADC r0 0\nloop:\nSUB r0 r0 #1\nBRp loop\nHALT", map[int]uint16{R_R0: 0}, FL_ZRO},
+  {"BR on carry", "CONST 0xFFFF\nCONST 1\nSTART\nLOADC r0 0\nADD r0 r0 #1\nBRc skip\nLOADC r1 1\nskip:\nHALT", map[int]uint16{R_R1: 0}, 0},
+  {"BR on overflow", "CONST 1\nSTART\nLOADC r0 0\nBRv skip\nLOADC r1 0\nskip:\nHALT", map[int]uint16{R_R1: 1}, 0},
+
+  {"CALL and RET", "CONST 9\nSTART\nCALL f\nHALT\nf:\nLOADC r0 0\nRET", map[int]uint16{R_R0: 9, R_SP: STACK_TOP}, FL_POS},
+  {"nested CALL", "CONST 1\nSTART\nCALL f\nHALT\nf:\nCALL g\nADD r0 r0 #1\nRET\ng:\nLOADC r0 0\nRET", map[int]uint16{R_R0: 2, R_SP: STACK_TOP}, FL_POS},
+  {"PUSH and POP", "CONST 7\nCONST 0\nSTART\nLOADC r0 0\nPUSH r0\nLOADC r0 1\nPOP r1\nHALT", map[int]uint16{R_R1: 7, R_SP: STACK_TOP}, FL_POS},
+  {"POP sets the flags", "CONST 0\nCONST 5\nSTART\nLOADC r0 0\nPUSH r0\nLOADC r0 1\nPOP r1\nHALT", map[int]uint16{R_R1: 0}, FL_ZRO},
+  {"PUSH keeps the flags", "CONST 0\nSTART\nLOADC r0 0\nPUSH r0\nHALT", map[int]uint16{R_SP: STACK_TOP - 1}, FL_ZRO},
+}
+
+func TestInstructions(t *testing.T) {
+  for _, test := range instruction_tests {
+    t.Run(test.name, func(t *testing.T) {
+      m := load(t, test.source)
+
+      if err := m.Run(context.Background()); err != nil {
+        t.Fatalf("run failed: %v", err)
+      }
+      if !m.Halted {
+        t.Fatalf("machine did not halt")
+      }
+
+      for r, want := range test.reg {
+        if m.Reg[r] != want {
+          t.Errorf("%s = 0x%04X, want 0x%04X", RegisterName(r), m.Reg[r], want)
+        }
+      }
+      if test.flags != 0 && m.Reg[R_COND] != test.flags {
+        t.Errorf("flags %s, want %s", FlagNames(m.Reg[R_COND]), FlagNames(test.flags))
+      }
+    })
+  }
+}
+
+/**
+ * STACK
+ * =============================================================================
+ */
+func TestStackIsLastInFirstOut(t *testing.T) {
+  m := load(t, "CONST 1\nCONST 2\nSTART\nLOADC r0 0\nLOADC r1 1\nPUSH r0\nPUSH r1\nPOP r2\nPOP r3\nHALT")
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if m.Reg[R_R2] != 2 || m.Reg[R_R3] != 1 {
+    t.Errorf("popped %d and %d, want 2 and 1", m.Reg[R_R2], m.Reg[R_R3])
+  }
+  if m.Memory[STACK_TOP] != 1 || m.Memory[STACK_TOP - 1] != 2 {
+    t.Errorf("stack holds %v, want 1 at the top of memory", m.Memory[STACK_TOP - 1:])
+  }
+}
+
+func TestCallPushesTheReturnAddress(t *testing.T) {
+  m := load(t, "START\nCALL f\nHALT\nf:\nHALT")
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if m.Reg[R_SP] != STACK_TOP - 1 || m.Memory[STACK_TOP] != 2 {
+    t.Errorf("sp = 0x%04X with 0x%04X on the stack, want the return address 2", m.Reg[R_SP], m.Memory[STACK_TOP])
+  }
+}
+
+var stack_error_tests = []struct {
+  name string
+  source string
+}{
+  {"overflow", "START\nloop:\nPUSH r0\nJUMP loop"},
+  {"underflow", "START\nPOP r0\nHALT"},
+  {"return with an empty stack", "START\nRET\nHALT"},
+}
+
+func TestStackErrors(t *testing.T) {
+  for _, test := range stack_error_tests {
+    m := load(t, test.source)
+
+    if err := m.Run(context.Background()); err == nil || !m.Halted {
+      t.Errorf("%s: got %v, want the machine to stop with an error", test.name, err)
+    }
+  }
+}
+
+/**
+ * OFFSETS AND LE
+ * =============================================================================
+ *
+ * LOADC, LOADM and STOREM take their 9-bit operand as an unsigned offset,
+ * STOREM writes at R_MAR plus its offset and LE includes equality.
+ */
+func TestLoadcIndexIsUnsigned(t *testing.T) {
+  m := load(t, strings.Repeat("CONST 0\n", 256) + "CONST 77\nSTART\nLOADC r0 256\nHALT")
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if m.Reg[R_R0] != 77 {
+    t.Errorf("r0 = %d, want constant 256 (77)", m.Reg[R_R0])
+  }
+}
+
+func TestDataOffsetIsUnsigned(t *testing.T) {
+  m := load(t, "CONST 99\nSTART\nLOADC r0 0\nSTOREM r0 300\nLOADM r1 300\nHALT")
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if m.Memory[m.Reg[R_MAR] + 300] != 99 {
+    t.Errorf("STOREM 300 did not write to offset 300")
+  }
+  if m.Reg[R_R1] != 99 {
+    t.Errorf("r1 = %d, LOADM 300 did not read offset 300", m.Reg[R_R1])
+  }
+}
+
+func TestStoremAppliesItsOffset(t *testing.T) {
+  m := load(t, "CONST 5\nSTART\nLOADC r0 0\nSTOREM r0 3\nHALT")
+
+  if err := m.Run(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if m.Memory[m.Reg[R_MAR] + 3] != 5 || m.Memory[m.Reg[R_MAR]] != 0 {
+    t.Errorf("STOREM 3 wrote to %v of the data segment, want offset 3", m.Memory[m.Reg[R_MAR]:m.Reg[R_MAR] + 4])
+  }
+}
+
+// Every program has the constants 2, 3, 4 and 1 at indices 0 to 3
+var le_tests = []struct {
+  name string
+  source string
+  taken bool
+}{
+  {"less", "LOADC r0 0\nLE r0 #3", true},
+  {"equal", "LOADC r0 1\nLE r0 #3", true},
+  {"greater", "LOADC r0 2\nLE r0 #3", false},
+  {"equal registers", "LOADC r0 1\nLOADC r2 1\nLE r0 r2", true},
+  {"greater registers", "LOADC r0 2\nLOADC r2 1\nLE r0 r2", false},
+}
+
+func TestLE(t *testing.T) {
+  for _, test := range le_tests {
+    t.Run(test.name, func(t *testing.T) {
+      m := load(t, "CONST 2\nCONST 3\nCONST 4\nCONST 1\nSTART\n" + test.source + "\nLOADC r1 3\nHALT")
+
+      if err := m.Run(context.Background()); err != nil {
+        t.Fatal(err)
+      }
+      if taken := m.Reg[R_R1] == 1; taken != test.taken {
+        t.Errorf("LE ran the next instruction: %v, want %v", taken, test.taken)
+      }
+    })
+  }
+}